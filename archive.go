@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+// importArchive loads each CSV and JSON file in a zip or tar archive into its own raw table,
+// recorded in core_raw_tables under the archive's row. Other files are listed as skipped.
+func importArchive(ctx context.Context, tx *models.Tx, r *http.Request, file *models.File, compression string) (map[string]interface{}, error) {
+	if file.Compression == "" {
+		file.Compression = compression
+	}
+
+	// Archives are only compared as they are, their files are compared as they're imported
+	hashes := models.FileHashes{Hash: file.Hash}
+	duplicate, link, err := checkDuplicate(ctx, tx, r, hashes)
+	if err != nil {
+		return nil, err
+	}
+	if link {
+		return linkDuplicate(ctx, tx, file, hashes, nil, duplicate)
+	}
+
+	// Like a workbook's, the archive's row has no table of its own
+	query := "INSERT INTO core_raw_tables (source_filename, file_size, datetime_uploaded, file_hash, compression) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+	var uploadID int64
+	err = tx.QueryRowContext(ctx, query, file.Header.Filename, file.Header.Size, time.Now(), file.Hash, file.Compression).Scan(&uploadID)
+	if err != nil {
+		return nil, failedUpload("Failed to save file information to the database", fmt.Errorf("error saving archive: %w", err))
+	}
+
+	tables := []map[string]interface{}{}
+	skipped := []map[string]interface{}{}
+	err = models.WalkArchive(*file, compression, models.DefaultArchiveLimits, func(member models.File) error {
+		name := member.Header.Filename
+		if member.Header.Size == 0 {
+			skipped = append(skipped, map[string]interface{}{"file": name, "reason": "empty file"})
+			return nil
+		}
+		kind, err := sniffFile(r, member)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", name, err)
+		}
+		var imported map[string]interface{}
+		switch kind {
+		case kindCSV:
+			imported, err = importCSVFile(ctx, tx, r, &member, uploadID)
+		case kindJSON:
+			imported, err = importJSONFile(ctx, tx, r, &member, uploadID)
+		default:
+			skipped = append(skipped, map[string]interface{}{"file": name, "reason": "not a CSV or JSON file"})
+			return nil
+		}
+		var uploadErr *uploadError
+		if errors.As(err, &uploadErr) {
+			return &uploadError{status: uploadErr.status, message: name + ": " + uploadErr.message, cause: uploadErr.cause, detail: uploadErr.detail}
+		}
+		if err != nil {
+			return err
+		}
+		imported["file"] = name
+		tables = append(tables, imported)
+		return nil
+	})
+	if err != nil {
+		return nil, archiveUploadError(err)
+	}
+	imported := map[string]interface{}{
+		"id":          uploadID,
+		"compression": file.Compression,
+		"tables":      tables,
+		"skipped":     skipped,
+	}
+	if duplicate != nil {
+		imported["duplicate"] = duplicate
+	}
+	return imported, nil
+}
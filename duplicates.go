@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+// duplicatePolicyFromForm reads what to do with a duplicate upload from the form field duplicates
+func duplicatePolicyFromForm(r *http.Request) (string, error) {
+	policy := r.PostFormValue("duplicates")
+	if policy == "" {
+		return models.DefaultDuplicatePolicy, nil
+	}
+	return policy, models.ValidateDuplicatePolicy(policy)
+}
+
+// checkDuplicate looks for an earlier upload with the same content and applies the request's
+// duplicate policy to it. It returns the duplicate, if there is one and the upload may go ahead,
+// and whether the upload should be linked to it rather than loaded.
+func checkDuplicate(ctx context.Context, tx *models.Tx, r *http.Request, hashes models.FileHashes) (*models.Duplicate, bool, error) {
+	policy, err := duplicatePolicyFromForm(r)
+	if err != nil {
+		return nil, false, badUpload("Invalid duplicate policy: " + err.Error())
+	}
+	duplicate, err := models.FindDuplicate(ctx, tx, hashes)
+	if err != nil {
+		return nil, false, failedUpload("Error processing file", err)
+	}
+	return applyDuplicatePolicy(policy, duplicate)
+}
+
+// applyDuplicatePolicy is checkDuplicate once the duplicate, if any, has been found
+func applyDuplicatePolicy(policy string, duplicate *models.Duplicate) (*models.Duplicate, bool, error) {
+	if duplicate == nil {
+		return nil, false, nil
+	}
+	if policy == models.DuplicatesReject {
+		return nil, false, &uploadError{
+			status:  http.StatusConflict,
+			message: "Upload rejected: " + duplicate.Message,
+			detail:  map[string]interface{}{"duplicate": duplicate},
+		}
+	}
+	return duplicate, policy == models.DuplicatesLink, nil
+}
+
+// linkDuplicate records an upload in core_raw_tables against the table, or the child tables,
+// of the earlier upload it duplicates instead of loading its content again
+func linkDuplicate(ctx context.Context, tx *models.Tx, file *models.File, hashes models.FileHashes, parentID interface{}, duplicate *models.Duplicate) (map[string]interface{}, error) {
+	query := "INSERT INTO core_raw_tables (source_filename, file_size, datetime_uploaded, name, file_hash, file_hash_no_bom, file_hash_trimmed_no_bom, parent_id, compression, duplicate_of, duplicate_match) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id"
+	var uploadID int64
+	err := tx.QueryRowContext(ctx, query, file.Header.Filename, file.Header.Size, time.Now(), nullableString(duplicate.Table),
+		hashes.Hash, nullableString(hashes.HashNoBOM), nullableString(hashes.HashTrimmed), parentID, nullableString(file.Compression),
+		duplicate.UploadID, duplicate.Match).Scan(&uploadID)
+	if err != nil {
+		return nil, failedUpload("Failed to save file information to the database", fmt.Errorf("error linking duplicate: %w", err))
+	}
+	// The counts are the duplicate's, as are the tables they count
+	_, err = tx.ExecContext(ctx, `UPDATE core_raw_tables u SET row_count = d.row_count, row_count_dedup = d.row_count_dedup, dedup_name = d.dedup_name
+	FROM core_raw_tables d WHERE u.id = $1 AND d.id = $2`, uploadID, duplicate.UploadID)
+	if err != nil {
+		return nil, failedUpload("Failed to save file information to the database", fmt.Errorf("error copying row counts: %w", err))
+	}
+	tables, err := models.GetChildTables(ctx, tx, duplicate.UploadID)
+	if err != nil {
+		return nil, failedUpload("Error processing file", err)
+	}
+	return linkedUpload(uploadID, file, duplicate, tables), nil
+}
+
+// linkedUpload describes an upload linked to a duplicate, which has the duplicate's table or tables
+func linkedUpload(uploadID int64, file *models.File, duplicate *models.Duplicate, tables []models.RawTable) map[string]interface{} {
+	linked := map[string]interface{}{
+		"id":        uploadID,
+		"duplicate": duplicate,
+		"linked":    true,
+	}
+	if duplicate.Table != "" {
+		linked["table"] = duplicate.Table
+	}
+	if len(tables) > 0 {
+		linked["tables"] = tables
+	}
+	if file.Compression != "" {
+		linked["compression"] = file.Compression
+	}
+	return linked
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+func TestApplyDuplicatePolicy(t *testing.T) {
+	duplicate := &models.Duplicate{UploadID: 3, Match: models.MatchExact, Message: "duplicate of upload #3 (exact)"}
+	tests := []struct {
+		name      string
+		policy    string
+		duplicate *models.Duplicate
+		want      *models.Duplicate
+		link      bool
+		status    int
+	}{
+		{"no duplicate", models.DuplicatesReject, nil, nil, false, 0},
+		{"reject", models.DuplicatesReject, duplicate, nil, false, http.StatusConflict},
+		{"warn", models.DuplicatesWarn, duplicate, duplicate, false, 0},
+		{"link", models.DuplicatesLink, duplicate, duplicate, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, link, err := applyDuplicatePolicy(tt.policy, tt.duplicate)
+			if got != tt.want || link != tt.link {
+				t.Errorf("applyDuplicatePolicy() = %v, %v, want %v, %v", got, link, tt.want, tt.link)
+			}
+			var uploadErr *uploadError
+			if tt.status == 0 {
+				if err != nil {
+					t.Errorf("applyDuplicatePolicy() error = %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &uploadErr) || uploadErr.status != tt.status || uploadErr.detail["duplicate"] != tt.duplicate {
+				t.Errorf("applyDuplicatePolicy() error = %v, want status %d with the duplicate", err, tt.status)
+			}
+		})
+	}
+}
+
+func TestLinkedUpload(t *testing.T) {
+	duplicate := &models.Duplicate{UploadID: 3, Table: "orders", Match: models.MatchIgnoringBOM}
+	file := &models.File{}
+	want := map[string]interface{}{"id": int64(9), "duplicate": duplicate, "linked": true, "table": "orders"}
+	if got := linkedUpload(9, file, duplicate, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("linkedUpload() = %v, want %v", got, want)
+	}
+
+	// A workbook has no table of its own, but the tables of its sheets
+	workbook := &models.Duplicate{UploadID: 4, Match: models.MatchExact}
+	file.Compression = models.CompressionZip
+	tables := []models.RawTable{{ID: 5, Name: "book_sheet1", SheetName: "Sheet1"}}
+	want = map[string]interface{}{"id": int64(9), "duplicate": workbook, "linked": true, "tables": tables, "compression": models.CompressionZip}
+	if got := linkedUpload(9, file, workbook, tables); !reflect.DeepEqual(got, want) {
+		t.Errorf("linkedUpload() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+// Number of ranked import formats returned with an upload that wasn't matched confidently
+const maxFormatCandidates = 5
+
+// matchFormatFromForm reads the match_format form field. Uploads that don't name an import format
+// are matched against them unless it's false.
+func matchFormatFromForm(r *http.Request) (bool, error) {
+	value := r.PostFormValue("match_format")
+	if value == "" {
+		return true, nil
+	}
+	match, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("match_format must be true or false")
+	}
+	return match, nil
+}
+
+// matchImportFormat ranks the import formats by how well the columns of an upload match them.
+// It returns the format to assign, if the best is a confident match, and the ranking to report.
+func matchImportFormat(ctx context.Context, tx *models.Tx, columns []models.Column) (*models.ImportFormat, map[string]interface{}, error) {
+	formats, err := models.ListImportFormats(ctx, tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	matches := models.MatchFormats(formats, columns, toPostgreSQLName)
+	report := map[string]interface{}{"assigned": nil}
+	if len(matches) > maxFormatCandidates {
+		matches = matches[:maxFormatCandidates]
+	}
+	report["candidates"] = matches
+
+	best := models.ConfidentMatch(matches)
+	if best == nil {
+		return nil, report, nil
+	}
+	report["assigned"] = best.FormatID
+	for i := range formats {
+		if formats[i].ID == best.FormatID {
+			return &formats[i], report, nil
+		}
+	}
+	return nil, report, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nickcoast/gocsv/models"
+)
+
+// writeFormatError reports an error with an import format to the client
+func writeFormatError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidImportFormat):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, models.ErrFormatNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, models.ErrFormatNameTaken), errors.Is(err, models.ErrFormatInUse):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println("Error with import format:", err)
+		http.Error(w, "Error with import format", http.StatusInternalServerError)
+	}
+}
+
+func writeFormat(w http.ResponseWriter, status int, format interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(format)
+}
+
+// formatFromRequest reads an import format sent as JSON in the request body
+func formatFromRequest(w http.ResponseWriter, r *http.Request) (models.ImportFormat, bool) {
+	var format models.ImportFormat
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormValueBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&format); err != nil {
+		http.Error(w, "Invalid import format: "+err.Error(), http.StatusBadRequest)
+		return format, false
+	}
+	return format, true
+}
+
+func formatIDFromRequest(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid import format ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func (env *Env) fetchImportFormats(w http.ResponseWriter, r *http.Request) {
+	formats, err := env.formats.All(r.Context())
+	if err != nil {
+		writeFormatError(w, err)
+		return
+	}
+	writeFormat(w, http.StatusOK, formats)
+}
+
+func (env *Env) fetchImportFormat(w http.ResponseWriter, r *http.Request) {
+	id, ok := formatIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	format, err := env.formats.Get(r.Context(), id)
+	if err != nil {
+		writeFormatError(w, err)
+		return
+	}
+	writeFormat(w, http.StatusOK, format)
+}
+
+func (env *Env) createImportFormat(w http.ResponseWriter, r *http.Request) {
+	format, ok := formatFromRequest(w, r)
+	if !ok {
+		return
+	}
+	format, err := env.formats.Insert(r.Context(), format)
+	if err != nil {
+		writeFormatError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/import-formats/"+strconv.FormatInt(format.ID, 10))
+	writeFormat(w, http.StatusCreated, format)
+}
+
+// updateImportFormat replaces an import format with the one in the request body
+func (env *Env) updateImportFormat(w http.ResponseWriter, r *http.Request) {
+	id, ok := formatIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	format, ok := formatFromRequest(w, r)
+	if !ok {
+		return
+	}
+	format.ID = id
+	format, err := env.formats.Update(r.Context(), format)
+	if err != nil {
+		writeFormatError(w, err)
+		return
+	}
+	writeFormat(w, http.StatusOK, format)
+}
+
+// deleteImportFormat deletes an import format, unless uploads of it are still recorded
+func (env *Env) deleteImportFormat(w http.ResponseWriter, r *http.Request) {
+	id, ok := formatIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := env.formats.Delete(r.Context(), id); err != nil {
+		writeFormatError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
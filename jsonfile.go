@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+// importJSONFile flattens the records of a JSON or NDJSON file into a raw table, recorded in
+// core_raw_tables under parentID if it came out of an archive. parentID is nil otherwise.
+func importJSONFile(ctx context.Context, tx *models.Tx, r *http.Request, file *models.File, parentID interface{}) (map[string]interface{}, error) {
+	jsonOpts, err := jsonOptionsFromForm(r)
+	if err != nil {
+		return nil, badUpload("Invalid JSON options: " + err.Error())
+	}
+	optionsJSON, err := json.Marshal(jsonOpts)
+	if err != nil {
+		return nil, failedUpload("Error processing JSON file", err)
+	}
+	load, err := tableLoadFromForm(r)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is always UTF-8
+	file.Encoding = models.EncodingUTF8
+	file.File.Seek(0, io.SeekStart)
+	tables, err := models.ReadJSON(file.File, jsonOpts)
+	if errors.Is(err, models.ErrInvalidJSON) {
+		return nil, badUpload("Error importing JSON: " + err.Error())
+	}
+	if err != nil {
+		return nil, failedUpload("Error processing JSON file", fmt.Errorf("error reading JSON file: %w", err))
+	}
+
+	lastValue, err := getLastSequenceValue(ctx, tx, "core_raw_tables_id_seq")
+	if err != nil {
+		return nil, failedUpload("Error processing file", fmt.Errorf("error getting last sequence value: %w", err))
+	}
+	tableName := fmt.Sprintf("raw_table_%d", lastValue+1)
+
+	// The file was hashed as it was spooled. The trimmed hash is of the compacted JSON,
+	// so reformatted files hash the same.
+	file.File.Seek(0, io.SeekStart)
+	compacted := sha256.New()
+	err = file.CompactJSON(file.File, compacted)
+	if err != nil {
+		return nil, failedUpload("Error processing file", fmt.Errorf("error compacting JSON file: %w", err))
+	}
+	fileHashCompacted := hex.EncodeToString(compacted.Sum(nil))
+	hashes := models.FileHashes{Hash: file.Hash, HashNoBOM: file.HashNoBOM, HashTrimmed: fileHashCompacted}
+	duplicate, link, err := checkDuplicate(ctx, tx, r, hashes)
+	if err != nil {
+		return nil, err
+	}
+	if link {
+		return linkDuplicate(ctx, tx, file, hashes, parentID, duplicate)
+	}
+
+	query := "INSERT INTO core_raw_tables (source_filename, file_size, datetime_uploaded, name, file_hash, file_hash_no_bom, file_hash_trimmed_no_bom, encoding, json_options, parent_id, compression) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id"
+	var uploadID int64
+	err = tx.QueryRowContext(ctx, query, file.Header.Filename, file.Header.Size, time.Now(), tableName, file.Hash, file.HashNoBOM, fileHashCompacted, file.Encoding, string(optionsJSON), parentID, nullableString(file.Compression)).Scan(&uploadID)
+	if err != nil {
+		return nil, failedUpload("Failed to save file information to the database", err)
+	}
+	columns, loaded, children, err := importJSON(ctx, tx, *file, uploadID, tableName, tables, load)
+	if err != nil {
+		return nil, failedUpload("Error importing data", err)
+	}
+
+	imported := map[string]interface{}{
+		"id":           uploadID,
+		"table":        tableName,
+		"encoding":     file.Encoding,
+		"json_options": jsonOpts,
+		"columns":      columns,
+	}
+	loaded.addTo(imported)
+	if len(children) > 0 {
+		imported["tables"] = children
+	}
+	if duplicate != nil {
+		imported["duplicate"] = duplicate
+	}
+	if file.Compression != "" {
+		imported["compression"] = file.Compression
+	}
+	return imported, nil
+}
+
+// importJSON loads the records of a JSON file into the upload's raw table, and the arrays
+// exploded out of them into child tables recorded under the upload. tables is the result
+// of models.ReadJSON, records first.
+func importJSON(ctx context.Context, tx *models.Tx, file models.File, uploadID int64, tableName string, tables []models.JSONTable, load tableLoad) ([]models.Column, loadedRows, []map[string]interface{}, error) {
+	records := tables[0]
+	columns, loaded, err := loadCellTable(ctx, tx, uploadID, tableName, records.Headers, records.Rows, false, load)
+	if err != nil {
+		return nil, loadedRows{}, nil, err
+	}
+
+	children := []map[string]interface{}{}
+	for _, table := range tables[1:] {
+		id, childName, err := insertArrayTable(ctx, tx, file, uploadID, table.Path)
+		if err != nil {
+			return nil, loadedRows{}, nil, err
+		}
+		childColumns, childLoaded, err := loadCellTable(ctx, tx, id, childName, table.Headers, table.Rows, false, load)
+		if err != nil {
+			return nil, loadedRows{}, nil, fmt.Errorf("error loading array %q: %w", table.Path, err)
+		}
+		child := map[string]interface{}{
+			"id":        id,
+			"table":     childName,
+			"json_path": table.Path,
+			"columns":   childColumns,
+		}
+		childLoaded.addTo(child)
+		children = append(children, child)
+	}
+	return columns, loaded, children, nil
+}
+
+// insertArrayTable records the raw table of the arrays at a path in a JSON upload's records
+func insertArrayTable(ctx context.Context, tx *models.Tx, file models.File, uploadID int64, path string) (int64, string, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT nextval('core_raw_tables_id_seq')").Scan(&id)
+	if err != nil {
+		return 0, "", fmt.Errorf("error getting next raw table id: %w", err)
+	}
+	tableName := fmt.Sprintf("raw_table_%d", id)
+
+	query := "INSERT INTO core_raw_tables (id, parent_id, json_path, name, source_filename, file_size, datetime_uploaded) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	_, err = tx.ExecContext(ctx, query, id, uploadID, path, tableName, file.Header.Filename, file.Header.Size, time.Now())
+	if err != nil {
+		return 0, "", fmt.Errorf("error saving array %q: %w", path, err)
+	}
+	return id, tableName, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nickcoast/gocsv/models"
+)
+
+// Page size of the keys listed in a bucket
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 10000
+)
+
+// applyKeyColumn makes the key_column form field the key of an upload, or else the key column of
+// its import format. A format's key column that the upload doesn't have is skipped.
+func applyKeyColumn(ctx context.Context, tx *models.Tx, r *http.Request, uploadID int64, format *models.ImportFormat) (*models.KeyCounts, error) {
+	column, fromFormat := keyColumn(r.PostFormValue("key_column"), format)
+	if column == "" {
+		return nil, nil
+	}
+	counts, err := models.SetKeyColumn(ctx, tx, uploadID, column)
+	return keyColumnResult(counts, err, fromFormat)
+}
+
+// keyColumn is the key column asked for, or else that of the import format, and whether it's the format's
+func keyColumn(asked string, format *models.ImportFormat) (string, bool) {
+	if asked == "" && format != nil {
+		return format.KeyColumn, true
+	}
+	return asked, false
+}
+
+// keyColumnResult is what applyKeyColumn returns once the key column has been set
+func keyColumnResult(counts models.KeyCounts, err error, fromFormat bool) (*models.KeyCounts, error) {
+	if errors.Is(err, models.ErrUnknownKeyColumn) {
+		if fromFormat {
+			return nil, nil
+		}
+		return nil, badUpload("Invalid key_column: " + err.Error())
+	}
+	if err != nil {
+		return nil, failedUpload("Error reconciling keys", err)
+	}
+	return &counts, nil
+}
+
+// writeKeysError reports an error with an upload's keys to the client
+func writeKeysError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrNoTable), errors.Is(err, models.ErrNoKeyColumn), errors.Is(err, models.ErrUnknownKeyColumn), errors.Is(err, models.ErrUnknownBucket):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println("Error reconciling keys:", err)
+		http.Error(w, "Error reconciling keys", http.StatusInternalServerError)
+	}
+}
+
+// setKeyColumn makes the form field column the key of an upload and reconciles its keys
+// against earlier uploads of the same import format
+func (env *Env) setKeyColumn(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	column := r.PostFormValue("column")
+	if column == "" {
+		http.Error(w, "No key column", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	tx, err := env.upload.DB.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	counts, err := models.SetKeyColumn(ctx, tx, id, column)
+	if err != nil {
+		writeKeysError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error committing transaction", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
+
+// fetchKeyCounts reconciles the keys of an upload again, as earlier uploads may have been
+// deleted since, and returns the counts
+func (env *Env) fetchKeyCounts(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	tx, err := env.upload.DB.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	counts, err := models.ReconcileKeys(ctx, tx, id)
+	if err != nil {
+		writeKeysError(w, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error committing transaction", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counts)
+}
+
+// fetchKeys lists the keys of an upload in a bucket: new, old, unique or duplicated.
+// The query parameters limit and offset page through them in key order.
+func (env *Env) fetchKeys(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := pageFromQuery(r, defaultKeysLimit, maxKeysLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	tx, err := env.upload.DB.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	keys, err := models.ListKeys(ctx, tx, id, vars["bucket"], limit, offset)
+	if err != nil {
+		writeKeysError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"bucket": vars["bucket"],
+		"limit":  limit,
+		"offset": offset,
+		"keys":   keys,
+	})
+}
+
+// pageFromQuery reads the limit and offset query parameters
+func pageFromQuery(r *http.Request, defaultLimit, maxLimit int) (int, int, error) {
+	limit, offset := defaultLimit, 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+		limit = n
+	}
+	if value := r.URL.Query().Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+func TestKeyColumn(t *testing.T) {
+	format := &models.ImportFormat{KeyColumn: "order_id"}
+	tests := []struct {
+		name       string
+		asked      string
+		format     *models.ImportFormat
+		want       string
+		fromFormat bool
+	}{
+		{"asked", "sku", format, "sku", false},
+		{"format's", "", format, "order_id", true},
+		{"no format", "", nil, "", false},
+		{"format without one", "", &models.ImportFormat{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fromFormat := keyColumn(tt.asked, tt.format)
+			if got != tt.want || fromFormat != tt.fromFormat {
+				t.Errorf("keyColumn() = %q, %v, want %q, %v", got, fromFormat, tt.want, tt.fromFormat)
+			}
+		})
+	}
+}
+
+func TestKeyColumnResult(t *testing.T) {
+	counts := models.KeyCounts{Column: "order_id", New: 2}
+	missing := fmt.Errorf("%w: %q", models.ErrUnknownKeyColumn, "order_id")
+	tests := []struct {
+		name       string
+		err        error
+		fromFormat bool
+		want       *models.KeyCounts
+		status     int
+	}{
+		{"set", nil, false, &counts, 0},
+		{"format's key column missing from the upload is skipped", missing, true, nil, 0},
+		{"asked for key column missing", missing, false, nil, http.StatusBadRequest},
+		{"failed", errors.New("connection lost"), true, nil, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keyColumnResult(counts, tt.err, tt.fromFormat)
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("keyColumnResult() = %v, want %v", got, tt.want)
+			}
+			var uploadErr *uploadError
+			switch {
+			case tt.status == 0 && err != nil:
+				t.Errorf("keyColumnResult() error = %v", err)
+			case tt.status != 0 && (!errors.As(err, &uploadErr) || uploadErr.status != tt.status):
+				t.Errorf("keyColumnResult() error = %v, want status %d", err, tt.status)
+			}
+		})
+	}
+}
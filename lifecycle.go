@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nickcoast/gocsv/models"
+)
+
+// Deleted files can be restored until they're purged: the raw tables are dropped, the stored file
+// removed and the metadata deleted. Files deleted longer than the retention are purged every period.
+const (
+	deletedUploadRetention   = 30 * 24 * time.Hour
+	deletedUploadPurgePeriod = 24 * time.Hour
+)
+
+// purgeDeletedUploads purges the uploads deleted longer than retention every period until the
+// program exits
+func purgeDeletedUploads(uploads models.UploadModel, files *models.FileStore, retention, period time.Duration) {
+	for now := range time.Tick(period) {
+		purged, err := purgeDeleted(context.Background(), uploads, files, now.Add(-retention))
+		if err != nil {
+			log.Println("Error purging deleted files:", err)
+		}
+		if len(purged) > 0 {
+			log.Println("Purged deleted files:", len(purged))
+		}
+	}
+}
+
+// purgeDeleted purges the uploads deleted before a time and removes their stored files
+func purgeDeleted(ctx context.Context, uploads models.UploadModel, files *models.FileStore, before time.Time) ([]models.Purged, error) {
+	purged, err := uploads.PurgeDeleted(ctx, before)
+	for _, p := range purged {
+		removeStoredFile(ctx, files, p)
+	}
+	return purged, err
+}
+
+// removeStoredFile removes the file of a purged upload unless another upload refers to it. The
+// purge is committed by now, so a file that can't be removed is only logged.
+func removeStoredFile(ctx context.Context, files *models.FileStore, p models.Purged) {
+	if p.File == "" {
+		return
+	}
+	if err := files.Release(ctx, p.File); err != nil {
+		log.Printf("Error removing the file of purged upload %d: %v", p.ID, err)
+	}
+}
+
+// writeLifecycleError reports an error deleting, restoring or purging a file to the client
+func writeLifecycleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrFileNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, models.ErrNotDeleted), errors.Is(err, models.ErrUploadLinked):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println("Error with file:", err)
+		http.Error(w, "Error with file", http.StatusInternalServerError)
+	}
+}
+
+func fileIDFromRequest(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// deleteFile marks a file deleted. It's hidden from GET /files until it's restored or purged.
+func (env *Env) deleteFile(w http.ResponseWriter, r *http.Request) {
+	id, ok := fileIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := env.upload.Delete(r.Context(), id); err != nil {
+		writeLifecycleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("File deleted successfully"))
+}
+
+func (env *Env) restoreFile(w http.ResponseWriter, r *http.Request) {
+	id, ok := fileIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := env.upload.Restore(r.Context(), id); err != nil {
+		writeLifecycleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("File restored successfully"))
+}
+
+// purgeFile purges a deleted file now rather than when it's been deleted for the retention
+func (env *Env) purgeFile(w http.ResponseWriter, r *http.Request) {
+	id, ok := fileIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	purged, err := env.upload.Purge(r.Context(), id)
+	if err != nil {
+		writeLifecycleError(w, err)
+		return
+	}
+	removeStoredFile(r.Context(), env.files, purged)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(purged)
+}
+
+// purgeDeletedFiles purges the files deleted more than the query parameter days ago, 30 if it's
+// left out. days=0 purges every deleted file.
+func (env *Env) purgeDeletedFiles(w http.ResponseWriter, r *http.Request) {
+	retention := deletedUploadRetention
+	if value := r.URL.Query().Get("days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 0 {
+			http.Error(w, "days must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		retention = time.Duration(days) * 24 * time.Hour
+	}
+	purged, err := purgeDeleted(r.Context(), env.upload, env.files, time.Now().Add(-retention))
+	if err != nil {
+		writeLifecycleError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"purged": purged})
+}
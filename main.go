@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -31,7 +33,10 @@ import (
 )
 
 type Env struct {
-	upload models.UploadModel
+	upload    models.UploadModel
+	formats   models.ImportFormatModel
+	resumable *models.ResumableStore
+	files     *models.FileStore
 }
 
 func main() {
@@ -48,7 +53,8 @@ func main() {
 	db, err := models.NewDB(connStr)
 	//var asdf *db.UploadModel
 	env := &Env{
-		upload: models.UploadModel{DB: db},
+		upload:  models.UploadModel{DB: db},
+		formats: models.ImportFormatModel{DB: db},
 	}
 
 	if err != nil {
@@ -56,22 +62,53 @@ func main() {
 	}
 	defer db.Close()
 
+	env.resumable, err = models.NewResumableStore(resumableUploadDir, resumableUploadTTL)
+	if err != nil {
+		log.Fatalf("Failed to set up resumable uploads: %v", err)
+	}
+	blobs, err := blobStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to set up file storage: %v", err)
+	}
+	env.files = models.NewFileStore(db, blobs)
+	go expireResumableUploads(env.resumable, resumableExpiryPeriod)
+	go purgeDeletedUploads(env.upload, env.files, deletedUploadRetention, deletedUploadPurgePeriod)
+
 	r := mux.NewRouter()
 
 	r.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		handleFileUpload(w, r, db)
+		handleFileUpload(w, r, db, env.files)
 	}).Methods("POST", "OPTIONS")
+	r.HandleFunc("/uploads", env.createResumableUpload).Methods("POST", "OPTIONS")
+	r.HandleFunc("/uploads/{id}", env.fetchResumableUpload).Methods("GET", "HEAD", "OPTIONS")
+	r.HandleFunc("/uploads/{id}", env.appendResumableUpload).Methods("PATCH", "OPTIONS")
+	r.HandleFunc("/uploads/{id}", env.deleteResumableUpload).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/uploads/{id}/finalize", env.finalizeResumableUpload).Methods("POST", "OPTIONS")
 	r.HandleFunc("/files", env.fetchUploadedFiles).Methods("GET", "OPTIONS")
 	r.HandleFunc("/files/{id}", env.deleteFile).Methods("DELETE", "OPTIONS")
-	r.HandleFunc("/import-formats", func(w http.ResponseWriter, r *http.Request) {
-		getImportFormatsHandler(w, r, db)
-	}).Methods("GET", "OPTIONS")
+	r.HandleFunc("/files/{id}/restore", env.restoreFile).Methods("POST", "OPTIONS")
+	r.HandleFunc("/files/{id}/purge", env.purgeFile).Methods("POST", "OPTIONS")
+	r.HandleFunc("/files/{id}/original", env.fetchOriginalFile).Methods("GET", "OPTIONS")
+	r.HandleFunc("/files/purge", env.purgeDeletedFiles).Methods("POST", "OPTIONS")
+	r.HandleFunc("/import-formats", env.fetchImportFormats).Methods("GET", "OPTIONS")
+	r.HandleFunc("/import-formats", env.createImportFormat).Methods("POST", "OPTIONS")
+	r.HandleFunc("/import-formats/{id}", env.fetchImportFormat).Methods("GET", "OPTIONS")
+	r.HandleFunc("/import-formats/{id}", env.updateImportFormat).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/import-formats/{id}", env.deleteImportFormat).Methods("DELETE", "OPTIONS")
 	r.HandleFunc("/update-file-format", func(w http.ResponseWriter, r *http.Request) {
 		updateFileFormatHandler(w, r, db)
 	}).Methods("GET", "OPTIONS")
 	r.HandleFunc("/files/{fileId}", func(w http.ResponseWriter, r *http.Request) {
 		fetchFileDetails(w, r, db)
 	}).Methods("GET", "OPTIONS")
+	r.HandleFunc("/files/{id}/key", env.setKeyColumn).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/files/{id}/keys", env.fetchKeyCounts).Methods("GET", "OPTIONS")
+	r.HandleFunc("/files/{id}/keys/{bucket}", env.fetchKeys).Methods("GET", "OPTIONS")
+	r.HandleFunc("/files/{id}/rejected", env.fetchRejectedRows).Methods("GET", "OPTIONS")
+	r.HandleFunc("/files/{id}/rejected/download", env.downloadRejectedRows).Methods("GET", "OPTIONS")
+	r.HandleFunc("/files/{id}/map", env.mapFile).Methods("POST", "OPTIONS")
+	r.HandleFunc("/files/{id}/validate", env.validateFile).Methods("POST", "OPTIONS")
+	r.HandleFunc("/files/{id}/violations", env.fetchViolations).Methods("GET", "OPTIONS")
 
 	/* r.HandleFunc("/upload", handleFileUpload).Methods("POST")
 	r.HandleFunc("/files", fetchUploadedFiles).Methods("GET")
@@ -82,7 +119,9 @@ func main() {
 	// Add CORS middleware
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000"}, // Change this to the appropriate origin in production
-		AllowedMethods:   []string{"POST", "GET", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"POST", "GET", "HEAD", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Content-Type", "X-Requested-With", "Upload-Offset"},
+		ExposedHeaders:   []string{"Location", "Upload-Offset", "Upload-Length"},
 		AllowCredentials: true,
 	})
 
@@ -211,234 +250,919 @@ func getSecret(key string) (string, error) {
 	return secretValue, nil
 }
 
-func handleFileUpload(w http.ResponseWriter, r *http.Request, db *models.DB) {
-	ctx := r.Context()
-	tx, err := db.BeginTx(ctx)
-	if err != nil {
-		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
-		return
+// Kinds of uploaded file, as told by their content. Archives are told apart by their models.Compression* kind.
+const (
+	kindCSV      = "csv"
+	kindJSON     = "json"
+	kindWorkbook = "workbook"
+)
+
+// uploadError is a problem with an upload that's reported to the client with its status.
+// The cause, if any, is logged rather than shown. Any detail is sent as JSON alongside the message.
+type uploadError struct {
+	status  int
+	message string
+	cause   error
+	detail  map[string]interface{}
+}
+
+func (e *uploadError) Error() string {
+	if e.cause != nil {
+		return e.message + ": " + e.cause.Error()
 	}
-	defer tx.Rollback()
+	return e.message
+}
 
-	err = r.ParseMultipartForm(32 << 20) // 32 MB
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func badUpload(message string) *uploadError {
+	return &uploadError{status: http.StatusBadRequest, message: message}
+}
+
+func failedUpload(message string, cause error) *uploadError {
+	return &uploadError{status: http.StatusInternalServerError, message: message, cause: cause}
+}
+
+// writeUploadError reports an error importing an upload to the client
+func writeUploadError(w http.ResponseWriter, err error) {
+	var uploadErr *uploadError
+	if !errors.As(err, &uploadErr) {
+		uploadErr = failedUpload("Error importing data", err)
+	}
+	if uploadErr.cause != nil {
+		log.Println(uploadErr.message+":", uploadErr.cause)
+	}
+	if uploadErr.detail != nil {
+		body := map[string]interface{}{"error": uploadErr.message}
+		for key, value := range uploadErr.detail {
+			body[key] = value
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(uploadErr.status)
+		json.NewEncoder(w).Encode(body)
 		return
 	}
+	http.Error(w, uploadErr.message, uploadErr.status)
+}
+
+// archiveUploadError reports the errors extracting a compressed upload that are the upload's fault
+func archiveUploadError(err error) error {
+	if errors.Is(err, models.ErrArchiveLimit) {
+		return &uploadError{status: http.StatusRequestEntityTooLarge, message: "Error extracting upload: " + err.Error()}
+	}
+	if errors.Is(err, models.ErrInvalidArchive) {
+		return badUpload("Error extracting upload: " + err.Error())
+	}
+	return err
+}
 
-	f, fhead, err := r.FormFile("file")
-	file := &models.File{File: f, Header: fhead}
+// sniffFile tells what kind of file an upload is from its first 512 bytes, or returns "" if it isn't a kind that can be uploaded
+func sniffFile(r *http.Request, file models.File) (string, error) {
+	file.File.Seek(0, io.SeekStart)
+	defer file.File.Seek(0, io.SeekStart)
+	buffer := make([]byte, 512)
+	n, err := file.File.Read(buffer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return "", err
+	}
+	if compression := models.DetectCompression(buffer[:n]); compression != "" {
+		if compression == models.CompressionZip && models.IsWorkbook(file.File, file.Header.Size) {
+			return kindWorkbook, nil
+		}
+		return compression, nil
 	}
-	defer file.File.Close()
 
 	// Check the MIME type of the uploaded file
-	buffer := make([]byte, 512)
-	_, err = file.File.Read(buffer)
+	contentType := http.DetectContentType(buffer[:n])
+	isText := contentType == "text/csv" || strings.HasPrefix(contentType, "text/plain")
+	// UTF-16 without a BOM is full of zero bytes and sniffed as binary
+	if contentType == "application/octet-stream" {
+		detected := models.DetectEncoding(buffer[:n])
+		isText = r.PostFormValue("encoding") != "" || detected == models.EncodingUTF16LE || detected == models.EncodingUTF16BE
+	}
+	switch {
+	case isText && models.IsJSON(buffer[:n]):
+		return kindJSON, nil
+	case isText:
+		return kindCSV, nil
+	}
+	return "", nil
+}
+
+// Longest value accepted for the fields of the upload form other than the file
+const maxFormValueBytes = 1 << 20
+
+// readUploadForm reads the upload form from the request body in a single pass, spooling the file
+// into a temporary file as it arrives, and scanning its columns with the settings from scan if
+// it's set. The other fields are put in r.PostForm for PostFormValue, whichever side of the file
+// they were sent on. Only those before the file are there when scan is called.
+func readUploadForm(r *http.Request, scan models.ScanSettings) (models.File, error) {
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusBadRequest)
-		return
+		return models.File{}, badUpload(err.Error())
 	}
-	contentType := http.DetectContentType(buffer)
-	if contentType != "text/csv" && contentType != "text/plain; charset=utf-8" && !strings.HasPrefix(contentType, "image/") {
-		http.Error(w, "Invalid file type. Only CSV and image files are allowed", http.StatusBadRequest)
+	var upload *models.File
+	// The spooled file is the caller's to remove once the form has been read in full
+	read := false
+	defer func() {
+		if upload != nil && !read {
+			upload.RemoveTemp()
+		}
+	}()
+	form := url.Values{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return models.File{}, badUpload("Error reading upload: " + err.Error())
+		}
+		if part.FormName() == "file" && part.FileName() != "" && upload == nil {
+			r.PostForm, r.Form = form, form
+			spooled, err := models.SpoolUpload(part, "", filepath.Base(part.FileName()), scan)
+			if err != nil {
+				return models.File{}, failedUpload("Error saving file", err)
+			}
+			upload = &spooled
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormValueBytes+1))
+		if err != nil {
+			return models.File{}, badUpload("Error reading upload: " + err.Error())
+		}
+		if len(value) > maxFormValueBytes {
+			return models.File{}, badUpload("Form field " + part.FormName() + " is too long")
+		}
+		form.Add(part.FormName(), string(value))
+	}
+	r.PostForm, r.Form = form, form
+	if upload == nil {
+		return models.File{}, badUpload("No file uploaded")
+	}
+	read = true
+	return *upload, nil
+}
+
+func handleFileUpload(w http.ResponseWriter, r *http.Request, db *models.DB, files *models.FileStore) {
+	upload, err := readUploadForm(r, csvScanSettings(r, db))
+	if err != nil {
+		writeUploadError(w, err)
 		return
 	}
+	defer upload.RemoveTemp() // unless it's been stored
+	importUpload(w, r, db, files, upload)
+}
 
-	if contentType == "text/csv" || contentType == "text/plain; charset=utf-8" {
-		file.File.Seek(0, 0)
+// importUpload imports a file that's been received in full, taking the import options from the
+// form of r, and keeps it in the file store. It reports whether the import succeeded. Files that
+// can't be imported, such as images, are refused, as nothing would refer to them once kept.
+func importUpload(w http.ResponseWriter, r *http.Request, db *models.DB, files *models.FileStore, upload models.File) bool {
+	ctx := r.Context()
+	file := &upload
+
+	kind, err := sniffFile(r, *file)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return false
+	}
+	// A gzipped file is read as the file inside it, which may be a tar archive
+	if kind == models.CompressionGzip {
+		inner, err := models.Gunzip(*file, models.DefaultArchiveLimits)
 		if err != nil {
-			log.Println("Error getting max column lengths:", err)
-			http.Error(w, "Error processing CSV file", http.StatusInternalServerError)
-			return
+			writeUploadError(w, archiveUploadError(err))
+			return false
 		}
-		//tableName := toPostgreSQLName(handler.Filename)
-
-		sequenceName := "core_raw_tables_id_seq"
-		lastValue, err := getLastSequenceValue(ctx, tx, sequenceName)
+		defer inner.RemoveTemp()
+		inner.Compression = models.CompressionGzip
+		file = &inner
+		kind, err = sniffFile(r, *file)
 		if err != nil {
-			log.Printf("Error getting last sequence value: %v", err)
-			http.Error(w, "Error processing file", http.StatusInternalServerError)
-			return
+			http.Error(w, "Failed to read file", http.StatusBadRequest)
+			return false
+		}
+		if kind == models.CompressionTar {
+			file.Compression = models.CompressionTarGzip
 		}
-		tableName := fmt.Sprintf("raw_table_%d", lastValue+1)
+	}
+	switch kind {
+	case kindJSON, kindCSV, kindWorkbook, models.CompressionZip, models.CompressionTar:
+	default:
+		http.Error(w, "Invalid file type. Only CSV, JSON and Excel files, and archives of them, are allowed", http.StatusBadRequest)
+		return false
+	}
 
-		// Calculate the file hash
-		file.File.Seek(0, 0)
-		fileHash, err := file.CalculateFileHash(file.File)
+	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
+		return false
+	}
+	defer tx.Rollback()
+
+	var imported map[string]interface{}
+	switch kind {
+	case kindJSON:
+		imported, err = importJSONFile(ctx, tx, r, file, nil)
+	case kindCSV:
+		imported, err = importCSVFile(ctx, tx, r, file, nil)
+	case kindWorkbook:
+		imported, err = importWorkbookFile(ctx, tx, r, file)
+	case models.CompressionZip, models.CompressionTar:
+		imported, err = importArchive(ctx, tx, r, file, kind)
+	}
+	if err != nil {
+		writeUploadError(w, err)
+		return false
+	}
+
+	// The upload is kept as it was sent, compressed or not, under the hash of its content
+	savedName, err := files.Put(ctx, tx, upload.Path(), upload.Hash)
+	if err != nil {
+		log.Println("Error storing upload:", err)
+		http.Error(w, "Error saving file", http.StatusInternalServerError)
+		return false
+	}
+	committed := false
+	defer func() {
+		// The name is locked until the rollback, and nothing may refer to the file after it
+		if !committed {
+			tx.Rollback()
+			if err := files.Release(context.Background(), savedName); err != nil {
+				log.Println("Error releasing stored upload:", err)
+			}
+		}
+	}()
+	if id, ok := imported["id"].(int64); ok {
+		_, err = tx.ExecContext(ctx, "UPDATE core_raw_tables SET saved_filename = $2 WHERE id = $1", id, savedName)
 		if err != nil {
-			log.Println("Error calculating file hash:", err)
-			return
+			http.Error(w, "Failed to save file information to the database", http.StatusInternalServerError)
+			return false
 		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		http.Error(w, "Error committing transaction", http.StatusInternalServerError)
+		return false
+	}
+	committed = true
+
+	response := map[string]interface{}{
+		"message": "File uploaded successfully: " + upload.Header.Filename,
+	}
+	for key, value := range imported {
+		response[key] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+	return true
+}
+
+// nullableString is s, or NULL if it's empty
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// csvSettings are how a CSV file is imported, besides what's set on the file itself
+type csvSettings struct {
+	format      *models.ImportFormat
+	formatID    interface{} // NULL unless the upload names an import format
+	typeOpts    models.TypeInferenceOptions
+	dedup       bool
+	matchFormat bool
+}
 
-		// Calculate the file hash without BOM
-		file.File.Seek(0, 0)
-		fileNoBOM := file.RemoveBOM(file.File)
-		fileHashNoBOM, err := file.CalculateFileHash(fileNoBOM)
-		fileTrimmedNoBOM, err := file.RemoveEmptyRows(fileNoBOM)
-		fileHashTrimmedNoBOM, err := file.CalculateFileHash(fileTrimmedNoBOM)
+// readCSVSettings sets the encoding, dialect, parsing profile, layout and row policy of a CSV file
+// and returns the rest of its settings. What the import format says about its files comes before
+// what's detected in the file, and the form fields sent with the upload come before either.
+func readCSVSettings(ctx context.Context, tx *models.Tx, r *http.Request, file *models.File) (csvSettings, error) {
+	var settings csvSettings
+	if value := r.PostFormValue("format_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			log.Println("Error calculating file hash without BOM:", err)
-			return
+			return settings, badUpload("Invalid format_id")
+		}
+		f, err := models.GetImportFormat(ctx, tx, id)
+		if errors.Is(err, models.ErrFormatNotFound) {
+			return settings, badUpload("Unknown import format")
 		}
-
-		query := "INSERT INTO core_raw_tables (source_filename, file_size, datetime_uploaded, name, file_hash, file_hash_no_bom, file_hash_trimmed_no_bom) VALUES ($1, $2, $3, $4, $5, $6, $7)" // could add "RETURNING id"
-		_, err = tx.ExecContext(ctx, query, fhead.Filename, fhead.Size, time.Now(), tableName, fileHash, fileHashNoBOM, fileHashTrimmedNoBOM)
-		fmt.Println(query+"\n", fhead.Filename+"\n", fhead.Size, fhead.Header, time.Now(), tableName+"\n")
 		if err != nil {
-			fmt.Print(err)
-			http.Error(w, "Failed to save file information to the database", http.StatusInternalServerError)
-			return
+			return settings, failedUpload("Error processing CSV file", fmt.Errorf("error reading import format: %w", err))
 		}
+		settings.format, settings.formatID = &f, f.ID
+	}
+	if err := readFileSettings(r, file, settings.format); err != nil {
+		return settings, err
+	}
+
+	var err error
+	settings.typeOpts, err = typeInferenceOptionsFromForm(r)
+	if err != nil {
+		return settings, badUpload("Invalid type inference options: " + err.Error())
+	}
+	settings.dedup, err = dedupTableFromForm(r)
+	if err != nil {
+		return settings, badUpload(err.Error())
+	}
+	settings.matchFormat, err = matchFormatFromForm(r)
+	if err != nil {
+		return settings, badUpload(err.Error())
+	}
+	return settings, nil
+}
 
-		columnNames, err := createTableForCSV(ctx, tx, *file, tableName)
+// readFileSettings sets the encoding, dialect, parsing profile, layout and row policy of a CSV
+// file read with format, which may be nil, and the form fields sent with the upload
+func readFileSettings(r *http.Request, file *models.File, format *models.ImportFormat) error {
+	file.FixedWidth = nil
+	if format != nil {
+		file.FixedWidth = format.FixedWidth
+	}
+	var err error
+	file.Encoding, err = file.DetectEncoding()
+	if err != nil {
+		return failedUpload("Error processing CSV file", fmt.Errorf("error detecting file encoding: %w", err))
+	}
+	if format != nil && format.Encoding != "" {
+		file.Encoding = format.Encoding
+	}
+	if value := r.PostFormValue("encoding"); value != "" {
+		_, file.Encoding, err = models.LookupEncoding(value)
 		if err != nil {
-			tx.Rollback()
-			log.Println("Error creating table:", err)
-			http.Error(w, "Error creating table", http.StatusInternalServerError)
-			return
+			return badUpload("Invalid encoding: " + err.Error())
+		}
+	}
+	if format != nil && format.Dialect != nil {
+		file.Dialect = *format.Dialect
+	} else {
+		file.Dialect, err = file.SniffDialect()
+		if err != nil {
+			return failedUpload("Error processing CSV file", fmt.Errorf("error detecting CSV dialect: %w", err))
+		}
+	}
+	file.Dialect, err = dialectFromForm(r, file.Dialect)
+	if err != nil {
+		return badUpload("Invalid CSV dialect: " + err.Error())
+	}
+	profile := models.DefaultParsingProfile
+	if format != nil && format.ParsingProfile != nil {
+		profile = *format.ParsingProfile
+	}
+	file.Profile, err = parsingProfileFromForm(r, profile)
+	if err != nil {
+		return badUpload("Invalid parsing profile: " + err.Error())
+	}
+	if file.FixedWidth != nil {
+		// Fixed-width files are named by the format's fields, after any lines it skips
+		file.Layout = models.HeaderLayout{Offset: file.FixedWidth.SkipLines, HasHeader: false}
+	} else {
+		file.Layout, err = file.DetectLayout()
+		if err != nil {
+			return &uploadError{status: http.StatusBadRequest, message: "Error processing CSV file", cause: fmt.Errorf("error detecting header row: %w", err)}
+		}
+		file.Layout, err = headerLayoutFromForm(r, file.Layout)
+		if err != nil {
+			return badUpload("Invalid header options: " + err.Error())
 		}
+	}
+	file.Policy, err = rowPolicyFromForm(r)
+	if err != nil {
+		return badUpload("Invalid row policy: " + err.Error())
+	}
+	return nil
+}
 
-		err = importCSVDataToTable(ctx, tx, *file, tableName, columnNames)
+// csvScanSettings works out how an upload will be read if it's a CSV file from its first bytes
+// and the form fields sent before it, for its columns to be scanned as it's spooled. Fields sent
+// after it can change the settings, and then the columns are scanned again.
+func csvScanSettings(r *http.Request, db *models.DB) models.ScanSettings {
+	return func(sample models.File) (models.File, models.TypeInferenceOptions, bool) {
+		kind, err := sniffFile(r, sample)
+		if err != nil || kind != kindCSV {
+			return sample, models.TypeInferenceOptions{}, false
+		}
+		ctx := r.Context()
+		tx, err := db.BeginTx(ctx)
 		if err != nil {
-			log.Println("Error importing data:", err)
-			txErr := tx.Rollback()
-			log.Println("Tx error:", txErr)
-			http.Error(w, "Error importing data", http.StatusInternalServerError)
-			return
+			return sample, models.TypeInferenceOptions{}, false
 		}
-		err = tx.Commit()
+		defer tx.Rollback()
+		settings, err := readCSVSettings(ctx, tx, r, &sample)
 		if err != nil {
-			http.Error(w, "Error committing transaction", http.StatusInternalServerError)
-			return
+			return sample, models.TypeInferenceOptions{}, false
 		}
-		w.WriteHeader(http.StatusCreated)
+		return sample, settings.typeOpts, true
 	}
+}
 
-	_, err = file.File.Seek(0, io.SeekStart) // Reset the file read position
+// importCSVFile loads a delimited or fixed-width text file into a raw table, recorded in
+// core_raw_tables under parentID if it came out of an archive. parentID is nil otherwise.
+func importCSVFile(ctx context.Context, tx *models.Tx, r *http.Request, file *models.File, parentID interface{}) (map[string]interface{}, error) {
+	settings, err := readCSVSettings(ctx, tx, r, file)
 	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusBadRequest)
-		return
+		return nil, err
 	}
+	format, formatID := settings.format, settings.formatID
+	typeOpts, dedup, matchFormat := settings.typeOpts, settings.dedup, settings.matchFormat
+	//tableName := toPostgreSQLName(handler.Filename)
 
-	uploadPath := filepath.Join("uploads", fhead.Filename)
-	err = os.MkdirAll(filepath.Dir(uploadPath), os.ModePerm)
+	sequenceName := "core_raw_tables_id_seq"
+	lastValue, err := getLastSequenceValue(ctx, tx, sequenceName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, failedUpload("Error processing file", fmt.Errorf("error getting last sequence value: %w", err))
 	}
+	tableName := fmt.Sprintf("raw_table_%d", lastValue+1)
 
-	tempFile, err := os.CreateTemp("uploads", fhead.Filename+"_tmp_*")
+	// The file was hashed as it was spooled, and its columns scanned and its trimmed content hashed
+	// if the settings could be worked out by then. They're scanned now if not.
+	stats, err := file.ColumnStats(typeOpts)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, failedUpload("Error processing file", fmt.Errorf("error reading columns: %w", err))
+	}
+	hashes := models.FileHashes{Hash: file.Hash, HashNoBOM: file.HashNoBOM, HashTrimmed: stats.HashTrimmed}
+	duplicate, link, err := checkDuplicate(ctx, tx, r, hashes)
+	if err != nil {
+		return nil, err
+	}
+	if link {
+		return linkDuplicate(ctx, tx, file, hashes, parentID, duplicate)
 	}
-	defer tempFile.Close()
 
-	fileBytes, err := io.ReadAll(file.File)
+	// An upload that doesn't name its import format is given the one its columns match, if any
+	// matches confidently. Only the columns of a header row can be matched.
+	var formatMatch map[string]interface{}
+	if format == nil && matchFormat && file.FixedWidth == nil && file.Layout.HasHeader {
+		var matched *models.ImportFormat
+		matched, formatMatch, err = matchImportFormat(ctx, tx, tableColumns(stats.Header, stats.MaxLengths, stats.HeaderLengths, stats.Types))
+		if err != nil {
+			return nil, failedUpload("Error processing CSV file", fmt.Errorf("error matching import formats: %w", err))
+		}
+		if matched != nil {
+			// The file was read with what was detected in it. It's read again as the format reads
+			// its files, as it would be if the upload had named it.
+			format, formatID = matched, matched.ID
+			if err := readFileSettings(r, file, matched); err != nil {
+				return nil, err
+			}
+			stats, err = file.ColumnStats(typeOpts)
+			if err != nil {
+				return nil, failedUpload("Error processing file", fmt.Errorf("error reading columns: %w", err))
+			}
+		}
+	}
+	dialectJSON, err := json.Marshal(file.Dialect)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, failedUpload("Error processing CSV file", err)
+	}
+	profileJSON, err := json.Marshal(file.Profile)
+	if err != nil {
+		return nil, failedUpload("Error processing CSV file", err)
+	}
+	policyJSON, err := json.Marshal(file.Policy)
+	if err != nil {
+		return nil, failedUpload("Error processing CSV file", err)
 	}
 
-	_, err = tempFile.Write(fileBytes)
+	fhead := file.Header
+	query := "INSERT INTO core_raw_tables (source_filename, file_size, datetime_uploaded, name, file_hash, file_hash_no_bom, file_hash_trimmed_no_bom, dialect, encoding, format_id, parsing_profile, header_offset, has_header, row_policy, parent_id, compression) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) RETURNING id"
+	var uploadID int64
+	err = tx.QueryRowContext(ctx, query, fhead.Filename, fhead.Size, time.Now(), tableName, file.Hash, file.HashNoBOM, stats.HashTrimmed, string(dialectJSON), file.Encoding, formatID, string(profileJSON), file.Layout.Offset, file.Layout.HasHeader, string(policyJSON), parentID, nullableString(file.Compression)).Scan(&uploadID)
+	fmt.Println(query+"\n", fhead.Filename+"\n", fhead.Size, fhead.Header, time.Now(), tableName+"\n")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, failedUpload("Failed to save file information to the database", err)
 	}
 
-	err = os.Rename(tempFile.Name(), uploadPath)
+	columns, err := createTableForCSV(ctx, tx, *file, tableName, stats)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, failedUpload("Error creating table", err)
+	}
+
+	err = models.InsertColumns(ctx, tx, uploadID, columns)
+	if err != nil {
+		return nil, failedUpload("Error creating table", fmt.Errorf("error saving column headers: %w", err))
 	}
 
-	fmt.Fprintf(w, "File uploaded successfully: %s", fhead.Filename)
+	rejected, repairs, rowsLoaded, err := importCSVDataToTable(ctx, tx, *file, tableName, columns)
+	if errors.Is(err, errTooManyRepairs) {
+		return nil, &uploadError{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("Error importing data: %v. The first was line %d: %s", err, repairs[0].Line, repairs[0].Action)}
+	}
+	if errors.Is(err, errTooManyRejectedRows) {
+		return nil, &uploadError{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("Error importing data: %v. The first was line %d: %s", err, rejected[0].Line, rejected[0].Message)}
+	}
+	if err != nil {
+		return nil, failedUpload("Error importing data", err)
+	}
+
+	err = models.InsertRejectedRows(ctx, tx, uploadID, rejected)
+	if err != nil {
+		return nil, failedUpload("Error importing data", fmt.Errorf("error saving rejected rows: %w", err))
+	}
+	err = models.InsertRepairs(ctx, tx, uploadID, repairs)
+	if err != nil {
+		return nil, failedUpload("Error importing data", fmt.Errorf("error saving repairs: %w", err))
+	}
+	columnNames := make([]string, len(columns))
+	for i, column := range columns {
+		columnNames[i] = column.Name
+	}
+	if file.Policy.LongRows == models.RowsExtra {
+		columnNames = append(columnNames, models.ExtraColumn)
+	}
+	loaded, err := recordRows(ctx, tx, uploadID, tableName, columnNames, rowsLoaded, file.Layout.HasHeader, dedup)
+	if err != nil {
+		return nil, failedUpload("Error importing data", err)
+	}
+	// Broken rules don't stop the upload. Its validation status says whether it's valid.
+	var validation *models.ValidationSummary
+	if format != nil && len(format.Rules) > 0 {
+		summary, err := models.ValidateUpload(ctx, tx, uploadID, format.Rules)
+		if err != nil {
+			return nil, failedUpload("Error validating data", err)
+		}
+		validation = &summary
+	}
+	keys, err := applyKeyColumn(ctx, tx, r, uploadID, format)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := map[string]interface{}{
+		"id":                uploadID,
+		"table":             tableName,
+		"encoding":          file.Encoding,
+		"dialect":           file.Dialect,
+		"parsing_profile":   file.Profile,
+		"layout":            file.Layout,
+		"columns":           columns,
+		"row_policy":        file.Policy,
+		"rejected_rows":     len(rejected),
+		"conversion_errors": conversionErrors(rejected),
+		"repairs":           len(repairs),
+	}
+	if file.FixedWidth != nil {
+		imported["fixed_width"] = file.FixedWidth
+	}
+	loaded.addTo(imported)
+	if keys != nil {
+		imported["keys"] = keys
+	}
+	if duplicate != nil {
+		imported["duplicate"] = duplicate
+	}
+	if validation != nil {
+		imported["validation"] = validation
+	}
+	if formatMatch != nil {
+		imported["format_match"] = formatMatch
+	}
+	if formatID != nil {
+		imported["format_id"] = formatID
+	}
+	if file.Compression != "" {
+		imported["compression"] = file.Compression
+	}
+	return imported, nil
+}
+
+// parsingProfileFromForm replaces p with the built in profile named by the profile form field,
+// then overrides it with any of decimal_separator, thousands_separator, day_first and date_layout
+func parsingProfileFromForm(r *http.Request, p models.ParsingProfile) (models.ParsingProfile, error) {
+	var err error
+	if name := r.PostFormValue("profile"); name != "" {
+		p, err = models.LookupParsingProfile(name)
+		if err != nil {
+			return p, err
+		}
+	}
+	separators := map[string]*string{"decimal_separator": &p.DecimalSeparator, "thousands_separator": &p.ThousandsSeparator}
+	for field, target := range separators {
+		values, ok := r.PostForm[field]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		switch strings.ToLower(values[0]) {
+		case "none":
+			*target = ""
+		case "space":
+			*target = " "
+		default:
+			*target = values[0]
+		}
+		p.Name = ""
+	}
+	if value := r.PostFormValue("day_first"); value != "" {
+		dayFirst, err := strconv.ParseBool(value)
+		if err != nil {
+			return p, fmt.Errorf("day_first must be true or false")
+		}
+		p.DateOrder = models.DateOrderMDY
+		if dayFirst {
+			p.DateOrder = models.DateOrderDMY
+		}
+		p.Name = ""
+	}
+	if layouts, ok := r.PostForm["date_layout"]; ok {
+		p.DateLayouts = layouts
+		p.Name = ""
+	}
+	return p, p.Validate()
+}
+
+// headerLayoutFromForm overrides the detected layout with the header_row form field,
+// the line number of the header row, or no_header=true for files without one
+func headerLayoutFromForm(r *http.Request, layout models.HeaderLayout) (models.HeaderLayout, error) {
+	headerRow := r.PostFormValue("header_row")
+	noHeader := r.PostFormValue("no_header")
+	if headerRow != "" && noHeader != "" {
+		return layout, fmt.Errorf("header_row and no_header can't be used together")
+	}
+	if headerRow != "" {
+		line, err := strconv.Atoi(headerRow)
+		if err != nil || line < 1 {
+			return layout, fmt.Errorf("header_row must be a line number starting from 1")
+		}
+		return models.HeaderLayout{Offset: line - 1, HasHeader: true}, nil
+	}
+	if noHeader != "" {
+		none, err := strconv.ParseBool(noHeader)
+		if err != nil {
+			return layout, fmt.Errorf("no_header must be true or false")
+		}
+		layout.HasHeader = !none
+	}
+	return layout, nil
+}
+
+// rowPolicyFromForm reads the short_rows (pad or reject) and long_rows (truncate, extra or reject)
+// form fields, which say what to do with rows that have fewer or more fields than the header,
+// and recover=true, which repairs rows with stray quotes instead of rejecting them
+func rowPolicyFromForm(r *http.Request) (models.RowPolicy, error) {
+	policy := models.DefaultRowPolicy
+	if value := r.PostFormValue("short_rows"); value != "" {
+		policy.ShortRows = strings.ToLower(value)
+	}
+	if value := r.PostFormValue("long_rows"); value != "" {
+		policy.LongRows = strings.ToLower(value)
+	}
+	if value := r.PostFormValue("recover"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return policy, fmt.Errorf("recover must be true or false")
+		}
+		policy.Recover = enabled
+	}
+	return policy, policy.Validate()
+}
+
+// dedupTableFromForm reads the dedup_table form field, which asks for a deduplicated companion
+// of each raw table the upload is loaded into
+func dedupTableFromForm(r *http.Request) (bool, error) {
+	value := r.PostFormValue("dedup_table")
+	if value == "" {
+		return false, nil
+	}
+	dedup, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("dedup_table must be true or false")
+	}
+	return dedup, nil
+}
+
+// jsonOptionsFromForm reads how to flatten JSON records from the json_depth and json_arrays form fields
+func jsonOptionsFromForm(r *http.Request) (models.JSONOptions, error) {
+	opts := models.DefaultJSONOptions
+	if value := r.PostFormValue("json_depth"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("json_depth must be a whole number")
+		}
+		opts.MaxDepth = depth
+	}
+	if value := r.PostFormValue("json_arrays"); value != "" {
+		opts.Arrays = strings.ToLower(value)
+	}
+	return opts, opts.Validate()
+}
+
+// typeInferenceOptionsFromForm reads the optional form fields infer_types (true/false),
+// type_confidence (fraction of values that must fit a type) and type_min_values
+func typeInferenceOptionsFromForm(r *http.Request) (models.TypeInferenceOptions, error) {
+	opts := models.DefaultTypeInferenceOptions
+	if value := r.PostFormValue("infer_types"); value != "" {
+		infer, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("infer_types must be true or false")
+		}
+		opts.Disabled = !infer
+	}
+	if value := r.PostFormValue("type_confidence"); value != "" {
+		confidence, err := strconv.ParseFloat(value, 64)
+		if err != nil || confidence <= 0 || confidence > 1 {
+			return opts, fmt.Errorf("type_confidence must be a number greater than 0 and at most 1")
+		}
+		opts.Confidence = confidence
+	}
+	if value := r.PostFormValue("type_min_values"); value != "" {
+		minValues, err := strconv.Atoi(value)
+		if err != nil || minValues < 0 {
+			return opts, fmt.Errorf("type_min_values must be a non-negative integer")
+		}
+		opts.MinValues = minValues
+	}
+	return opts, nil
+}
+
+// Names accepted for dialect characters in upload form fields, in addition to the literal character
+var dialectCharNames = map[string]rune{
+	"comma":     ',',
+	"semicolon": ';',
+	"tab":       '\t',
+	"\\t":       '\t',
+	"pipe":      '|',
+	"colon":     ':',
+	"space":     ' ',
+	"none":      0,
+}
+
+var lineTerminatorNames = map[string]string{
+	"lf":   "\n",
+	"crlf": "\r\n",
+	"cr":   "\r",
+}
+
+// dialectFromForm overrides the detected dialect with any of the form fields
+// delimiter, quote, escape, comment and line_terminator sent with the upload
+func dialectFromForm(r *http.Request, d models.Dialect) (models.Dialect, error) {
+	for field, target := range map[string]*rune{"delimiter": &d.Delimiter, "quote": &d.Quote, "comment": &d.Comment} {
+		values, ok := r.PostForm[field]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		if c, ok := dialectCharNames[strings.ToLower(value)]; ok {
+			*target = c
+			continue
+		}
+		if utf8.RuneCountInString(value) != 1 {
+			return d, fmt.Errorf("%s must be a single character", field)
+		}
+		*target, _ = utf8.DecodeRuneInString(value)
+	}
+	if value := r.PostFormValue("escape"); value != "" {
+		d.Escape = strings.ToLower(value)
+	}
+	if value := r.PostFormValue("line_terminator"); value != "" {
+		terminator, ok := lineTerminatorNames[strings.ToLower(value)]
+		if !ok {
+			return d, fmt.Errorf("line_terminator must be one of lf, crlf or cr")
+		}
+		d.LineTerminator = terminator
+	}
+	return d, d.Validate()
 }
 
 // Add a new function to fetch file information from the database
+// The query parameter deleted=true lists the deleted files that haven't been purged instead.
 func (env *Env) fetchUploadedFiles(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	uploads, err := env.upload.All(ctx)
+	deleted := false
+	if value := r.URL.Query().Get("deleted"); value != "" {
+		var err error
+		deleted, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "deleted must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	uploads, err := env.upload.All(ctx, deleted)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	json.NewEncoder(w).Encode(uploads)
 }
 
-func (env *Env) deleteFile(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	vars := mux.Vars(r)
-	id := vars["id"]
-	idInt, err := strconv.Atoi(id)
-	err = env.upload.Delete(ctx, idInt)
+// fetchRejectedRows lists the rows of an upload that weren't loaded, with the reason for each
+func (env *Env) fetchRejectedRows(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("File deleted successfully"))
+	rejected, err := env.upload.RejectedRows(r.Context(), id)
+	if err != nil {
+		log.Println("Error fetching rejected rows:", err)
+		http.Error(w, "Failed to fetch rejected rows", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rejected)
 }
 
-// Returns column names
+// downloadRejectedRows sends the text of an upload's rejected rows as a file,
+// so they can be fixed and uploaded again
+func (env *Env) downloadRejectedRows(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	rejected, err := env.upload.RejectedRows(r.Context(), id)
+	if err != nil {
+		log.Println("Error fetching rejected rows:", err)
+		http.Error(w, "Failed to fetch rejected rows", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"rejected_rows_%d.csv\"", id))
+	for _, row := range rejected {
+		io.WriteString(w, row.Raw+"\n")
+	}
+}
+
+// Returns the columns of the created table
 // Creates table in DB, skipping completely empty columns and rows
 // For zero-length columns with headers, sets to VARCHAR(1)
-func createTableForCSV(ctx context.Context, tx *models.Tx, file models.File, tableName string) ([]string, error) {
-	// Read the first line of the CSV file to get the column headers
-	file.File.Seek(0, 0)
-	maxLengths, headerLengths, err := file.GetMaxColumnLengths()
+func createTableForCSV(ctx context.Context, tx *models.Tx, file models.File, tableName string, stats models.ColumnStats) ([]models.Column, error) {
+	columns := tableColumns(stats.Header, stats.MaxLengths, stats.HeaderLengths, stats.Types)
+	err := createRawTable(ctx, tx, tableName, columns, file.Policy.LongRows == models.RowsExtra)
 	if err != nil {
-		log.Println("Error getting max column lengths:", err)
 		return nil, err
 	}
-	// Reset the reader position before reading headers
-	file.File.Seek(0, 0)
+	return columns, nil
+}
 
-	reader := csv.NewReader(file.File)
-	headers, err := reader.Read()
-	if err != nil {
-		return nil, fmt.Errorf("error reading CSV file: %w", err)
+// tableColumns describes the columns of a raw table from the header row, or generated names if
+// headers is nil, and the longest value and inferred type of each column. Columns with neither
+// a header nor any values are left out.
+func tableColumns(headers []string, maxLengths, headerLengths []int, types []models.InferredType) []models.Column {
+	hasHeader := headers != nil
+	if !hasHeader {
+		headers = models.ColumnNames(len(maxLengths))
 	}
 
-	// Create the table schema using the column headers
-	columns := []string{"_id SERIAL PRIMARY KEY"} // use underscore prefix for system column names
-	columnNames := []string{}                     // exclude system column names
+	columns := []models.Column{} // exclude system column names
 	for i, header := range headers {
-		if maxLengths[i] == 0 && headerLengths[i] == 0 {
+		maxLength := 0
+		if i < len(maxLengths) {
+			maxLength = maxLengths[i]
+		}
+		headerLength := 0
+		if i < len(headerLengths) {
+			headerLength = headerLengths[i]
+		}
+		if maxLength == 0 && headerLength == 0 {
 			continue // skip this column
 		}
-		columnName := toPostgreSQLName(header)
-		columnLength := maxLengths[i]
-		if columnLength < 1 { // 0-length varchar not allowed in Postgres? (allowed in MySQL)
-			columnLength = 1
+		column := models.Column{Header: header, Index: i, Type: models.TypeText, Confidence: 1}
+		if !hasHeader {
+			column.Header = "" // generated name
 		}
-		columns = append(columns, fmt.Sprintf("\"%s\" VARCHAR(%d)", columnName, columnLength))
-		columnNames = append(columnNames, columnName)
+		if i < len(types) {
+			column.Type, column.Confidence = types[i].Type, types[i].Confidence
+		}
+		column.SQLType = column.Type.SQL(maxLength)
+		columns = append(columns, column)
+	}
+	names := columnIdentifiers(headers)
+	for i := range columns {
+		columns[i].Name = names[columns[i].Index]
 	}
-	schema := strings.Join(columns, ", ")
+	return columns
+}
 
-	_, err = tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s);", tableName, schema))
-	if err != nil {
-		return nil, fmt.Errorf("error creating table: %w", err)
+// createRawTable creates a raw table with the columns, and an _extra column for the overflow
+// of long rows if extra is set
+func createRawTable(ctx context.Context, tx *models.Tx, tableName string, columns []models.Column, extra bool) error {
+	definitions := []string{"_id SERIAL PRIMARY KEY"} // use underscore prefix for system column names
+	for _, column := range columns {
+		definitions = append(definitions, fmt.Sprintf("\"%s\" %s", column.Name, column.SQLType))
+	}
+	if extra {
+		definitions = append(definitions, models.ExtraColumn+" JSONB") // overflow of rows longer than the header
 	}
+	schema := strings.Join(definitions, ", ")
 
-	return columnNames, nil
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s (%s);", tableName, schema))
+	if err != nil {
+		return fmt.Errorf("error creating table: %w", err)
+	}
+	return nil
 }
 
 func toPostgreSQLName(s string) string {
 	if strings.ToLower(filepath.Ext(s)) == ".csv" {
 		s = strings.TrimSuffix(s, filepath.Ext(s))
 	}
-	// Convert non-ASCII characters to their ASCII equivalents
+	// Romanise other scripts, then convert non-ASCII characters to their ASCII equivalents
+	s = transliterate(s)
 	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
 	asciiStr, _, _ := transform.String(t, s)
 
 	// Make all characters lowercase
 	lowercaseStr := strings.ToLower(asciiStr)
 
-	asciiRe := regexp.MustCompile(`[^a-zA-Z0-9\n]`)
+	asciiRe := regexp.MustCompile(`[^a-zA-Z0-9]`)
 	underscoreStr := asciiRe.ReplaceAllString(lowercaseStr, "_")
 
 	// Replace all spaces with underscores
@@ -454,96 +1178,242 @@ func toPostgreSQLName(s string) string {
 	cleanStr = re.ReplaceAllString(cleanStr, "_")
 
 	maxLen := 59 // 63 is max, but cutting 4 more off to leave room for table name prefixes
-	runeCont := utf8.RuneCountInString(cleanStr)
+	cleanStr = truncateBytes(cleanStr, maxLen)
+
+	return cleanStr
+}
+
+// Postgres limits identifiers to 63 bytes (NAMEDATALEN - 1)
+const maxIdentifierBytes = 63
+
+// Reserved key words that can't be column names without quoting, and system column names
+// that can't be column names at all
+var reservedIdentifiers = map[string]bool{
+	"all": true, "analyse": true, "analyze": true, "and": true, "any": true, "array": true, "as": true, "asc": true,
+	"asymmetric": true, "authorization": true, "binary": true, "both": true, "case": true, "cast": true, "check": true,
+	"collate": true, "collation": true, "column": true, "concurrently": true, "constraint": true, "create": true,
+	"cross": true, "current_catalog": true, "current_date": true, "current_role": true, "current_schema": true,
+	"current_time": true, "current_timestamp": true, "current_user": true, "default": true, "deferrable": true,
+	"desc": true, "distinct": true, "do": true, "else": true, "end": true, "except": true, "false": true, "fetch": true,
+	"for": true, "foreign": true, "freeze": true, "from": true, "full": true, "grant": true, "group": true, "having": true,
+	"ilike": true, "in": true, "initially": true, "inner": true, "intersect": true, "into": true, "is": true, "isnull": true,
+	"join": true, "lateral": true, "leading": true, "left": true, "like": true, "limit": true, "localtime": true,
+	"localtimestamp": true, "natural": true, "not": true, "notnull": true, "null": true, "offset": true, "on": true,
+	"only": true, "or": true, "order": true, "outer": true, "overlaps": true, "placing": true, "primary": true,
+	"references": true, "returning": true, "right": true, "select": true, "session_user": true, "similar": true,
+	"some": true, "symmetric": true, "system_user": true, "table": true, "tablesample": true, "then": true, "to": true,
+	"trailing": true, "true": true, "union": true, "unique": true, "user": true, "using": true, "variadic": true,
+	"verbose": true, "when": true, "where": true, "window": true, "with": true,
+	"tableoid": true, "xmin": true, "cmin": true, "xmax": true, "cmax": true, "ctid": true,
+}
 
-	if runeCont > maxLen {
-		r := []rune(cleanStr)
-		trunc := r[:maxLen]
-		cleanStr = string(trunc)
+// columnIdentifiers turns a row of headers into column names that can all go in one CREATE TABLE.
+// Headers that clean up to nothing get their position as a name (column_3), reserved words get a
+// trailing underscore, and repeats get a numeric suffix (price, price_2), all within 63 bytes.
+func columnIdentifiers(headers []string) []string {
+	names := make([]string, len(headers))
+	used := map[string]bool{}
+	for i, header := range headers {
+		name := toPostgreSQLName(header)
+		if name == "" {
+			name = fmt.Sprintf("column_%d", i+1)
+		}
+		if reservedIdentifiers[name] {
+			name += "_"
+		}
+		name = truncateBytes(name, maxIdentifierBytes)
+		unique := name
+		for n := 2; used[unique]; n++ {
+			suffix := fmt.Sprintf("_%d", n)
+			unique = truncateBytes(name, maxIdentifierBytes-len(suffix)) + suffix
+		}
+		used[unique] = true
+		names[i] = unique
 	}
+	return names
+}
 
-	return cleanStr
+// truncateBytes shortens s to at most n bytes without splitting a multi-byte character
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
 }
 
-func importCSVDataToTable(ctx context.Context, tx *models.Tx, file models.File, tableName string, columnNames []string) error {
-	// Reset the file position to the beginning
-	file.File.Seek(0, 0)
+// Returned by importCSVDataToTable along with the rejected rows or repairs when there are more than models.MaxRejectedRows
+var (
+	errTooManyRejectedRows = fmt.Errorf("more than %d rows were rejected", models.MaxRejectedRows)
+	errTooManyRepairs      = fmt.Errorf("more than %d rows needed repairs", models.MaxRejectedRows)
+)
 
-	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(tableName, columnNames...))
+// importCSVDataToTable loads the rows of the file into the table and returns the rows that were
+// rejected and the repairs made to read malformed rows
+func importCSVDataToTable(ctx context.Context, tx *models.Tx, file models.File, tableName string, columns []models.Column) ([]models.RowError, []models.Repair, int64, error) {
+	columnNames := make([]string, len(columns))
+	for i, column := range columns {
+		columnNames[i] = column.Name
+	}
+	extra := file.Policy.LongRows == models.RowsExtra
+	if extra {
+		columnNames = append(columnNames, models.ExtraColumn)
+	}
+
+	reader, err := file.NewRowReader() // Skips the header row
 	if err != nil {
-		return fmt.Errorf("error preparing COPY statement: %w", err)
+		return nil, nil, 0, fmt.Errorf("error reading CSV file: %w", err)
 	}
 
-	reader := csv.NewReader(file.File)
-	_, err = reader.Read() // Skip header row
+	// Rejected rows and repairs are kept until the COPY is done, as nothing else can run on the connection during it
+	rejected := []models.RowError{}
+	loaded, err := copyRows(ctx, tx, tableName, columnNames, func() ([]interface{}, error) {
+		for {
+			row, err := reader.Read()
+			if len(reader.Repairs()) > models.MaxRejectedRows {
+				return nil, errTooManyRepairs
+			}
+			var rowErr *models.RowError
+			if errors.As(err, &rowErr) {
+				rejected = append(rejected, *rowErr)
+				if len(rejected) > models.MaxRejectedRows {
+					return nil, errTooManyRejectedRows
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			// Pick out the values of the table's columns and convert them to the column types
+			// using the file's parsing profile. Rows with values that don't fit an inferred type
+			// are rejected, as types are inferred from fewer than all values with type_confidence.
+			values, convErr := file.Profile.ConvertRow(columns, row)
+			if convErr != nil {
+				rejected = append(rejected, *convErr)
+				if len(rejected) > models.MaxRejectedRows {
+					return nil, errTooManyRejectedRows
+				}
+				continue
+			}
+			if extra {
+				var extraValue interface{}
+				if len(row.Extra) > 0 {
+					extraJSON, err := json.Marshal(row.Extra)
+					if err != nil {
+						return nil, err
+					}
+					extraValue = string(extraJSON)
+				}
+				values = append(values, extraValue)
+			}
+			return values, nil
+		}
+	})
+	return rejected, reader.Repairs(), loaded, err
+}
+
+// conversionErrors counts the rows rejected for a value that didn't fit its column's type
+func conversionErrors(rejected []models.RowError) int {
+	n := 0
+	for _, row := range rejected {
+		if row.Column != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// copyRows loads rows into a table with COPY and returns how many it loaded. next returns the
+// values of each row in the order of columnNames, then io.EOF.
+func copyRows(ctx context.Context, tx *models.Tx, tableName string, columnNames []string, next func() ([]interface{}, error)) (int64, error) {
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(tableName, columnNames...))
 	if err != nil {
-		return fmt.Errorf("error reading CSV file: %w", err)
+		return 0, fmt.Errorf("error preparing COPY statement: %w", err)
 	}
+	defer stmt.Close()
 
+	var rows int64
 	for {
-		record, err := reader.Read()
+		values, err := next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("error reading CSV file: %w", err)
+			return rows, err
 		}
-
-		// Convert the record slice of string to a slice of interface{}
-		recordInterface := make([]interface{}, len(record))
-		for i, v := range record {
-			recordInterface[i] = v
-		}
-
-		_, err = stmt.ExecContext(ctx, recordInterface...)
+		_, err = stmt.ExecContext(ctx, values...)
 		if err != nil {
-			return fmt.Errorf("error executing COPY statement: %w", err)
+			return rows, fmt.Errorf("error executing COPY statement: %w", err)
 		}
+		rows++
 	}
 
 	_, err = stmt.ExecContext(ctx)
 	if err != nil {
-		return fmt.Errorf("error executing COPY statement: %w", err)
+		return rows, fmt.Errorf("error executing COPY statement: %w", err)
 	}
 
 	err = stmt.Close()
 	if err != nil {
-		return fmt.Errorf("error closing COPY statement: %w", err)
+		return rows, fmt.Errorf("error closing COPY statement: %w", err)
 	}
-
-	return nil
+	return rows, nil
 }
 
-func getImportFormatsHandler(w http.ResponseWriter, r *http.Request, db *models.DB) {
-	formats := []struct {
-		ID   int    `json:"id"`
-		Name string `json:"name"`
-	}{}
-
-	ctx := r.Context()
+// loadedRows is what was counted loading the rows of a raw table
+type loadedRows struct {
+	counts     models.RowCounts
+	dedupTable string
+}
 
-	rows, err := db.QueryWithContext(ctx, "SELECT id, name FROM core_import_formats;")
-	if err != nil {
-		http.Error(w, "Failed to retrieve import formats", http.StatusInternalServerError)
-		return
+func (l loadedRows) addTo(response map[string]interface{}) {
+	response["row_count"] = l.counts.Rows
+	response["row_count_dedup"] = l.counts.Distinct
+	if l.dedupTable != "" {
+		response["dedup_table"] = l.dedupTable
 	}
-	defer rows.Close()
+}
 
-	for rows.Next() {
-		var format struct {
-			ID   int    `json:"id"`
-			Name string `json:"name"`
-		}
-		err := rows.Scan(&format.ID, &format.Name)
+// recordRows counts and saves the row counts of a raw table once it's loaded, first making its
+// deduplicated companion table if dedup is set. rows is the number of rows loaded.
+func recordRows(ctx context.Context, tx *models.Tx, id int64, tableName string, columnNames []string, rows int64, hasHeader, dedup bool) (loadedRows, error) {
+	var loaded loadedRows
+	var err error
+	if dedup {
+		loaded.dedupTable, err = createDedupTable(ctx, tx, tableName, columnNames)
 		if err != nil {
-			http.Error(w, "Error enumerating import formats", http.StatusInternalServerError)
-			return
+			return loaded, err
 		}
-		formats = append(formats, format)
 	}
+	loaded.counts, err = models.CountRows(ctx, tx, tableName, columnNames, rows, hasHeader, loaded.dedupTable)
+	if err != nil {
+		return loaded, err
+	}
+	err = models.SetRowCounts(ctx, tx, id, loaded.counts, loaded.dedupTable)
+	return loaded, err
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(formats)
+// createDedupTable copies the first of each set of identical rows of a raw table into a
+// companion table named after it, keeping their _id
+func createDedupTable(ctx context.Context, tx *models.Tx, tableName string, columnNames []string) (string, error) {
+	dedupName := tableName + "_dedup"
+	quoted := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		quoted[i] = pq.QuoteIdentifier(name)
+	}
+	groupBy := "()" // a table without columns has at most one distinct row
+	if len(quoted) > 0 {
+		groupBy = strings.Join(quoted, ", ")
+	}
+	query := fmt.Sprintf("CREATE TABLE %s AS SELECT * FROM %s WHERE _id IN (SELECT min(_id) FROM %s GROUP BY %s) ORDER BY _id", dedupName, tableName, tableName, groupBy)
+	_, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return "", fmt.Errorf("error creating deduplicated table: %w", err)
+	}
+	return dedupName, nil
 }
 
 func updateFileFormatHandler(w http.ResponseWriter, r *http.Request, db *models.DB) {
@@ -586,17 +1456,37 @@ func fetchFileDetails(w http.ResponseWriter, r *http.Request, db *models.DB) {
 	ctx := r.Context()
 
 	tx, err := db.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
-	// Retrieve the table name from core_raw_tables based on the file ID
-	var tableName string
-	err = tx.QueryRowContext(ctx, "SELECT name FROM core_raw_tables WHERE id = $1", fileId).Scan(&tableName)
+	// Retrieve the table name from core_raw_tables based on the file ID. An upload linked to
+	// a duplicate is described by the duplicate's columns and tables.
+	var name, dedupName sql.NullString
+	var sourceID int64
+	var rowCount, rowCountDedup sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT name, COALESCE(duplicate_of, id), row_count, row_count_dedup, dedup_name FROM core_raw_tables WHERE id = $1", fileId).Scan(&name, &sourceID, &rowCount, &rowCountDedup, &dedupName)
 	if err != nil {
 		http.Error(w, "Error retrieving table name", http.StatusInternalServerError)
 		return
 	}
+	// Workbooks have no table of their own, only the tables of their sheets
+	if !name.Valid {
+		tables, err := models.GetChildTables(ctx, tx, sourceID)
+		if err != nil {
+			http.Error(w, "Error retrieving tables", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"tables": tables})
+		return
+	}
+	tableName := name.String
 
-	// Retrieve column names
-	columns, err := tx.QueryContext(ctx, "SELECT column_name FROM information_schema.columns WHERE table_name = $1", tableName)
+	// Retrieve column names and types
+	columns, err := tx.QueryContext(ctx, "SELECT column_name, data_type FROM information_schema.columns WHERE table_name = $1 ORDER BY ordinal_position", tableName)
 	if err != nil {
 		http.Error(w, "Error retrieving column names", http.StatusInternalServerError)
 		return
@@ -604,13 +1494,47 @@ func fetchFileDetails(w http.ResponseWriter, r *http.Request, db *models.DB) {
 	defer columns.Close()
 
 	columnNames := make([]string, 0)
+	columnTypes := make(map[string]string)
 	for columns.Next() {
-		var columnName string
-		if err := columns.Scan(&columnName); err != nil {
+		var columnName, dataType string
+		if err := columns.Scan(&columnName, &dataType); err != nil {
 			http.Error(w, "Error reading column names", http.StatusInternalServerError)
 			return
 		}
 		columnNames = append(columnNames, columnName)
+		columnTypes[columnName] = dataType
+	}
+
+	// Original header text of each column, for uploads that recorded it
+	recorded, err := models.GetColumns(ctx, tx, sourceID)
+	if err != nil {
+		http.Error(w, "Error retrieving column headers", http.StatusInternalServerError)
+		return
+	}
+	headers := make(map[string]string)
+	for _, column := range recorded {
+		headers[column.Name] = column.Header
+	}
+
+	// Rows that were repaired or skipped in recovery mode
+	repairs, err := models.GetRepairs(ctx, tx, sourceID)
+	if err != nil {
+		http.Error(w, "Error retrieving repairs", http.StatusInternalServerError)
+		return
+	}
+
+	// Counts of the keys, if a key column was chosen
+	keys, err := models.GetKeyCounts(ctx, tx, int64(fileId))
+	if err != nil {
+		http.Error(w, "Error retrieving key counts", http.StatusInternalServerError)
+		return
+	}
+
+	// Tables of the arrays exploded out of JSON records
+	tables, err := models.GetChildTables(ctx, tx, sourceID)
+	if err != nil {
+		http.Error(w, "Error retrieving tables", http.StatusInternalServerError)
+		return
 	}
 
 	// Retrieve rows data
@@ -637,6 +1561,10 @@ func fetchFileDetails(w http.ResponseWriter, r *http.Request, db *models.DB) {
 		}
 
 		for i, columnName := range columnNames {
+			// numeric and uuid values are scanned as raw bytes, which would be base64 encoded as JSON
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
 			rowData[columnName] = values[i]
 		}
 
@@ -645,8 +1573,23 @@ func fetchFileDetails(w http.ResponseWriter, r *http.Request, db *models.DB) {
 
 	// Create the response JSON
 	response := map[string]interface{}{
-		"columns": columnNames,
-		"rows":    rowsData,
+		"columns":      columnNames,
+		"column_types": columnTypes,
+		"headers":      headers,
+		"rows":         rowsData,
+		"repairs":      repairs,
+		"tables":       tables,
+	}
+	// Uploads from before rows were counted have no counts
+	if rowCount.Valid {
+		response["row_count"] = rowCount.Int64
+		response["row_count_dedup"] = rowCountDedup.Int64
+	}
+	if dedupName.Valid {
+		response["dedup_table"] = dedupName.String
+	}
+	if keys != nil {
+		response["keys"] = keys
 	}
 
 	// Send the JSON response
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 
 	_ "github.com/lib/pq"
+	"github.com/nickcoast/gocsv/models"
 )
 
 /*
@@ -16,6 +23,7 @@ func Test_toPostgreSQLName(t *testing.T) {
 		s string
 	}
 	want1 := "lodes_2_15_2023_price_list_excel_version_vc"
+	want1Cyrillic := want1 + "yu"
 	//want1 := "lodes_2_15_20" + "23_price_list_excel_version_vc"
 	tests := []struct {
 		name string
@@ -69,7 +77,7 @@ func Test_toPostgreSQLName(t *testing.T) {
 			args: args{
 				s: "_99_LODÉS 2.15. 2023 PRIČÈ LIST -EXCEL VERSION vcЮ.csv",
 			},
-			want: want1,
+			want: want1Cyrillic,
 		},
 		{
 			name: "Initial BOM",
@@ -83,7 +91,42 @@ func Test_toPostgreSQLName(t *testing.T) {
 			args: args{
 				s: string('\uFEFF') + "_99_LODÉS 2.15. 2023 PRIČÈ LIST -EXCEL VERSION vcЮ.csv",
 			},
-			want: want1,
+			want: want1Cyrillic,
+		},
+		{
+			name: "Cyrillic",
+			args: args{
+				s: "Цена товара, руб.",
+			},
+			want: "tsena_tovara_rub",
+		},
+		{
+			name: "Cyrillic short i",
+			args: args{
+				s: "Код района",
+			},
+			want: "kod_rayona",
+		},
+		{
+			name: "Greek with tonos",
+			args: args{
+				s: "Τιμή μονάδας",
+			},
+			want: "timi_monadas",
+		},
+		{
+			name: "Chinese",
+			args: args{
+				s: "价格 (元)",
+			},
+			want: "u4ef7_u683c_u5143",
+		},
+		{
+			name: "German sharp s",
+			args: args{
+				s: "Straße Nr.",
+			},
+			want: "strasse_nr",
 		},
 	}
 	for _, tt := range tests {
@@ -95,6 +138,73 @@ func Test_toPostgreSQLName(t *testing.T) {
 	}
 }
 
+func Test_columnIdentifiers(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	tests := []struct {
+		name    string
+		headers []string
+		want    []string
+	}{
+		{
+			name:    "Currency symbols collide",
+			headers: []string{"Price €", "Price $", "Price"},
+			want:    []string{"price", "price_2", "price_3"},
+		},
+		{
+			name:    "Empty results",
+			headers: []string{"", "???", "name"},
+			want:    []string{"column_1", "column_2", "name"},
+		},
+		{
+			name:    "Reserved words",
+			headers: []string{"DESC", "Order", "xmin", "description"},
+			want:    []string{"desc_", "order_", "xmin_", "description"},
+		},
+		{
+			name:    "Suffix fits in 63 bytes",
+			headers: []string{long, long + "b"},
+			want:    []string{long[:59], long[:59] + "_2"},
+		},
+		{
+			name:    "Generated name taken by a header",
+			headers: []string{"column_2", ""},
+			want:    []string{"column_2", "column_2_2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := columnIdentifiers(tt.headers)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("columnIdentifiers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// uploadedFile is an upload read from memory
+type uploadedFile struct {
+	*bytes.Reader
+}
+
+func (uploadedFile) Close() error { return nil }
+
+func TestImportUploadRefusesImages(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00")
+	upload := models.File{
+		File:   uploadedFile{bytes.NewReader(png)},
+		Header: &multipart.FileHeader{Filename: "logo.png", Size: int64(len(png))},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	w := httptest.NewRecorder()
+	// Refused before a transaction is started, so no database is needed
+	if importUpload(w, r, nil, nil, upload) {
+		t.Error("importUpload() of an image succeeded")
+	}
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid file type") {
+		t.Errorf("importUpload() of an image = %d %q, want %d", w.Code, w.Body.String(), http.StatusBadRequest)
+	}
+}
+
 /* //go:embed evolutions/*.sql
 var evolutionFS embed.FS
 
@@ -229,3 +339,35 @@ func TestCreateTableForCSV(t *testing.T) {
 		})
 	}
 } */
+
+func TestReadFileSettingsWithMatchedFormat(t *testing.T) {
+	content := []byte("id,name;code\n1,a;x\n2,b;y\n")
+	file := models.File{File: uploadedFile{bytes.NewReader(content)}}
+	r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	if err := readFileSettings(r, &file, nil); err != nil {
+		t.Fatal(err)
+	}
+	if file.Dialect.Delimiter != ',' {
+		t.Fatalf("sniffed delimiter = %q, want ','", file.Dialect.Delimiter)
+	}
+
+	// A format matched afterwards reads the file its own way, as if the upload had named it
+	dialect := models.DefaultDialect
+	dialect.Delimiter = ';'
+	profile := models.DefaultParsingProfile
+	profile.DecimalSeparator, profile.ThousandsSeparator = ",", "."
+	format := models.ImportFormat{Dialect: &dialect, Encoding: "windows-1252", ParsingProfile: &profile}
+	if err := readFileSettings(r, &file, &format); err != nil {
+		t.Fatal(err)
+	}
+	if file.Dialect != dialect || file.Encoding != "windows-1252" || !reflect.DeepEqual(file.Profile, profile) {
+		t.Errorf("readFileSettings() = %+v, %s, %+v, want the format's", file.Dialect, file.Encoding, file.Profile)
+	}
+	stats, err := file.ColumnStats(models.TypeInferenceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"id,name", "code"}; !reflect.DeepEqual(stats.Header, want) {
+		t.Errorf("header = %q, want %q", stats.Header, want)
+	}
+}
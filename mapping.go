@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/nickcoast/gocsv/models"
+)
+
+// mapFile loads an upload's raw table into the canonical table named by its import format's
+// mapping, in one transaction. Rows it loaded before are replaced.
+func (env *Env) mapFile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	tx, err := env.upload.DB.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := models.MapUpload(ctx, tx, id)
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, models.ErrNoTable), errors.Is(err, models.ErrNoFormat), errors.Is(err, models.ErrNoMapping),
+		errors.Is(err, models.ErrUnknownSourceColumn):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.As(err, &pqErr) && pqErr.Code.Class() == "22":
+		// A value that doesn't fit its cast fails the whole load
+		http.Error(w, "Error loading the upload into its canonical table: "+pqErr.Message, http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		log.Println("Error mapping upload:", err)
+		http.Error(w, "Error loading the upload into its canonical table", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error committing transaction", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
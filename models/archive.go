@@ -0,0 +1,209 @@
+package models
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Kinds of compressed and archived uploads
+const (
+	CompressionGzip    = "gzip"
+	CompressionZip     = "zip"
+	CompressionTar     = "tar"
+	CompressionTarGzip = "tar.gz"
+)
+
+// ArchiveLimits guard against archives that expand to far more than was uploaded
+type ArchiveLimits struct {
+	MaxUncompressedSize int64   // bytes extracted from an upload altogether
+	MaxEntries          int     // files in an archive, not counting directories
+	MaxRatio            float64 // bytes extracted per uploaded byte
+}
+
+var DefaultArchiveLimits = ArchiveLimits{MaxUncompressedSize: 2 << 30, MaxEntries: 1000, MaxRatio: 200}
+
+var (
+	ErrArchiveLimit   = errors.New("archive exceeds the extraction limits")
+	ErrInvalidArchive = errors.New("invalid archive")
+)
+
+// DetectCompression returns the kind of compressed file or archive a sample from the start
+// of a file is, or "" if it's neither. Workbooks are zip archives too.
+func DetectCompression(sample []byte) string {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0x1f, 0x8b}):
+		return CompressionGzip
+	case bytes.HasPrefix(sample, []byte("PK\x03\x04")), bytes.HasPrefix(sample, []byte("PK\x05\x06")):
+		return CompressionZip
+	case len(sample) >= 262 && string(sample[257:262]) == "ustar":
+		return CompressionTar
+	}
+	return ""
+}
+
+// extraction keeps track of how much more may be extracted from an upload
+type extraction struct {
+	limit  int64 // the smaller of the size and ratio limits
+	budget int64
+}
+
+func newExtraction(limits ArchiveLimits, uploadSize int64) *extraction {
+	limit := limits.MaxUncompressedSize
+	if byRatio := int64(limits.MaxRatio * float64(uploadSize)); byRatio < limit {
+		limit = byRatio
+	}
+	return &extraction{limit: limit, budget: limit}
+}
+
+// extract copies the content of an archived file to a temporary file
+func (e *extraction) extract(name string, r io.Reader) (File, error) {
+	tmp, err := os.CreateTemp("", "gocsv-extract-*")
+	if err != nil {
+		return File{}, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	f, err := spool(tmp, io.LimitReader(archiveReader{r}, e.budget+1), name, nil)
+	if err == nil && f.Header.Size > e.budget {
+		err = fmt.Errorf("%w: the upload expands to more than %d bytes", ErrArchiveLimit, e.limit)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return File{}, err
+	}
+	e.budget -= f.Header.Size
+	return f, nil
+}
+
+// archiveReader marks errors reading compressed data as the archive's fault
+type archiveReader struct {
+	r io.Reader
+}
+
+func (a archiveReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	return n, err
+}
+
+// RemoveTemp closes and deletes a file spooled or extracted from an upload
+func (f File) RemoveTemp() {
+	f.File.Close()
+	if path := f.Path(); path != "" {
+		os.Remove(path)
+	}
+}
+
+// Gunzip decompresses a gzipped upload to a temporary file, named by the gzip header or
+// else by the upload without its .gz extension
+func Gunzip(f File, limits ArchiveLimits) (File, error) {
+	f.File.Seek(0, io.SeekStart)
+	zr, err := gzip.NewReader(f.File)
+	if err != nil {
+		return File{}, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	defer zr.Close()
+
+	name := path.Base(zr.Name)
+	if zr.Name == "" {
+		name = f.Header.Filename
+		if strings.HasSuffix(strings.ToLower(name), ".tgz") {
+			name = name[:len(name)-len(".tgz")] + ".tar"
+		} else if strings.HasSuffix(strings.ToLower(name), ".gz") {
+			name = name[:len(name)-len(".gz")]
+		}
+	}
+	return newExtraction(limits, f.Header.Size).extract(name, zr)
+}
+
+// skippedEntry reports whether a file in an archive is metadata rather than content,
+// like the __MACOSX folder and ._ files that macOS adds to zips
+func skippedEntry(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, "._") || base == ".DS_Store"
+}
+
+// WalkArchive extracts the files of a zip or tar archive one at a time and calls fn with
+// each, deleting it once fn returns. Directories and macOS metadata are skipped.
+func WalkArchive(f File, compression string, limits ArchiveLimits, fn func(File) error) error {
+	e := newExtraction(limits, f.Header.Size)
+	switch compression {
+	case CompressionZip:
+		zr, err := zip.NewReader(f.File, f.Header.Size)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		entries := []*zip.File{}
+		var declared uint64
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() || skippedEntry(zf.Name) {
+				continue
+			}
+			entries = append(entries, zf)
+			declared += zf.UncompressedSize64
+		}
+		if len(entries) > limits.MaxEntries {
+			return fmt.Errorf("%w: more than %d files", ErrArchiveLimit, limits.MaxEntries)
+		}
+		// The declared sizes can't be trusted to be small, but can be trusted to be too big
+		if declared > uint64(e.limit) {
+			return fmt.Errorf("%w: the upload expands to more than %d bytes", ErrArchiveLimit, e.limit)
+		}
+		for _, zf := range entries {
+			rc, err := zf.Open()
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+			}
+			member, err := e.extract(zf.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			err = fn(member)
+			member.RemoveTemp()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case CompressionTar:
+		f.File.Seek(0, io.SeekStart)
+		tr := tar.NewReader(f.File)
+		count := 0
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+			}
+			if hdr.Typeflag != tar.TypeReg || skippedEntry(hdr.Name) {
+				continue
+			}
+			count++
+			if count > limits.MaxEntries {
+				return fmt.Errorf("%w: more than %d files", ErrArchiveLimit, limits.MaxEntries)
+			}
+			member, err := e.extract(hdr.Name, tr)
+			if err != nil {
+				return err
+			}
+			err = fn(member)
+			member.RemoveTemp()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("%q isn't an archive", compression)
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime/multipart"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testArchive is an uploaded archive read from memory
+type testArchive struct {
+	*bytes.Reader
+}
+
+func (testArchive) Close() error { return nil }
+
+func newTestArchive(name string, content []byte) File {
+	return File{File: testArchive{bytes.NewReader(content)}, Header: &multipart.FileHeader{Filename: name, Size: int64(len(content))}}
+}
+
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a.csv", "dir/", "dir/b.csv", "__MACOSX/dir/._b.csv"} {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarGzArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for _, name := range []string{"a.csv", "dir/b.csv"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))})
+		tw.Write([]byte(files[name]))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gw.Close()
+	return buf.Bytes()
+}
+
+func walkedFiles(t *testing.T, f File, compression string, limits ArchiveLimits) (map[string]string, error) {
+	t.Helper()
+	files := map[string]string{}
+	err := WalkArchive(f, compression, limits, func(member File) error {
+		content, err := io.ReadAll(member.File)
+		if err != nil {
+			return err
+		}
+		if member.Header.Size != int64(len(content)) {
+			t.Errorf("%s has size %d, read %d bytes", member.Header.Filename, member.Header.Size, len(content))
+		}
+		files[member.Header.Filename] = string(content)
+		return nil
+	})
+	return files, err
+}
+
+func TestWalkArchive(t *testing.T) {
+	want := map[string]string{"a.csv": "id,name\n1,Jane\n", "dir/b.csv": "id\n2\n"}
+
+	zipped := zipArchive(t, map[string]string{"a.csv": want["a.csv"], "dir/": "", "dir/b.csv": want["dir/b.csv"], "__MACOSX/dir/._b.csv": "junk"})
+	if got := DetectCompression(zipped); got != CompressionZip {
+		t.Fatalf("DetectCompression() = %q for a zip", got)
+	}
+	files, err := walkedFiles(t, newTestArchive("export.zip", zipped), CompressionZip, DefaultArchiveLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("zip files = %q, want %q", files, want)
+	}
+
+	tgz := tarGzArchive(t, want)
+	if got := DetectCompression(tgz); got != CompressionGzip {
+		t.Fatalf("DetectCompression() = %q for a tar.gz", got)
+	}
+	tarball, err := Gunzip(newTestArchive("export.tgz", tgz), DefaultArchiveLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarball.RemoveTemp()
+	sample := make([]byte, 512)
+	n, _ := tarball.File.Read(sample)
+	if got := DetectCompression(sample[:n]); got != CompressionTar || tarball.Header.Filename != "export.tar" {
+		t.Fatalf("Gunzip() = %s detected as %q", tarball.Header.Filename, got)
+	}
+	files, err = walkedFiles(t, tarball, CompressionTar, DefaultArchiveLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("tar files = %q, want %q", files, want)
+	}
+}
+
+func TestArchiveLimits(t *testing.T) {
+	bomb := strings.Repeat("0", 1<<20)
+	zipped := zipArchive(t, map[string]string{"a.csv": bomb, "dir/b.csv": "id\n2\n"})
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(bomb))
+	gw.Close()
+
+	tests := []struct {
+		name    string
+		walk    func() error
+		wantErr error
+	}{
+		{"Ratio", func() error {
+			_, err := walkedFiles(t, newTestArchive("bomb.zip", zipped), CompressionZip, ArchiveLimits{MaxUncompressedSize: 1 << 30, MaxEntries: 10, MaxRatio: 10})
+			return err
+		}, ErrArchiveLimit},
+		{"Total size", func() error {
+			_, err := walkedFiles(t, newTestArchive("bomb.zip", zipped), CompressionZip, ArchiveLimits{MaxUncompressedSize: 1000, MaxEntries: 10, MaxRatio: 1000})
+			return err
+		}, ErrArchiveLimit},
+		{"Entries", func() error {
+			_, err := walkedFiles(t, newTestArchive("bomb.zip", zipped), CompressionZip, ArchiveLimits{MaxUncompressedSize: 1 << 30, MaxEntries: 1, MaxRatio: 1000})
+			return err
+		}, ErrArchiveLimit},
+		{"Gzip ratio", func() error {
+			_, err := Gunzip(newTestArchive("bomb.csv.gz", gzipped.Bytes()), ArchiveLimits{MaxUncompressedSize: 1 << 30, MaxEntries: 10, MaxRatio: 10})
+			return err
+		}, ErrArchiveLimit},
+		{"Corrupt gzip", func() error {
+			_, err := Gunzip(newTestArchive("bad.csv.gz", gzipped.Bytes()[:gzipped.Len()/2]), ArchiveLimits{MaxUncompressedSize: 1 << 30, MaxEntries: 10, MaxRatio: 1e6})
+			return err
+		}, ErrInvalidArchive},
+	}
+	for _, tt := range tests {
+		if err := tt.walk(); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidStoredName = errors.New("invalid stored file name")
+	ErrBlobNotFound      = errors.New("stored file not found")
+)
+
+// BlobStore keeps files under slash separated names, on local disk or in an S3 bucket. Files are
+// streamed in and out, never held in memory whole.
+type BlobStore interface {
+	// Put stores size bytes read from r under name, replacing what's stored under it. A file is
+	// never stored half written.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Open opens the file stored under name for reading. The caller closes it.
+	Open(ctx context.Context, name string) (Blob, error)
+	// Remove removes the file stored under name. One that's already gone isn't an error.
+	Remove(ctx context.Context, name string) error
+	// Exists reports whether a file is stored under name
+	Exists(ctx context.Context, name string) (bool, error)
+}
+
+// Blob is a stored file being read
+type Blob struct {
+	io.ReadCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// checkBlobName rejects names that aren't clean relative paths, which could leave the store
+func checkBlobName(name string) error {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%w: %q", ErrInvalidStoredName, name)
+	}
+	return nil
+}
+
+// LocalBlobStore keeps files in a directory. Instances sharing it have to share the filesystem.
+type LocalBlobStore struct {
+	dir string
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating file store: %w", err)
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(name string) (string, error) {
+	if err := checkBlobName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	dst, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating file store: %w", err)
+	}
+	// Written next to where it goes and renamed over it, which is atomic
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put_tmp_*")
+	if err != nil {
+		return fmt.Errorf("error storing file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("error storing file: %w", err)
+	}
+	if n != size {
+		return fmt.Errorf("error storing file: read %d bytes, want %d", n, size)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("error storing file: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Open(ctx context.Context, name string) (Blob, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return Blob{}, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return Blob{}, fmt.Errorf("%w: %s", ErrBlobNotFound, name)
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return Blob{}, err
+	}
+	return Blob{ReadCloser: f, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Exists(ctx context.Context, name string) (bool, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalBlobStore) Remove(ctx context.Context, name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+// InsertColumns records the columns of an upload's raw table along with the header text
+// each column name was made from
+func InsertColumns(ctx context.Context, tx *Tx, uploadID int64, columns []Column) error {
+	query := `INSERT INTO core_raw_table_columns (raw_table_id, position, source_position, column_name, original_header, data_type, type_confidence)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	for i, column := range columns {
+		_, err := tx.ExecContext(ctx, query, uploadID, i+1, column.Index+1, column.Name, column.Header, string(column.Type), column.Confidence)
+		if err != nil {
+			return fmt.Errorf("error saving column %s: %w", column.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetColumns returns the columns recorded for an upload's raw table in table order
+func GetColumns(ctx context.Context, tx *Tx, uploadID int64) ([]Column, error) {
+	query := `SELECT column_name, original_header, source_position, data_type, type_confidence
+	FROM core_raw_table_columns
+	WHERE raw_table_id = $1
+	ORDER BY position`
+	rows, err := tx.QueryContext(ctx, query, uploadID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading columns of upload %d: %w", uploadID, err)
+	}
+	defer rows.Close()
+
+	columns := []Column{}
+	for rows.Next() {
+		var column Column
+		var dataType string
+		err := rows.Scan(&column.Name, &column.Header, &column.Index, &dataType, &column.Confidence)
+		if err != nil {
+			return nil, fmt.Errorf("error reading columns of upload %d: %w", uploadID, err)
+		}
+		column.Index--
+		column.Type = ColumnType(dataType)
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,454 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/text/transform"
+)
+
+const (
+	EscapeDouble    = "double"    // quote characters inside quoted fields are doubled: "a ""b"" c"
+	EscapeBackslash = "backslash" // quote characters inside quoted fields are backslash escaped: "a \"b\" c"
+)
+
+// Number of bytes read from the start of an upload when sniffing its encoding and dialect
+const SampleSize = 64 << 10
+
+// Dialect describes how a delimited text file is laid out
+type Dialect struct {
+	Delimiter      rune
+	Quote          rune
+	Escape         string
+	Comment        rune // 0 if the file has no comment lines
+	LineTerminator string
+}
+
+var DefaultDialect = Dialect{
+	Delimiter:      ',',
+	Quote:          '"',
+	Escape:         EscapeDouble,
+	LineTerminator: "\n",
+}
+
+// Candidate delimiters in order of preference when scores are tied
+var delimiterCandidates = []rune{',', ';', '\t', '|', ':'}
+
+type dialectJSON struct {
+	Delimiter      string `json:"delimiter"`
+	Quote          string `json:"quote"`
+	Escape         string `json:"escape"`
+	Comment        string `json:"comment,omitempty"`
+	LineTerminator string `json:"line_terminator"`
+}
+
+func (d Dialect) MarshalJSON() ([]byte, error) {
+	j := dialectJSON{
+		Delimiter:      string(d.Delimiter),
+		Quote:          string(d.Quote),
+		Escape:         d.Escape,
+		LineTerminator: d.LineTerminator,
+	}
+	if d.Comment != 0 {
+		j.Comment = string(d.Comment)
+	}
+	return json.Marshal(j)
+}
+
+func (d *Dialect) UnmarshalJSON(data []byte) error {
+	var j dialectJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*d = Dialect{Escape: j.Escape, LineTerminator: j.LineTerminator}
+	for _, f := range []struct {
+		s string
+		r *rune
+	}{{j.Delimiter, &d.Delimiter}, {j.Quote, &d.Quote}, {j.Comment, &d.Comment}} {
+		runes := []rune(f.s)
+		if len(runes) > 1 {
+			return fmt.Errorf("invalid dialect character %q", f.s)
+		}
+		if len(runes) == 1 {
+			*f.r = runes[0]
+		}
+	}
+	return nil
+}
+
+// Validate checks that the dialect can be used to read a file
+func (d Dialect) Validate() error {
+	if d.Delimiter <= 0 || d.Delimiter > 127 || d.Delimiter == '\r' || d.Delimiter == '\n' {
+		return fmt.Errorf("delimiter must be a single ASCII character other than a line break")
+	}
+	if d.Quote <= 0 || d.Quote > 127 || d.Quote == d.Delimiter || d.Quote == '\r' || d.Quote == '\n' {
+		return fmt.Errorf("quote must be a single ASCII character different from the delimiter")
+	}
+	if d.Escape != EscapeDouble && d.Escape != EscapeBackslash {
+		return fmt.Errorf("escape must be %q or %q", EscapeDouble, EscapeBackslash)
+	}
+	if d.Comment != 0 && (d.Comment > 127 || d.Comment == d.Delimiter || d.Comment == d.Quote) {
+		return fmt.Errorf("comment must be a single ASCII character different from the delimiter and quote")
+	}
+	if d.LineTerminator != "\n" && d.LineTerminator != "\r\n" && d.LineTerminator != "\r" {
+		return fmt.Errorf("line terminator must be LF, CRLF or CR")
+	}
+	return nil
+}
+
+// NewReader returns a csv.Reader configured for the dialect.
+// encoding/csv only understands double-quote quoting with doubled escapes,
+// so anything else is rewritten into that form on the fly.
+func (d Dialect) NewReader(r io.Reader) *csv.Reader {
+	return d.NewReaderAfterLines(r, 0)
+}
+
+// NewReaderAfterLines is like NewReader but discards the first skip lines of r, e.g. a preamble
+// before the header row. Lines are counted the same way as csv.Reader.FieldPos counts them.
+func (d Dialect) NewReaderAfterLines(r io.Reader, skip int) *csv.Reader {
+	return d.csvReader(d.normalize(r, skip))
+}
+
+// normalize rewrites r into the form encoding/csv reads and discards its first skip lines
+func (d Dialect) normalize(r io.Reader, skip int) io.Reader {
+	if d.Delimiter == 0 {
+		d = DefaultDialect
+	}
+	if d.Quote != '"' || d.Escape != EscapeDouble || d.LineTerminator == "\r" {
+		r = transform.NewReader(r, &dialectTransformer{d: d})
+	}
+	if skip > 0 {
+		r = &lineSkipper{r: bufio.NewReader(r), skip: skip}
+	}
+	return r
+}
+
+// csvReader reads the output of normalize
+func (d Dialect) csvReader(r io.Reader) *csv.Reader {
+	if d.Delimiter == 0 {
+		d = DefaultDialect
+	}
+	reader := csv.NewReader(r)
+	reader.Comma = d.Delimiter
+	reader.Comment = d.Comment
+	return reader
+}
+
+// lineSkipper discards lines from the start of a reader
+type lineSkipper struct {
+	r    *bufio.Reader
+	skip int
+}
+
+func (l *lineSkipper) Read(p []byte) (int, error) {
+	for l.skip > 0 {
+		_, err := l.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		l.skip--
+	}
+	return l.r.Read(p)
+}
+
+// dialectTransformer rewrites a file written in an arbitrary dialect into RFC 4180 CSV.
+// Every non-empty field is emitted inside double quotes so that escaped characters,
+// whatever their source form, can always be represented.
+type dialectTransformer struct {
+	d         Dialect
+	lineStart bool // at the start of a line, before any field content
+	fieldOpen bool // a double quote has been emitted for the current field
+	inQuotes  bool // inside a quoted section in the source dialect
+	inComment bool // passing a comment line through untouched
+	started   bool
+}
+
+func (t *dialectTransformer) Reset() {
+	*t = dialectTransformer{d: t.d}
+}
+
+func (t *dialectTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !t.started {
+		t.started = true
+		t.lineStart = true
+	}
+	delim := byte(t.d.Delimiter)
+	quote := byte(t.d.Quote)
+	backslash := t.d.Escape == EscapeBackslash
+
+	emit := func(b ...byte) {
+		nDst += copy(dst[nDst:], b)
+	}
+	openField := func() {
+		if !t.fieldOpen {
+			emit('"')
+			t.fieldOpen = true
+		}
+	}
+	literal := func(c byte) {
+		openField()
+		if c == '"' {
+			emit('"', '"')
+		} else {
+			emit(c)
+		}
+	}
+	endField := func() {
+		if t.fieldOpen {
+			emit('"')
+			t.fieldOpen = false
+		}
+		t.inQuotes = false
+	}
+
+	for nSrc < len(src) {
+		if len(dst)-nDst < 4 {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		c := src[nSrc]
+		var next byte
+		hasNext := nSrc+1 < len(src)
+		if hasNext {
+			next = src[nSrc+1]
+		}
+		needsLookahead := c == '\r' || (backslash && c == '\\') || (t.inQuotes && c == quote)
+		if needsLookahead && !hasNext && !atEOF {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+
+		if t.inComment {
+			if c == '\r' && hasNext && next == '\n' {
+				emit('\r', '\n')
+				nSrc += 2
+				t.inComment, t.lineStart = false, true
+				continue
+			}
+			if c == '\n' || (c == '\r' && t.d.LineTerminator == "\r") {
+				emit('\n')
+				t.inComment, t.lineStart = false, true
+			} else {
+				emit(c)
+			}
+			nSrc++
+			continue
+		}
+		if t.lineStart && t.d.Comment != 0 && rune(c) == t.d.Comment {
+			emit(c)
+			nSrc++
+			t.inComment = true
+			continue
+		}
+		t.lineStart = false
+
+		switch {
+		case backslash && c == '\\' && hasNext:
+			literal(next)
+			nSrc += 2
+			continue
+		case t.inQuotes && c == quote:
+			if t.d.Escape == EscapeDouble && hasNext && next == quote {
+				literal(quote)
+				nSrc += 2
+				continue
+			}
+			t.inQuotes = false
+		case t.inQuotes:
+			literal(c)
+		case c == quote && !t.fieldOpen:
+			openField()
+			t.inQuotes = true
+		case c == delim:
+			endField()
+			emit(delim)
+		case c == '\n':
+			endField()
+			emit('\n')
+			t.lineStart = true
+		case c == '\r' && hasNext && next == '\n':
+			endField()
+			emit('\r', '\n')
+			t.lineStart = true
+			nSrc += 2
+			continue
+		case c == '\r' && t.d.LineTerminator == "\r":
+			endField()
+			emit('\n')
+			t.lineStart = true
+		default:
+			literal(c)
+		}
+		nSrc++
+	}
+	if atEOF {
+		if len(dst)-nDst < 1 {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		endField()
+	}
+	return nDst, nSrc, nil
+}
+
+// SniffDialect infers the dialect of a delimited text file from a sample of its first bytes.
+// Anything that can't be determined falls back to DefaultDialect.
+func SniffDialect(sample []byte) Dialect {
+	d := DefaultDialect
+	sample = bytes.TrimPrefix(sample, []byte("\xEF\xBB\xBF"))
+	if len(sample) == 0 {
+		return d
+	}
+
+	crlf := bytes.Count(sample, []byte("\r\n"))
+	lf := bytes.Count(sample, []byte("\n")) - crlf
+	cr := bytes.Count(sample, []byte("\r")) - crlf
+	switch {
+	case crlf > 0 && crlf >= lf && crlf >= cr:
+		d.LineTerminator = "\r\n"
+	case cr > lf:
+		d.LineTerminator = "\r"
+	}
+
+	lines := bytes.Split(sample, []byte(d.LineTerminator))
+	if len(lines) > 1 {
+		lines = lines[:len(lines)-1] // the last line is empty or was cut off by the sample size
+	}
+	dataLines := [][]byte{}
+	commentLines := [][]byte{}
+	for _, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			commentLines = append(commentLines, line)
+			continue
+		}
+		dataLines = append(dataLines, line)
+	}
+	if len(dataLines) == 0 {
+		dataLines, commentLines = commentLines, nil
+	}
+
+	d.Quote = sniffQuote(dataLines)
+
+	bestScore, bestCount := 0.0, 0
+	for _, candidate := range delimiterCandidates {
+		count, consistency := delimiterConsistency(dataLines, byte(candidate), byte(d.Quote))
+		if count == 0 {
+			continue
+		}
+		if consistency > bestScore || (consistency == bestScore && count > bestCount) {
+			d.Delimiter, bestScore, bestCount = candidate, consistency, count
+		}
+	}
+
+	// '#' is also a common header for row numbers, so only treat those lines as comments
+	// when they don't look like records
+	if len(commentLines) > 0 {
+		isComment := true
+		for _, line := range commentLines {
+			if countOutsideQuotes(line, byte(d.Delimiter), byte(d.Quote)) == bestCount && bestCount > 0 {
+				isComment = false
+				break
+			}
+		}
+		if isComment {
+			d.Comment = '#'
+		}
+	}
+
+	d.Escape = sniffEscape(dataLines, byte(d.Quote))
+	return d
+}
+
+// sniffQuote picks the quote character that most often wraps whole fields
+func sniffQuote(lines [][]byte) rune {
+	isBoundary := func(b byte) bool {
+		for _, c := range delimiterCandidates {
+			if b == byte(c) {
+				return true
+			}
+		}
+		return b == ' '
+	}
+	best, bestCount := '"', 0
+	for _, q := range []rune{'"', '\''} {
+		count := 0
+		for _, line := range lines {
+			for i, c := range line {
+				if c != byte(q) {
+					continue
+				}
+				if i == 0 || isBoundary(line[i-1]) || i == len(line)-1 || isBoundary(line[i+1]) {
+					count++
+				}
+			}
+		}
+		if count > bestCount {
+			best, bestCount = q, count
+		}
+	}
+	return best
+}
+
+// sniffEscape checks whether quotes inside quoted fields are doubled or backslash escaped
+func sniffEscape(lines [][]byte, quote byte) string {
+	doubled, backslashed := 0, 0
+	for _, line := range lines {
+		inQuotes := false
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			switch {
+			case inQuotes && c == '\\' && i+1 < len(line) && line[i+1] == quote:
+				backslashed++
+				i++
+			case inQuotes && c == quote && i+1 < len(line) && line[i+1] == quote:
+				doubled++
+				i++
+			case c == quote:
+				inQuotes = !inQuotes
+			}
+		}
+	}
+	if backslashed > 0 && doubled == 0 {
+		return EscapeBackslash
+	}
+	return EscapeDouble
+}
+
+// delimiterConsistency returns the most common number of delimiters per line
+// and the fraction of lines that have exactly that many
+func delimiterConsistency(lines [][]byte, delim, quote byte) (int, float64) {
+	if len(lines) == 0 {
+		return 0, 0
+	}
+	frequencies := map[int]int{}
+	for _, line := range lines {
+		frequencies[countOutsideQuotes(line, delim, quote)]++
+	}
+	mode, modeFreq := 0, 0
+	for count, freq := range frequencies {
+		if freq > modeFreq || (freq == modeFreq && count > mode) {
+			mode, modeFreq = count, freq
+		}
+	}
+	return mode, float64(modeFreq) / float64(len(lines))
+}
+
+func countOutsideQuotes(line []byte, delim, quote byte) int {
+	count := 0
+	inQuotes := false
+	for _, c := range line {
+		if c == quote {
+			inQuotes = !inQuotes
+		} else if c == delim && !inQuotes {
+			count++
+		}
+	}
+	return count
+}
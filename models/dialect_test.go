@@ -0,0 +1,87 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSniffDialect(t *testing.T) {
+	tests := []struct {
+		name   string
+		sample string
+		want   Dialect
+	}{
+		{
+			name:   "Comma",
+			sample: "name,age,email\nJane,30,jane@example.com\nJohn,40,john@example.com\n",
+			want:   DefaultDialect,
+		},
+		{
+			name:   "Semicolon with CRLF",
+			sample: "name;price\r\n\"Lamp, large\";1.234,56\r\nChair;99,00\r\n",
+			want:   Dialect{Delimiter: ';', Quote: '"', Escape: EscapeDouble, LineTerminator: "\r\n"},
+		},
+		{
+			name:   "Tab with single quotes and backslash escapes",
+			sample: "id\tnote\n1\t'it\\'s here'\n2\t'plain'\n",
+			want:   Dialect{Delimiter: '\t', Quote: '\'', Escape: EscapeBackslash, LineTerminator: "\n"},
+		},
+		{
+			name:   "Pipe with comments and CR",
+			sample: "# exported 2023-01-01\rsku|qty\rA1|2\rB2|3\r",
+			want:   Dialect{Delimiter: '|', Quote: '"', Escape: EscapeDouble, Comment: '#', LineTerminator: "\r"},
+		},
+		{
+			name:   "Hash column header is not a comment",
+			sample: "#,name\n1,Jane\n2,John\n",
+			want:   DefaultDialect,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffDialect([]byte(tt.sample)); got != tt.want {
+				t.Errorf("SniffDialect() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialectNewReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		input   string
+		want    [][]string
+	}{
+		{
+			name:    "Single quotes",
+			dialect: Dialect{Delimiter: ';', Quote: '\'', Escape: EscapeDouble, LineTerminator: "\n"},
+			input:   "a;b\n'x;''y''';\"z\"\n",
+			want:    [][]string{{"a", "b"}, {"x;'y'", "\"z\""}},
+		},
+		{
+			name:    "Backslash escapes",
+			dialect: Dialect{Delimiter: ',', Quote: '"', Escape: EscapeBackslash, LineTerminator: "\n"},
+			input:   "a,b\n\"say \\\"hi\\\"\",c\n",
+			want:    [][]string{{"a", "b"}, {"say \"hi\"", "c"}},
+		},
+		{
+			name:    "CR line endings and comments",
+			dialect: Dialect{Delimiter: '|', Quote: '"', Escape: EscapeDouble, Comment: '#', LineTerminator: "\r"},
+			input:   "# title\ra|b\r\"1\r2\"|3",
+			want:    [][]string{{"a", "b"}, {"1\r2", "3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.dialect.NewReader(strings.NewReader(tt.input)).ReadAll()
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadAll() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
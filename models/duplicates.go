@@ -0,0 +1,129 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// What's done with an upload whose content has been uploaded before
+const (
+	DuplicatesReject = "reject" // refuse the upload
+	DuplicatesWarn   = "warn"   // import it anyway and say what it duplicates
+	DuplicatesLink   = "link"   // record the upload against the earlier upload's table instead of loading it again
+)
+
+var DefaultDuplicatePolicy = DuplicatesWarn
+
+func ValidateDuplicatePolicy(policy string) error {
+	switch policy {
+	case DuplicatesReject, DuplicatesWarn, DuplicatesLink:
+		return nil
+	}
+	return fmt.Errorf("duplicates must be %q, %q or %q", DuplicatesReject, DuplicatesWarn, DuplicatesLink)
+}
+
+// How closely a duplicate matches, from the closest
+const (
+	MatchExact             = "exact"
+	MatchIgnoringBOM       = "ignoring_bom"
+	MatchIgnoringEmptyRows = "ignoring_empty_rows" // for JSON, ignoring whitespace between values
+)
+
+var matchDescriptions = map[string]string{
+	MatchExact:             "exact",
+	MatchIgnoringBOM:       "ignoring BOM",
+	MatchIgnoringEmptyRows: "ignoring empty rows",
+}
+
+// FileHashes are the hashes of an upload's content recorded in core_raw_tables.
+// Workbooks and archives only have Hash.
+type FileHashes struct {
+	Hash        string
+	HashNoBOM   string
+	HashTrimmed string
+}
+
+// Duplicate is an earlier upload with the same content as a new one
+type Duplicate struct {
+	UploadID         int64     `json:"upload_id"`
+	Table            string    `json:"table,omitempty"`
+	FileName         string    `json:"source_filename"`
+	DatetimeUploaded time.Time `json:"datetime_uploaded"`
+	Match            string    `json:"match"`
+	Message          string    `json:"message"`
+}
+
+// FindDuplicate returns the earliest upload that isn't deleted or itself a link, and matches the
+// hashes as closely as any other, or nil if none matches
+func FindDuplicate(ctx context.Context, tx *Tx, hashes FileHashes) (*Duplicate, error) {
+	// The earliest upload of each kind of match
+	query := `SELECT DISTINCT ON (exact, no_bom) id, name, source_filename, datetime_uploaded, exact, no_bom
+	FROM (
+		SELECT id, COALESCE(name, '') AS name, source_filename, datetime_uploaded,
+			COALESCE(file_hash = $1, false) AS exact, COALESCE(file_hash_no_bom = $2, false) AS no_bom
+		FROM core_raw_tables
+		WHERE NOT deleted AND duplicate_of IS NULL
+			AND (file_hash = $1 OR file_hash_no_bom = $2 OR file_hash_trimmed_no_bom = $3)
+	) d
+	ORDER BY exact, no_bom, id`
+	rows, err := tx.QueryContext(ctx, query, nullIfEmpty(hashes.Hash), nullIfEmpty(hashes.HashNoBOM), nullIfEmpty(hashes.HashTrimmed))
+	if err != nil {
+		return nil, fmt.Errorf("error looking for duplicate uploads: %w", err)
+	}
+	defer rows.Close()
+	var candidates []Duplicate
+	for rows.Next() {
+		var d Duplicate
+		var exact, noBOM bool
+		if err := rows.Scan(&d.UploadID, &d.Table, &d.FileName, &d.DatetimeUploaded, &exact, &noBOM); err != nil {
+			return nil, fmt.Errorf("error looking for duplicate uploads: %w", err)
+		}
+		d.Match = duplicateMatch(exact, noBOM)
+		candidates = append(candidates, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error looking for duplicate uploads: %w", err)
+	}
+	return closestDuplicate(candidates), nil
+}
+
+// duplicateMatch is how closely an upload matches, given which of its hashes are the same.
+// Any that matches at all has the same trimmed hash.
+func duplicateMatch(exact, noBOM bool) string {
+	switch {
+	case exact:
+		return MatchExact
+	case noBOM:
+		return MatchIgnoringBOM
+	}
+	return MatchIgnoringEmptyRows
+}
+
+var matchRanks = map[string]int{MatchExact: 0, MatchIgnoringBOM: 1, MatchIgnoringEmptyRows: 2}
+
+// closestDuplicate picks the closest match, the earliest of those as close, and describes it. It
+// returns nil if there are none.
+func closestDuplicate(candidates []Duplicate) *Duplicate {
+	var closest *Duplicate
+	for i := range candidates {
+		d := &candidates[i]
+		if closest == nil || matchRanks[d.Match] < matchRanks[closest.Match] ||
+			matchRanks[d.Match] == matchRanks[closest.Match] && d.UploadID < closest.UploadID {
+			closest = d
+		}
+	}
+	if closest == nil {
+		return nil
+	}
+	d := *closest
+	d.Message = fmt.Sprintf("duplicate of upload #%d (%s)", d.UploadID, matchDescriptions[d.Match])
+	return &d
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateDuplicatePolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		wantErr bool
+	}{
+		{DuplicatesReject, false},
+		{DuplicatesWarn, false},
+		{DuplicatesLink, false},
+		{"", true},
+		{"Reject", true},
+		{"skip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			if err := ValidateDuplicatePolicy(tt.policy); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDuplicatePolicy(%q) error = %v, wantErr %v", tt.policy, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDuplicateMatch(t *testing.T) {
+	tests := []struct {
+		exact, noBOM bool
+		want         string
+	}{
+		{true, true, MatchExact},
+		{true, false, MatchExact}, // a file without a BOM has no hash without one
+		{false, true, MatchIgnoringBOM},
+		{false, false, MatchIgnoringEmptyRows},
+	}
+	for _, tt := range tests {
+		if got := duplicateMatch(tt.exact, tt.noBOM); got != tt.want {
+			t.Errorf("duplicateMatch(%v, %v) = %s, want %s", tt.exact, tt.noBOM, got, tt.want)
+		}
+	}
+}
+
+func TestClosestDuplicate(t *testing.T) {
+	exact := Duplicate{UploadID: 7, Match: MatchExact}
+	earlierExact := Duplicate{UploadID: 5, Match: MatchExact}
+	noBOM := Duplicate{UploadID: 3, Match: MatchIgnoringBOM}
+	trimmed := Duplicate{UploadID: 1, Match: MatchIgnoringEmptyRows}
+	tests := []struct {
+		name       string
+		candidates []Duplicate
+		want       *Duplicate
+	}{
+		{"none", nil, nil},
+		{"exact over earlier closer ones", []Duplicate{trimmed, noBOM, exact}, &Duplicate{UploadID: 7, Match: MatchExact, Message: "duplicate of upload #7 (exact)"}},
+		{"earliest exact", []Duplicate{exact, earlierExact}, &Duplicate{UploadID: 5, Match: MatchExact, Message: "duplicate of upload #5 (exact)"}},
+		{"ignoring BOM over trimmed", []Duplicate{trimmed, noBOM}, &Duplicate{UploadID: 3, Match: MatchIgnoringBOM, Message: "duplicate of upload #3 (ignoring BOM)"}},
+		{"trimmed", []Duplicate{trimmed}, &Duplicate{UploadID: 1, Match: MatchIgnoringEmptyRows, Message: "duplicate of upload #1 (ignoring empty rows)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := closestDuplicate(tt.candidates); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("closestDuplicate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
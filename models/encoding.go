@@ -0,0 +1,173 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/japanese"
+	xunicode "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Canonical names of the encodings that DetectEncoding can report
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+	EncodingWindows1252 = "windows-1252"
+	EncodingISO88591    = "iso-8859-1"
+	EncodingShiftJIS    = "shift_jis"
+)
+
+var knownEncodings = map[string]encoding.Encoding{
+	EncodingUTF8:        xunicode.UTF8,
+	EncodingUTF16LE:     xunicode.UTF16(xunicode.LittleEndian, xunicode.UseBOM),
+	EncodingUTF16BE:     xunicode.UTF16(xunicode.BigEndian, xunicode.UseBOM),
+	EncodingWindows1252: charmap.Windows1252,
+	EncodingISO88591:    charmap.ISO8859_1,
+	EncodingShiftJIS:    japanese.ShiftJIS,
+}
+
+// LookupEncoding returns the encoding for an IANA name or alias such as "latin1" or "cp1252",
+// along with the name it will be recorded under
+func LookupEncoding(name string) (encoding.Encoding, string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if enc, ok := knownEncodings[name]; ok {
+		return enc, name, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, "", fmt.Errorf("unsupported encoding %q", name)
+	}
+	canonical, err := ianaindex.IANA.Name(enc)
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported encoding %q", name)
+	}
+	canonical = strings.ToLower(canonical)
+	if known, ok := knownEncodings[canonical]; ok {
+		enc = known // keep the BOM handling of the UTF-16 variants above
+	}
+	return enc, canonical, nil
+}
+
+// NewDecodingReader returns a reader that transcodes r from the named encoding to UTF-8.
+// A leading byte order mark is dropped, so it doesn't end up in the first header.
+func NewDecodingReader(r io.Reader, name string) io.Reader {
+	if name == "" || name == EncodingUTF8 {
+		return skipBOM(r)
+	}
+	enc, _, err := LookupEncoding(name)
+	if err != nil {
+		return skipBOM(r)
+	}
+	return skipBOM(transform.NewReader(r, enc.NewDecoder()))
+}
+
+// skipBOM drops a UTF-8 byte order mark from the start of r
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\uFEFF" {
+		br.Discard(3)
+	}
+	return br
+}
+
+// DetectEncoding guesses the character encoding of a sample from the start of a file.
+// A byte order mark wins outright; otherwise the sample is checked for UTF-16 zero bytes,
+// valid UTF-8, and finally scored as Shift-JIS against the single byte Western encodings.
+func DetectEncoding(sample []byte) string {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		return EncodingUTF8
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return EncodingUTF16BE
+	}
+	if len(sample) == 0 {
+		return EncodingUTF8
+	}
+
+	// ASCII text in UTF-16 has a zero byte in every other position
+	evenZeros, oddZeros := 0, 0
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	pairs := len(sample) / 2
+	if pairs > 0 && float64(oddZeros)/float64(pairs) > 0.3 && oddZeros > 4*evenZeros {
+		return EncodingUTF16LE
+	}
+	if pairs > 0 && float64(evenZeros)/float64(pairs) > 0.3 && evenZeros > 4*oddZeros {
+		return EncodingUTF16BE
+	}
+
+	if utf8.Valid(trimPartialRune(sample)) {
+		return EncodingUTF8
+	}
+
+	if looksLikeShiftJIS(sample) {
+		return EncodingShiftJIS
+	}
+
+	// The two only differ in 0x80-0x9F, which are control characters in ISO-8859-1
+	// and punctuation such as € and curly quotes in Windows-1252
+	for _, b := range sample {
+		if b >= 0x80 && b <= 0x9F {
+			return EncodingWindows1252
+		}
+	}
+	return EncodingISO88591
+}
+
+// trimPartialRune drops an incomplete UTF-8 sequence cut off at the end of a sample
+func trimPartialRune(sample []byte) []byte {
+	for i := 1; i <= utf8.UTFMax && i <= len(sample); i++ {
+		if utf8.RuneStart(sample[len(sample)-i]) {
+			if !utf8.FullRune(sample[len(sample)-i:]) {
+				return sample[:len(sample)-i]
+			}
+			break
+		}
+	}
+	return sample
+}
+
+// looksLikeShiftJIS decodes the sample as Shift-JIS and checks that it decodes cleanly
+// and that most of the non-ASCII text is Japanese
+func looksLikeShiftJIS(sample []byte) bool {
+	decoded, _, err := transform.Bytes(japanese.ShiftJIS.NewDecoder(), sample)
+	if err != nil {
+		return false
+	}
+	// allow for a double byte character cut in half at the end of the sample
+	decoded = bytes.TrimSuffix(decoded, []byte(string(utf8.RuneError)))
+	invalid, nonASCII, japaneseRunes := 0, 0, 0
+	for _, r := range string(decoded) {
+		switch {
+		case r == utf8.RuneError:
+			invalid++
+		case r < utf8.RuneSelf:
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana, unicode.Han) || (r >= 0xFF00 && r <= 0xFFEF) || (r >= 0x3000 && r <= 0x303F):
+			nonASCII++
+			japaneseRunes++
+		default:
+			nonASCII++
+		}
+	}
+	return invalid == 0 && japaneseRunes > 0 && japaneseRunes*2 >= nonASCII
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	xunicode "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+func encode(t *testing.T, s string, e transform.Transformer) []byte {
+	t.Helper()
+	b, _, err := transform.Bytes(e, []byte(s))
+	if err != nil {
+		t.Fatalf("encoding sample: %v", err)
+	}
+	return b
+}
+
+func TestDetectEncoding(t *testing.T) {
+	csv := "name;city\nJosé;Málaga\nRenée;Zürich – “centre”\n"
+	tests := []struct {
+		name   string
+		sample []byte
+		want   string
+	}{
+		{name: "ASCII", sample: []byte("a,b\n1,2\n"), want: EncodingUTF8},
+		{name: "UTF-8 with BOM", sample: append([]byte{0xEF, 0xBB, 0xBF}, csv...), want: EncodingUTF8},
+		{name: "UTF-16LE with BOM", sample: encode(t, csv, xunicode.UTF16(xunicode.LittleEndian, xunicode.UseBOM).NewEncoder()), want: EncodingUTF16LE},
+		{name: "UTF-16BE without BOM", sample: encode(t, csv, xunicode.UTF16(xunicode.BigEndian, xunicode.IgnoreBOM).NewEncoder()), want: EncodingUTF16BE},
+		{name: "Windows-1252", sample: encode(t, csv, charmap.Windows1252.NewEncoder()), want: EncodingWindows1252},
+		{name: "ISO-8859-1", sample: encode(t, "name;city\nJosé;Málaga\n", charmap.ISO8859_1.NewEncoder()), want: EncodingISO88591},
+		{name: "Shift-JIS", sample: encode(t, "品番,名前\n1,東京タワー\n2,ふじさん\n", japanese.ShiftJIS.NewEncoder()), want: EncodingShiftJIS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectEncoding(tt.sample); got != tt.want {
+				t.Errorf("DetectEncoding() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDecodingReader(t *testing.T) {
+	sample := encode(t, "name\nJosé\n", xunicode.UTF16(xunicode.LittleEndian, xunicode.UseBOM).NewEncoder())
+	got, err := io.ReadAll(NewDecodingReader(strings.NewReader(string(sample)), EncodingUTF16LE))
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(got) != "name\nJosé\n" {
+		t.Errorf("ReadAll() = %q, want %q", got, "name\nJosé\n")
+	}
+}
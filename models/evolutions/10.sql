@@ -0,0 +1,4 @@
+-- Table: public.core_import_formats
+-- UPS
+ALTER TABLE IF EXISTS public.core_import_formats
+ADD COLUMN IF NOT EXISTS fixed_width jsonb;
@@ -0,0 +1,7 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS json_options jsonb,
+ADD COLUMN IF NOT EXISTS json_path text COLLATE pg_catalog."default";
+COMMENT ON COLUMN public.core_raw_tables.json_options IS 'How the records of a JSON upload were flattened into columns';
+COMMENT ON COLUMN public.core_raw_tables.json_path IS 'Dotted path of the JSON arrays the table was exploded from';
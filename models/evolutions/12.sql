@@ -0,0 +1,5 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS compression character varying(16) COLLATE pg_catalog."default";
+COMMENT ON COLUMN public.core_raw_tables.compression IS 'How the upload was compressed or archived: gzip, zip, tar or tar.gz. NULL for files uploaded as they are and the files of archives';
@@ -0,0 +1,10 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS duplicate_of integer REFERENCES public.core_raw_tables (id),
+ADD COLUMN IF NOT EXISTS duplicate_match character varying(32) COLLATE pg_catalog."default";
+CREATE INDEX IF NOT EXISTS core_raw_tables_file_hash_idx ON public.core_raw_tables (file_hash);
+CREATE INDEX IF NOT EXISTS core_raw_tables_file_hash_no_bom_idx ON public.core_raw_tables (file_hash_no_bom);
+CREATE INDEX IF NOT EXISTS core_raw_tables_file_hash_trimmed_no_bom_idx ON public.core_raw_tables (file_hash_trimmed_no_bom);
+COMMENT ON COLUMN public.core_raw_tables.duplicate_of IS 'Earlier upload with the same content whose table this upload was linked to instead of being loaded again';
+COMMENT ON COLUMN public.core_raw_tables.duplicate_match IS 'How closely the upload matched duplicate_of: exact, ignoring_bom or ignoring_empty_rows';
@@ -0,0 +1,5 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS dedup_name character varying(63) COLLATE pg_catalog."default";
+COMMENT ON COLUMN public.core_raw_tables.dedup_name IS 'DB table name containing the first of each set of identical rows of the table, if one was requested';
@@ -0,0 +1,11 @@
+-- Table: public.core_raw_tables
+-- UPS
+COMMENT ON COLUMN public.core_raw_tables.key_field_id IS 'FK to core_raw_table_columns: the column holding the key of each row';
+COMMENT ON COLUMN public.core_raw_tables.key_count_new IS 'Count of distinct keys not in earlier uploads of the same format';
+COMMENT ON COLUMN public.core_raw_tables.key_count_old IS 'Count of distinct keys already in earlier uploads of the same format';
+COMMENT ON COLUMN public.core_raw_tables.key_count_unique IS 'Count of keys in only one row of the table';
+COMMENT ON COLUMN public.core_raw_tables.key_count_dup IS 'Count of distinct keys in more than one row of the table';
+CREATE INDEX IF NOT EXISTS core_raw_tables_format_id_idx ON public.core_raw_tables (format_id);
+-- Table: public.core_import_formats
+ALTER TABLE IF EXISTS public.core_import_formats
+ADD COLUMN IF NOT EXISTS key_column character varying(255) COLLATE pg_catalog."default";
@@ -0,0 +1,43 @@
+-- Table: public.core_import_formats
+-- UPS
+CREATE TABLE IF NOT EXISTS public.core_import_formats (
+    id SERIAL,
+    name character varying(255) COLLATE pg_catalog."default" NOT NULL,
+    description text COLLATE pg_catalog."default" NOT NULL DEFAULT '',
+    columns jsonb NOT NULL DEFAULT '[]',
+    dialect jsonb,
+    encoding character varying(40) COLLATE pg_catalog."default",
+    key_column character varying(255) COLLATE pg_catalog."default",
+    parsing_profile jsonb,
+    fixed_width jsonb,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    CONSTRAINT core_import_formats_pkey PRIMARY KEY (id)
+) TABLESPACE pg_default;
+-- Formats that were created by hand before this evolution get the columns they're missing
+ALTER TABLE IF EXISTS public.core_import_formats
+ADD COLUMN IF NOT EXISTS description text COLLATE pg_catalog."default" NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS columns jsonb NOT NULL DEFAULT '[]',
+ADD COLUMN IF NOT EXISTS dialect jsonb,
+ADD COLUMN IF NOT EXISTS encoding character varying(40) COLLATE pg_catalog."default",
+ADD COLUMN IF NOT EXISTS key_column character varying(255) COLLATE pg_catalog."default",
+ADD COLUMN IF NOT EXISTS parsing_profile jsonb,
+ADD COLUMN IF NOT EXISTS fixed_width jsonb,
+ADD COLUMN IF NOT EXISTS created_at timestamp with time zone NOT NULL DEFAULT now(),
+ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone NOT NULL DEFAULT now();
+CREATE UNIQUE INDEX IF NOT EXISTS core_import_formats_name_key ON public.core_import_formats (name);
+ALTER TABLE IF EXISTS public.core_import_formats OWNER to postgres;
+GRANT DELETE,
+    INSERT,
+    SELECT,
+    UPDATE ON TABLE public.core_import_formats TO ogrego;
+GRANT ALL ON TABLE public.core_import_formats TO postgres;
+GRANT SELECT,
+    USAGE ON SEQUENCE public.core_import_formats_id_seq TO ogrego;
+COMMENT ON TABLE public.core_import_formats IS 'Kinds of files that are uploaded again and again, and how to read them';
+COMMENT ON COLUMN public.core_import_formats.columns IS 'Columns files of the format are expected to have: name, type and required';
+COMMENT ON COLUMN public.core_import_formats.dialect IS 'CSV dialect files of the format are read with instead of a sniffed one';
+COMMENT ON COLUMN public.core_import_formats.encoding IS 'Character encoding files of the format are read with instead of a detected one';
+COMMENT ON COLUMN public.core_import_formats.key_column IS 'Column holding the key of each row, by header or column name';
+COMMENT ON COLUMN public.core_import_formats.parsing_profile IS 'Number and date parsing profile used to convert values';
+COMMENT ON COLUMN public.core_import_formats.fixed_width IS 'Field positions of fixed-width files of the format: fields and skip_lines';
@@ -0,0 +1,14 @@
+-- Table: public.core_import_formats
+-- UPS
+ALTER TABLE IF EXISTS public.core_import_formats
+ADD COLUMN IF NOT EXISTS mapping jsonb;
+COMMENT ON COLUMN public.core_import_formats.mapping IS 'How raw tables of the format are loaded into its canonical table: target_table and columns with source, target, cast, default and transforms';
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS mapped_table character varying(63) COLLATE pg_catalog."default",
+ADD COLUMN IF NOT EXISTS mapped_row_count bigint,
+ADD COLUMN IF NOT EXISTS mapped_at timestamp with time zone;
+COMMENT ON COLUMN public.core_raw_tables.mapped_table IS 'Canonical table the raw table was last loaded into by its format''s mapping';
+COMMENT ON COLUMN public.core_raw_tables.mapped_row_count IS 'Count of rows loaded into the canonical table, each with _upload_id set to this upload';
+COMMENT ON COLUMN public.core_raw_tables.mapped_at IS 'When the mapping was last run for this upload';
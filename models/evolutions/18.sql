@@ -0,0 +1,37 @@
+-- Table: public.core_validation_violations
+-- UPS
+ALTER TABLE IF EXISTS public.core_import_formats
+ADD COLUMN IF NOT EXISTS rules jsonb NOT NULL DEFAULT '[]';
+COMMENT ON COLUMN public.core_import_formats.rules IS 'Validation rules checked on each upload of the format: column, kind, severity and the kind''s settings';
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS validation_status character varying(10) COLLATE pg_catalog."default",
+ADD COLUMN IF NOT EXISTS validation_errors bigint,
+ADD COLUMN IF NOT EXISTS validation_warnings bigint;
+COMMENT ON COLUMN public.core_raw_tables.validation_status IS 'valid, warnings or invalid by the rules of the import format. NULL if they were never run.';
+COMMENT ON COLUMN public.core_raw_tables.validation_errors IS 'Count of violations of rules with severity error';
+COMMENT ON COLUMN public.core_raw_tables.validation_warnings IS 'Count of violations of rules with severity warning';
+CREATE TABLE IF NOT EXISTS public.core_validation_violations (
+    id SERIAL,
+    raw_table_id integer NOT NULL,
+    rule_index integer NOT NULL,
+    column_name text COLLATE pg_catalog."default" NOT NULL,
+    row_id bigint,
+    value text COLLATE pg_catalog."default",
+    severity character varying(10) COLLATE pg_catalog."default" NOT NULL,
+    message text COLLATE pg_catalog."default" NOT NULL,
+    CONSTRAINT core_validation_violations_pkey PRIMARY KEY (id),
+    CONSTRAINT core_validation_violations_raw_table_id_fkey FOREIGN KEY (raw_table_id) REFERENCES public.core_raw_tables (id) ON DELETE CASCADE
+) TABLESPACE pg_default;
+CREATE INDEX IF NOT EXISTS core_validation_violations_raw_table_id_idx ON public.core_validation_violations (raw_table_id, rule_index, row_id);
+ALTER TABLE IF EXISTS public.core_validation_violations OWNER to postgres;
+GRANT DELETE,
+    INSERT,
+    SELECT,
+    UPDATE ON TABLE public.core_validation_violations TO ogrego;
+GRANT ALL ON TABLE public.core_validation_violations TO postgres;
+GRANT SELECT,
+    USAGE ON SEQUENCE public.core_validation_violations_id_seq TO ogrego;
+COMMENT ON TABLE public.core_validation_violations IS 'Cells of uploads that broke a validation rule of their import format, up to 1000 per rule';
+COMMENT ON COLUMN public.core_validation_violations.rule_index IS 'Position of the rule in the format''s rules, starting from 0';
+COMMENT ON COLUMN public.core_validation_violations.column_name IS 'Column the rule checks, as the rule names it';
+COMMENT ON COLUMN public.core_validation_violations.row_id IS '_id of the row in the raw table. NULL if the column is missing.';
@@ -0,0 +1,9 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+-- Files deleted before this evolution start their retention now
+UPDATE public.core_raw_tables SET deleted_at = now() WHERE deleted AND deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS core_raw_tables_deleted_at_idx ON public.core_raw_tables (deleted_at) WHERE deleted;
+COMMENT ON COLUMN public.core_raw_tables.deleted IS 'Is file deleted. Deleted files can be restored until they are purged.';
+COMMENT ON COLUMN public.core_raw_tables.deleted_at IS 'When the file was deleted. Files deleted longer than the retention are purged.';
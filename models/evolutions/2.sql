@@ -0,0 +1,5 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS dialect jsonb;
+COMMENT ON COLUMN public.core_raw_tables.dialect IS 'CSV dialect used to read the file: delimiter, quote, escape, comment, line_terminator';
@@ -0,0 +1,5 @@
+-- Table: public.core_raw_tables
+-- UPS
+-- Stored files are counted by the uploads that refer to them when uploads are purged
+CREATE INDEX IF NOT EXISTS core_raw_tables_saved_filename_idx ON public.core_raw_tables (saved_filename) WHERE saved_filename IS NOT NULL;
+COMMENT ON COLUMN public.core_raw_tables.saved_filename IS 'Name of the uploaded file in the file store, named by the SHA-256 of its content. NULL for uploads from before files were stored by content.';
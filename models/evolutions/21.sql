@@ -0,0 +1,31 @@
+-- FUNCTION: public.core_try_numeric, public.core_try_date, public.core_try_timestamp
+-- UPS
+-- Validation rules compare values as numbers and dates. A value that matches the pattern of one
+-- can still be out of range, such as 2023-02-30, which would fail the whole rule if cast.
+CREATE OR REPLACE FUNCTION public.core_try_numeric(value text) RETURNS numeric
+LANGUAGE plpgsql STABLE AS $$
+BEGIN
+	RETURN value::numeric;
+EXCEPTION WHEN others THEN
+	RETURN NULL;
+END
+$$;
+CREATE OR REPLACE FUNCTION public.core_try_date(value text) RETURNS date
+LANGUAGE plpgsql STABLE AS $$
+BEGIN
+	RETURN value::date;
+EXCEPTION WHEN others THEN
+	RETURN NULL;
+END
+$$;
+CREATE OR REPLACE FUNCTION public.core_try_timestamp(value text) RETURNS timestamp
+LANGUAGE plpgsql STABLE AS $$
+BEGIN
+	RETURN value::timestamp;
+EXCEPTION WHEN others THEN
+	RETURN NULL;
+END
+$$;
+COMMENT ON FUNCTION public.core_try_numeric(text) IS 'The value as a number, or NULL if it isn''t one';
+COMMENT ON FUNCTION public.core_try_date(text) IS 'The value as a date, or NULL if it isn''t one';
+COMMENT ON FUNCTION public.core_try_timestamp(text) IS 'The value as a timestamp, or NULL if it isn''t one';
@@ -0,0 +1,5 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS encoding character varying(40) COLLATE pg_catalog."default";
+COMMENT ON COLUMN public.core_raw_tables.encoding IS 'character encoding of the uploaded file, transcoded to UTF-8 on import';
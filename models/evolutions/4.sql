@@ -0,0 +1,8 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS parsing_profile jsonb;
+COMMENT ON COLUMN public.core_raw_tables.parsing_profile IS 'number and date parsing profile used to convert values: decimal_separator, thousands_separator, date_order, date_layouts';
+-- Table: public.core_import_formats
+ALTER TABLE IF EXISTS public.core_import_formats
+ADD COLUMN IF NOT EXISTS parsing_profile jsonb;
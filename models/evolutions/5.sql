@@ -0,0 +1,7 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS header_offset integer NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS has_header boolean NOT NULL DEFAULT true;
+COMMENT ON COLUMN public.core_raw_tables.header_offset IS 'Count of preamble lines before the header row, or before the first data row when there is no header';
+COMMENT ON COLUMN public.core_raw_tables.has_header IS 'Does the table start with a header row. Without one, columns are named column_1, column_2, ...';
@@ -0,0 +1,29 @@
+-- Table: public.core_raw_table_columns
+-- UPS
+CREATE TABLE IF NOT EXISTS public.core_raw_table_columns (
+    id SERIAL,
+    raw_table_id integer NOT NULL,
+    position integer NOT NULL,
+    source_position integer NOT NULL,
+    column_name character varying(63) COLLATE pg_catalog."default" NOT NULL,
+    original_header text COLLATE pg_catalog."default" NOT NULL DEFAULT '',
+    data_type character varying(20) COLLATE pg_catalog."default" NOT NULL DEFAULT 'text',
+    type_confidence double precision NOT NULL DEFAULT 1,
+    CONSTRAINT core_raw_table_columns_pkey PRIMARY KEY (id),
+    CONSTRAINT core_raw_table_columns_raw_table_id_fkey FOREIGN KEY (raw_table_id) REFERENCES public.core_raw_tables (id) ON DELETE CASCADE,
+    CONSTRAINT core_raw_table_columns_name_key UNIQUE (raw_table_id, column_name)
+) TABLESPACE pg_default;
+ALTER TABLE IF EXISTS public.core_raw_table_columns OWNER to postgres;
+GRANT DELETE,
+    INSERT,
+    SELECT,
+    UPDATE ON TABLE public.core_raw_table_columns TO ogrego;
+GRANT ALL ON TABLE public.core_raw_table_columns TO postgres;
+GRANT SELECT,
+    USAGE ON SEQUENCE public.core_raw_table_columns_id_seq TO ogrego;
+COMMENT ON TABLE public.core_raw_table_columns IS 'Columns of each raw table and the CSV header text they were named from';
+COMMENT ON COLUMN public.core_raw_table_columns.position IS 'Position of the column in the raw table, excluding system columns, starting from 1';
+COMMENT ON COLUMN public.core_raw_table_columns.source_position IS 'Position of the column in the uploaded file, starting from 1';
+COMMENT ON COLUMN public.core_raw_table_columns.original_header IS 'Header text as uploaded. Empty if the file had no header row';
+COMMENT ON COLUMN public.core_raw_table_columns.data_type IS 'Inferred column type';
+COMMENT ON COLUMN public.core_raw_table_columns.type_confidence IS 'Fraction of non-empty values that fit data_type';
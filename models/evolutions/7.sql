@@ -0,0 +1,26 @@
+-- Table: public.core_raw_table_rejected_rows
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS row_policy jsonb;
+COMMENT ON COLUMN public.core_raw_tables.row_policy IS 'What was done with rows that have fewer (short_rows) or more (long_rows) fields than the header';
+CREATE TABLE IF NOT EXISTS public.core_raw_table_rejected_rows (
+    id SERIAL,
+    raw_table_id integer NOT NULL,
+    line_number integer NOT NULL,
+    raw_text text COLLATE pg_catalog."default" NOT NULL,
+    error_message text COLLATE pg_catalog."default" NOT NULL,
+    CONSTRAINT core_raw_table_rejected_rows_pkey PRIMARY KEY (id),
+    CONSTRAINT core_raw_table_rejected_rows_raw_table_id_fkey FOREIGN KEY (raw_table_id) REFERENCES public.core_raw_tables (id) ON DELETE CASCADE
+) TABLESPACE pg_default;
+CREATE INDEX IF NOT EXISTS core_raw_table_rejected_rows_raw_table_id_idx ON public.core_raw_table_rejected_rows (raw_table_id, line_number);
+ALTER TABLE IF EXISTS public.core_raw_table_rejected_rows OWNER to postgres;
+GRANT DELETE,
+    INSERT,
+    SELECT,
+    UPDATE ON TABLE public.core_raw_table_rejected_rows TO ogrego;
+GRANT ALL ON TABLE public.core_raw_table_rejected_rows TO postgres;
+GRANT SELECT,
+    USAGE ON SEQUENCE public.core_raw_table_rejected_rows_id_seq TO ogrego;
+COMMENT ON TABLE public.core_raw_table_rejected_rows IS 'Rows of uploaded files that could not be parsed or were rejected by the row policy';
+COMMENT ON COLUMN public.core_raw_table_rejected_rows.line_number IS 'Line of the uploaded file the row starts on, starting from 1';
+COMMENT ON COLUMN public.core_raw_table_rejected_rows.raw_text IS 'Text of the row as read from the file, transcoded to UTF-8';
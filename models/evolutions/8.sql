@@ -0,0 +1,24 @@
+-- Table: public.core_raw_table_repairs
+-- UPS
+CREATE TABLE IF NOT EXISTS public.core_raw_table_repairs (
+    id SERIAL,
+    raw_table_id integer NOT NULL,
+    line_number integer NOT NULL,
+    raw_text text COLLATE pg_catalog."default" NOT NULL,
+    action text COLLATE pg_catalog."default" NOT NULL,
+    CONSTRAINT core_raw_table_repairs_pkey PRIMARY KEY (id),
+    CONSTRAINT core_raw_table_repairs_raw_table_id_fkey FOREIGN KEY (raw_table_id) REFERENCES public.core_raw_tables (id) ON DELETE CASCADE
+) TABLESPACE pg_default;
+CREATE INDEX IF NOT EXISTS core_raw_table_repairs_raw_table_id_idx ON public.core_raw_table_repairs (raw_table_id, line_number);
+ALTER TABLE IF EXISTS public.core_raw_table_repairs OWNER to postgres;
+GRANT DELETE,
+    INSERT,
+    SELECT,
+    UPDATE ON TABLE public.core_raw_table_repairs TO ogrego;
+GRANT ALL ON TABLE public.core_raw_table_repairs TO postgres;
+GRANT SELECT,
+    USAGE ON SEQUENCE public.core_raw_table_repairs_id_seq TO ogrego;
+COMMENT ON TABLE public.core_raw_table_repairs IS 'Malformed rows that were repaired or skipped when an upload was read in recovery mode';
+COMMENT ON COLUMN public.core_raw_table_repairs.line_number IS 'Line of the uploaded file the row starts on, starting from 1';
+COMMENT ON COLUMN public.core_raw_table_repairs.raw_text IS 'Text of the row as read from the file, transcoded to UTF-8';
+COMMENT ON COLUMN public.core_raw_table_repairs.action IS 'What the parser did to read the row, or which lines it skipped';
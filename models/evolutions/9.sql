@@ -0,0 +1,8 @@
+-- Table: public.core_raw_tables
+-- UPS
+ALTER TABLE IF EXISTS public.core_raw_tables
+ADD COLUMN IF NOT EXISTS parent_id integer REFERENCES public.core_raw_tables (id) ON DELETE CASCADE,
+ADD COLUMN IF NOT EXISTS sheet_name character varying(255) COLLATE pg_catalog."default";
+CREATE INDEX IF NOT EXISTS core_raw_tables_parent_id_idx ON public.core_raw_tables (parent_id);
+COMMENT ON COLUMN public.core_raw_tables.parent_id IS 'Upload this table is part of, e.g. the workbook of a worksheet. NULL for uploads themselves';
+COMMENT ON COLUMN public.core_raw_tables.sheet_name IS 'Name of the worksheet the table was loaded from';
@@ -1,75 +1,199 @@
 package models
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"encoding/csv"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"strings"
 )
 
 type File struct {
-	File   multipart.File
-	Header *multipart.FileHeader
+	File       multipart.File
+	Header     *multipart.FileHeader
+	Encoding   string
+	Dialect    Dialect
+	Profile    ParsingProfile
+	Layout     HeaderLayout
+	Policy     RowPolicy
+	FixedWidth *FixedWidthLayout // nil for delimited files
+	// Compression of the upload the file was decompressed from, empty if it wasn't compressed
+	Compression string
+	// Hashes of the content, with and without a BOM, computed as the file was spooled
+	Hash      string
+	HashNoBOM string
+	// The columns scanned as the file was spooled, nil if they weren't
+	spooledScan *columnScan
 }
 
-func (f File) GetMaxColumnLengths() ([]int, []int, error) {
-	csvReader := csv.NewReader(f.File)
+// columnScan is a scan of a file's columns and the settings it was read with
+type columnScan struct {
+	key   string
+	stats ColumnStats
+	err   error
+}
+
+// scanKey is equal for files whose columns are read the same way
+func (f File) scanKey(opts TypeInferenceOptions) string {
+	key, _ := json.Marshal(struct {
+		Encoding   string
+		Dialect    Dialect
+		Profile    ParsingProfile
+		Layout     HeaderLayout
+		Policy     RowPolicy
+		FixedWidth *FixedWidthLayout
+		Options    TypeInferenceOptions
+	}{f.Encoding, f.Dialect, f.Profile, f.Layout, f.Policy, f.FixedWidth, opts})
+	return string(key)
+}
+
+// newRawCSVReader reads every line of r, including any preamble,
+// with records of any length
+func (f File) newRawCSVReader(r io.Reader) *csv.Reader {
+	reader := f.Dialect.NewReader(NewDecodingReader(r, f.Encoding))
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+// sample returns the first SampleSize bytes of the file and rewinds it
+func (f File) sample() ([]byte, error) {
+	f.File.Seek(0, io.SeekStart)
+	sample := make([]byte, SampleSize)
+	n, err := io.ReadFull(f.File, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("error reading file sample: %w", err)
+	}
+	_, err = f.File.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return sample[:n], nil
+}
+
+// DetectEncoding guesses the file's character encoding from its first SampleSize bytes
+func (f File) DetectEncoding() (string, error) {
+	sample, err := f.sample()
+	if err != nil {
+		return "", err
+	}
+	return DetectEncoding(sample), nil
+}
 
-	headerRow, err := csvReader.Read()
+// SniffDialect detects the file's dialect from its first SampleSize bytes,
+// after transcoding them from the file's encoding
+func (f File) SniffDialect() (Dialect, error) {
+	sample, err := f.sample()
 	if err != nil {
-		log.Println("Error reading CSV header:", err)
-		return nil, nil, err
+		return Dialect{}, err
 	}
+	decoded, err := io.ReadAll(NewDecodingReader(bytes.NewReader(sample), f.Encoding))
+	if err != nil {
+		return Dialect{}, fmt.Errorf("error decoding file sample: %w", err)
+	}
+	return SniffDialect(decoded), nil
+}
+
+// ColumnStats is what's needed to create the raw table of a file
+type ColumnStats struct {
+	Header        []string
+	MaxLengths    []int // length of the longest value in each column
+	HeaderLengths []int
+	Types         []InferredType
+	HashTrimmed   string // of the non-empty values of every line, see writeNonEmptyRows
+}
+
+// ColumnStats returns the file's column stats: those scanned as it was spooled, if it was read
+// with the same settings as it has now, or else those of a scan of the file now
+func (f File) ColumnStats(opts TypeInferenceOptions) (ColumnStats, error) {
+	if f.spooledScan != nil && f.spooledScan.err == nil && f.spooledScan.key == f.scanKey(opts) {
+		return f.spooledScan.stats, nil
+	}
+	return f.ScanColumns(opts)
+}
 
-	maxLengths := []int{}
-	headerLengths := make([]int, len(headerRow))
+// ScanColumns reads the file once to measure and type its columns and to hash its trimmed
+// content. Rows rejected by the row policy aren't counted.
+func (f File) ScanColumns(opts TypeInferenceOptions) (ColumnStats, error) {
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return ColumnStats{}, err
+	}
+	return f.scanContent(f.File, opts)
+}
+
+// scanContent is ScanColumns reading the file's content from r
+func (f File) scanContent(r io.Reader, opts TypeInferenceOptions) (ColumnStats, error) {
+	// The trimmed hash covers the preamble too, so it's computed from a copy of the
+	// content as the rows are read
+	pr, pw := io.Pipe()
+	hashed := make(chan error, 1)
+	hasher := sha256.New()
+	go func() {
+		err := f.writeNonEmptyRows(pr, hasher)
+		io.Copy(io.Discard, pr) // keep the content flowing if that stopped early
+		hashed <- err
+	}()
+	stats, err := f.scanColumns(io.TeeReader(r, pw), opts)
+	pw.CloseWithError(err)
+	if hashErr := <-hashed; err == nil && hashErr != nil {
+		err = fmt.Errorf("error hashing trimmed file: %w", hashErr)
+	}
+	if err != nil {
+		return ColumnStats{}, err
+	}
+	stats.HashTrimmed = hex.EncodeToString(hasher.Sum(nil))
+	return stats, nil
+}
+
+func (f File) scanColumns(r io.Reader, opts TypeInferenceOptions) (ColumnStats, error) {
+	rowReader, err := f.newRowReader(r)
+	if err != nil {
+		return ColumnStats{}, err
+	}
+	stats := ColumnStats{Header: rowReader.Header(), MaxLengths: []int{}, HeaderLengths: make([]int, len(rowReader.Header()))}
 	// header row lengths
-	for i, cell := range headerRow {
-		headerLengths[i] = len(cell)
+	for i, cell := range rowReader.Header() {
+		stats.HeaderLengths[i] = len(cell)
 	}
 
+	inferrer := NewTypeInferrer(opts, f.Profile)
 	for {
-		row, err := csvReader.Read()
+		row, err := rowReader.Read()
 		if err == io.EOF {
 			break
 		}
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			continue
+		}
 		if err != nil {
-			log.Println("Error reading CSV:", err)
-			return nil, nil, err
+			return ColumnStats{}, err
 		}
 
-		for i, cell := range row {
+		for i, cell := range row.Values {
 			cellLength := len(cell)
-			if i >= len(maxLengths) {
-				maxLengths = append(maxLengths, cellLength)
-			} else if cellLength > maxLengths[i] {
-				maxLengths[i] = cellLength
+			if i >= len(stats.MaxLengths) {
+				stats.MaxLengths = append(stats.MaxLengths, cellLength)
+			} else if cellLength > stats.MaxLengths[i] {
+				stats.MaxLengths[i] = cellLength
 			}
 		}
+		inferrer.Add(row.Values)
 	}
-
-	return maxLengths, headerLengths, nil
-}
-
-func (f File) RemoveBOM(file io.Reader) io.Reader {
-	const bom = '\uFEFF'
-	buffer := new(bytes.Buffer)
-	reader := bufio.NewReader(file)
-	io.TeeReader(reader, buffer)
-	r, _, err := reader.ReadRune()
-	if err != nil {
-		return file
-	}
-	if r != bom {
-		return io.MultiReader(bytes.NewReader([]byte(string(r))), buffer)
+	stats.Types = inferrer.Types()
+	// Fixed-width layouts can declare the type of a field
+	if f.FixedWidth != nil {
+		for i, field := range f.FixedWidth.Fields {
+			if field.Type != "" && i < len(stats.Types) {
+				stats.Types[i] = InferredType{Type: field.Type, Confidence: 1}
+			}
+		}
 	}
-	return buffer
+	return stats, nil
 }
 
 func (f File) CalculateFileHash(file io.Reader) (string, error) {
@@ -83,23 +207,23 @@ func (f File) CalculateFileHash(file io.Reader) (string, error) {
 	return hex.EncodeToString(hashBytes), nil
 }
 
+// writeNonEmptyRows writes every line of the file read from r to w as CSV, leaving out empty
+// values and lines without any, so files that only differ in blank lines and padding hash the same.
 // TODO: add removal of empty columns
-func (f File) trimAndRemoveBOM(file io.Reader) (io.Reader, error) {
-	file = f.RemoveBOM(file)
-	return f.RemoveEmptyRows(file)
-}
-
-func (f File) RemoveEmptyRows(file io.Reader) (io.Reader, error) {
-	reader := csv.NewReader(file)
-	var cleanedData bytes.Buffer
-	writer := csv.NewWriter(&cleanedData)
+func (f File) writeNonEmptyRows(r io.Reader, w io.Writer) error {
+	reader := f.newRawCSVReader(r)
+	writer := csv.NewWriter(w)
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			continue // rows that can't be parsed aren't part of the content
+		}
 		if err != nil {
-			return nil, fmt.Errorf("error reading CSV file: %w", err)
+			return fmt.Errorf("error reading CSV file: %w", err)
 		}
 
 		// Remove empty rows and columns
@@ -114,10 +238,10 @@ func (f File) RemoveEmptyRows(file io.Reader) (io.Reader, error) {
 		if len(trimmedRecord) > 0 {
 			err = writer.Write(trimmedRecord)
 			if err != nil {
-				return nil, fmt.Errorf("error writing cleaned CSV data: %w", err)
+				return fmt.Errorf("error writing cleaned CSV data: %w", err)
 			}
 		}
 	}
 	writer.Flush()
-	return bytes.NewReader(cleanedData.Bytes()), nil
+	return writer.Error()
 }
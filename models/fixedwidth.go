@@ -0,0 +1,111 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// How the values of a fixed-width field are trimmed of padding
+const (
+	TrimBoth  = "both" // the default
+	TrimLeft  = "left"
+	TrimRight = "right"
+	TrimNone  = "none"
+)
+
+// FixedWidthField is a column of a fixed-width file
+type FixedWidthField struct {
+	Name   string     `json:"name"`
+	Start  int        `json:"start"`  // position of the field's first character in the line, starting from 1
+	Length int        `json:"length"` // in characters
+	Trim   string     `json:"trim,omitempty"`
+	Type   ColumnType `json:"type,omitempty"` // inferred from the values if empty
+}
+
+// FixedWidthLayout describes a fixed-width file, where each field takes up the same
+// character positions on every line
+type FixedWidthLayout struct {
+	Fields    []FixedWidthField `json:"fields"`
+	SkipLines int               `json:"skip_lines,omitempty"` // header or banner lines before the first record
+}
+
+// ParseFixedWidthLayout reads a layout stored as JSON in an import format
+func ParseFixedWidthLayout(data []byte) (*FixedWidthLayout, error) {
+	var layout FixedWidthLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return nil, err
+	}
+	return &layout, layout.Validate()
+}
+
+// Validate checks that every field has a name, a position and a known type and trim
+func (l FixedWidthLayout) Validate() error {
+	if len(l.Fields) == 0 {
+		return fmt.Errorf("a fixed-width layout needs at least one field")
+	}
+	if l.SkipLines < 0 {
+		return fmt.Errorf("skip_lines can't be negative")
+	}
+	for i, field := range l.Fields {
+		if strings.TrimSpace(field.Name) == "" {
+			return fmt.Errorf("field %d has no name", i+1)
+		}
+		if field.Start < 1 || field.Length < 1 {
+			return fmt.Errorf("field %s must start at position 1 or later and be at least 1 character long", field.Name)
+		}
+		switch field.Trim {
+		case "", TrimBoth, TrimLeft, TrimRight, TrimNone:
+		default:
+			return fmt.Errorf("trim of field %s must be %q, %q, %q or %q", field.Name, TrimBoth, TrimLeft, TrimRight, TrimNone)
+		}
+		if field.Type != "" && field.Type != TypeText {
+			known := false
+			for _, t := range inferableTypes {
+				known = known || field.Type == t
+			}
+			if !known {
+				return fmt.Errorf("field %s has unknown type %q", field.Name, field.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// Names returns the field names in layout order
+func (l FixedWidthLayout) Names() []string {
+	names := make([]string, len(l.Fields))
+	for i, field := range l.Fields {
+		names[i] = field.Name
+	}
+	return names
+}
+
+// Split cuts a line into the values of the fields. Fields past the end of a short line are empty.
+func (l FixedWidthLayout) Split(line string) []string {
+	runes := []rune(line)
+	values := make([]string, len(l.Fields))
+	for i, field := range l.Fields {
+		start := field.Start - 1
+		if start >= len(runes) {
+			continue
+		}
+		end := start + field.Length
+		if end > len(runes) {
+			end = len(runes)
+		}
+		value := string(runes[start:end])
+		switch field.Trim {
+		case TrimLeft:
+			value = strings.TrimLeftFunc(value, unicode.IsSpace)
+		case TrimRight:
+			value = strings.TrimRightFunc(value, unicode.IsSpace)
+		case TrimNone:
+		default:
+			value = strings.TrimSpace(value)
+		}
+		values[i] = value
+	}
+	return values
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestFixedWidthLayoutSplit(t *testing.T) {
+	layout := FixedWidthLayout{Fields: []FixedWidthField{
+		{Name: "id", Start: 1, Length: 5},
+		{Name: "name", Start: 6, Length: 8, Trim: TrimRight},
+		{Name: "code", Start: 14, Length: 4, Trim: TrimNone},
+		{Name: "amount", Start: 18, Length: 6, Trim: TrimLeft},
+	}}
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"00042  Zoë   AB   12.50", []string{"00042", "  Zoë", "AB  ", "12.50"}},
+		{"00043Bob     CD", []string{"00043", "Bob", "CD", ""}},
+		{"7", []string{"7", "", "", ""}},
+	}
+	for _, tt := range tests {
+		if got := layout.Split(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Split(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseFixedWidthLayout(t *testing.T) {
+	tests := []struct {
+		json    string
+		wantErr bool
+	}{
+		{`{"fields":[{"name":"id","start":1,"length":5,"type":"integer"}],"skip_lines":1}`, false},
+		{`{"fields":[]}`, true},
+		{`{"fields":[{"name":"id","start":0,"length":5}]}`, true},
+		{`{"fields":[{"name":"id","start":1,"length":5,"trim":"middle"}]}`, true},
+		{`{"fields":[{"name":"id","start":1,"length":5,"type":"money"}]}`, true},
+		{`{"fields":[{"name":" ","start":1,"length":5}]}`, true},
+	}
+	for _, tt := range tests {
+		if _, err := ParseFixedWidthLayout([]byte(tt.json)); (err != nil) != tt.wantErr {
+			t.Errorf("ParseFixedWidthLayout(%s) error = %v, wantErr %v", tt.json, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRowReaderFixedWidth(t *testing.T) {
+	layout := &FixedWidthLayout{
+		Fields: []FixedWidthField{
+			{Name: "id", Start: 1, Length: 5, Type: TypeText},
+			{Name: "amount", Start: 6, Length: 7},
+		},
+		SkipLines: 2,
+	}
+	file := newTestFile("PAYROLL EXTRACT\nID   AMOUNT\n00001  10.50\n\n00002 200.00\r\n", DefaultRowPolicy)
+	file.FixedWidth = layout
+	file.Layout = HeaderLayout{Offset: layout.SkipLines}
+
+	reader, err := file.NewRowReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reader.Header(), []string{"id", "amount"}) {
+		t.Errorf("Header() = %q", reader.Header())
+	}
+	rows := []Row{}
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	want := []Row{
+		{Line: 3, Values: []string{"00001", "10.50"}, Raw: "00001  10.50"},
+		{Line: 5, Values: []string{"00002", "200.00"}, Raw: "00002 200.00"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %+v, want %+v", rows, want)
+	}
+
+	stats, err := file.ScanColumns(DefaultTypeInferenceOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTypes := []InferredType{{TypeText, 1}, {TypeNumeric, 1}}
+	if !reflect.DeepEqual(stats.Types, wantTypes) {
+		t.Errorf("ScanColumns() types = %v, want %v", stats.Types, wantTypes)
+	}
+}
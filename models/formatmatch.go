@@ -0,0 +1,136 @@
+package models
+
+import "sort"
+
+// An upload is given the best matching import format without being asked when its score is at
+// least AutoMatchScore, it has every column the format requires, and the next best is at least
+// AutoMatchMargin behind it
+const (
+	AutoMatchScore  = 0.9
+	AutoMatchMargin = 0.1
+)
+
+// TypeMismatch is a column whose values don't fit the type the import format declares for it
+type TypeMismatch struct {
+	Column   string     `json:"column"`
+	Declared ColumnType `json:"declared"`
+	Inferred ColumnType `json:"inferred"`
+}
+
+// FormatMatch is how well the columns of an upload match those of an import format. Columns are
+// named by their normalised headers.
+type FormatMatch struct {
+	FormatID        int64          `json:"format_id"`
+	Name            string         `json:"name"`
+	Score           float64        `json:"score"`   // 1 if the columns and their types are the same
+	Matched         []string       `json:"matched"` // in both, in the format's order
+	Missing         []string       `json:"missing"` // in the format but not the upload
+	MissingRequired []string       `json:"missing_required,omitempty"`
+	Unexpected      []string       `json:"unexpected"` // in the upload but not the format
+	TypeMismatches  []TypeMismatch `json:"type_mismatches,omitempty"`
+}
+
+// wideningTypes are the inferred types that also fit a declared type. Inference picks the most
+// specific type, so a numeric column whose values are all whole numbers is inferred as integer.
+var wideningTypes = map[ColumnType][]ColumnType{
+	TypeBigint:      {TypeInteger},
+	TypeNumeric:     {TypeInteger, TypeBigint},
+	TypeTimestamp:   {TypeDate},
+	TypeTimestampTZ: {TypeDate, TypeTimestamp},
+}
+
+// typeFits reports whether values inferred as inferred can be loaded as declared
+func typeFits(declared, inferred ColumnType) bool {
+	if declared == "" || declared == TypeText || declared == inferred {
+		return true
+	}
+	for _, t := range wideningTypes[declared] {
+		if t == inferred {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchFormat compares the columns of an upload with those of an import format. Headers on both
+// sides are compared after normalize. A matching column counts half if its type doesn't fit.
+func MatchFormat(format ImportFormat, columns []Column, normalize func(string) string) FormatMatch {
+	match := FormatMatch{FormatID: format.ID, Name: format.Name, Matched: []string{}, Missing: []string{}, Unexpected: []string{}}
+	uploaded := map[string]ColumnType{}
+	var names []string
+	for _, column := range columns {
+		name := normalize(column.Header)
+		if _, ok := uploaded[name]; ok {
+			match.Unexpected = append(match.Unexpected, name) // a repeat can match only once
+			continue
+		}
+		uploaded[name] = column.Type
+		names = append(names, name)
+	}
+
+	expected := map[string]bool{}
+	weight := 0.0
+	for _, column := range format.Columns {
+		name := normalize(column.Name)
+		expected[name] = true
+		inferred, ok := uploaded[name]
+		if !ok {
+			match.Missing = append(match.Missing, name)
+			if column.Required {
+				match.MissingRequired = append(match.MissingRequired, name)
+			}
+			continue
+		}
+		match.Matched = append(match.Matched, name)
+		if typeFits(column.Type, inferred) {
+			weight++
+			continue
+		}
+		weight += 0.5
+		match.TypeMismatches = append(match.TypeMismatches, TypeMismatch{Column: name, Declared: column.Type, Inferred: inferred})
+	}
+	for _, name := range names {
+		if !expected[name] {
+			match.Unexpected = append(match.Unexpected, name)
+		}
+	}
+
+	if total := len(format.Columns) + len(match.Unexpected); total > 0 {
+		match.Score = weight / float64(total)
+	}
+	return match
+}
+
+// MatchFormats ranks the import formats by how well an upload's columns match them, best first.
+// Formats without columns and fixed-width formats, whose columns aren't read from a header,
+// aren't ranked, nor are formats that match no column.
+func MatchFormats(formats []ImportFormat, columns []Column, normalize func(string) string) []FormatMatch {
+	matches := []FormatMatch{}
+	for _, format := range formats {
+		if len(format.Columns) == 0 || format.FixedWidth != nil {
+			continue
+		}
+		if match := MatchFormat(format, columns, normalize); len(match.Matched) > 0 {
+			matches = append(matches, match)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	return matches
+}
+
+// ConfidentMatch returns the best of ranked matches if it's good enough to assign without asking
+func ConfidentMatch(matches []FormatMatch) *FormatMatch {
+	if len(matches) == 0 {
+		return nil
+	}
+	best := matches[0]
+	if best.Score < AutoMatchScore || len(best.MissingRequired) > 0 {
+		return nil
+	}
+	if len(matches) > 1 && best.Score-matches[1].Score < AutoMatchMargin {
+		return nil
+	}
+	return &best
+}
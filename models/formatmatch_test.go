@@ -0,0 +1,91 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchFormats(t *testing.T) {
+	normalize := func(s string) string { return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), " ", "_")) }
+	orders := ImportFormat{ID: 1, Name: "Orders", Columns: []FormatColumn{
+		{Name: "Order ID", Type: TypeInteger, Required: true},
+		{Name: "Total", Type: TypeNumeric},
+		{Name: "Placed", Type: TypeTimestamp},
+	}}
+	returns := ImportFormat{ID: 2, Name: "Returns", Columns: []FormatColumn{
+		{Name: "Order ID", Type: TypeInteger, Required: true},
+		{Name: "Reason"},
+	}}
+	fixed := ImportFormat{ID: 3, Name: "Fixed", Columns: []FormatColumn{{Name: "order_id"}}, FixedWidth: &FixedWidthLayout{}}
+	formats := []ImportFormat{returns, orders, fixed, {ID: 4, Name: "Empty"}}
+
+	tests := []struct {
+		name      string
+		columns   []Column
+		want      []FormatMatch
+		confident int64 // ID of the format assigned without asking, 0 if none
+	}{
+		{
+			name:    "exact",
+			columns: []Column{{Header: "order_id", Type: TypeInteger}, {Header: "TOTAL", Type: TypeInteger}, {Header: "placed", Type: TypeDate}},
+			want: []FormatMatch{
+				{FormatID: 1, Name: "Orders", Score: 1, Matched: []string{"order_id", "total", "placed"}, Missing: []string{}, Unexpected: []string{}},
+				{FormatID: 2, Name: "Returns", Score: 0.25, Matched: []string{"order_id"}, Missing: []string{"reason"}, Unexpected: []string{"total", "placed"}},
+			},
+			confident: 1,
+		},
+		{
+			name:    "missing required column",
+			columns: []Column{{Header: "Total", Type: TypeNumeric}, {Header: "Placed", Type: TypeTimestamp}},
+			want: []FormatMatch{
+				{FormatID: 1, Name: "Orders", Score: 2.0 / 3, Matched: []string{"total", "placed"}, Missing: []string{"order_id"}, MissingRequired: []string{"order_id"}, Unexpected: []string{}},
+			},
+		},
+		{
+			name:    "type mismatch and unexpected column",
+			columns: []Column{{Header: "Order ID", Type: TypeText}, {Header: "Reason", Type: TypeText}, {Header: "Note", Type: TypeText}},
+			want: []FormatMatch{
+				{FormatID: 2, Name: "Returns", Score: 0.5, Matched: []string{"order_id", "reason"}, Missing: []string{}, Unexpected: []string{"note"},
+					TypeMismatches: []TypeMismatch{{Column: "order_id", Declared: TypeInteger, Inferred: TypeText}}},
+				{FormatID: 1, Name: "Orders", Score: 0.1, Matched: []string{"order_id"}, Missing: []string{"total", "placed"}, MissingRequired: nil, Unexpected: []string{"reason", "note"},
+					TypeMismatches: []TypeMismatch{{Column: "order_id", Declared: TypeInteger, Inferred: TypeText}}},
+			},
+		},
+		{
+			name:    "repeated header",
+			columns: []Column{{Header: "Order ID", Type: TypeInteger}, {Header: "order id", Type: TypeInteger}, {Header: "Reason", Type: TypeText}},
+			want: []FormatMatch{
+				{FormatID: 2, Name: "Returns", Score: 2.0 / 3, Matched: []string{"order_id", "reason"}, Missing: []string{}, Unexpected: []string{"order_id"}},
+				{FormatID: 1, Name: "Orders", Score: 0.2, Matched: []string{"order_id"}, Missing: []string{"total", "placed"}, Unexpected: []string{"order_id", "reason"}},
+			},
+		},
+		{
+			name:    "no match",
+			columns: []Column{{Header: "sku", Type: TypeText}},
+			want:    []FormatMatch{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MatchFormats(formats, tt.columns, normalize)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MatchFormats() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+			var confident int64
+			if best := ConfidentMatch(got); best != nil {
+				confident = best.FormatID
+			}
+			if confident != tt.confident {
+				t.Errorf("ConfidentMatch() = %d, want %d", confident, tt.confident)
+			}
+		})
+	}
+}
+
+func TestConfidentMatchNeedsMargin(t *testing.T) {
+	matches := []FormatMatch{{FormatID: 1, Score: 1}, {FormatID: 2, Score: 0.95}}
+	if best := ConfidentMatch(matches); best != nil {
+		t.Errorf("ConfidentMatch() = %d, want none as the next best is too close", best.FormatID)
+	}
+}
@@ -0,0 +1,373 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrFormatNotFound      = errors.New("import format not found")
+	ErrFormatNameTaken     = errors.New("an import format with that name already exists")
+	ErrFormatInUse         = errors.New("the import format is used by uploads")
+	ErrInvalidImportFormat = errors.New("invalid import format")
+)
+
+// FormatColumn is a column that files of an import format are expected to have
+type FormatColumn struct {
+	Name     string     `json:"name"`           // header text in the file
+	Type     ColumnType `json:"type,omitempty"` // text if empty
+	Required bool       `json:"required,omitempty"`
+}
+
+// ImportFormat describes a kind of file that's uploaded again and again, such as a supplier's
+// monthly export, and how to read it. Uploads name their format with format_id.
+type ImportFormat struct {
+	ID             int64             `json:"id"`
+	Name           string            `json:"name"`
+	Description    string            `json:"description"`
+	Columns        []FormatColumn    `json:"columns"`
+	Dialect        *Dialect          `json:"dialect,omitempty"`  // sniffed from each file if nil. Characters left out are DefaultDialect's.
+	Encoding       string            `json:"encoding,omitempty"` // detected in each file if empty
+	KeyColumn      string            `json:"key_column,omitempty"`
+	ParsingProfile *ParsingProfile   `json:"parsing_profile,omitempty"` // DefaultParsingProfile if nil
+	FixedWidth     *FixedWidthLayout `json:"fixed_width,omitempty"`     // for fixed-width files instead of delimited ones
+	Mapping        *Mapping          `json:"mapping,omitempty"`         // how uploads are loaded into a canonical table
+	Rules          []ValidationRule  `json:"rules"`                     // checked on each upload once it's loaded
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+// UnmarshalJSON reads a format sent to the API. A parsing profile is read like a stored one,
+// so it can name a built in profile and only give the fields that differ.
+func (f *ImportFormat) UnmarshalJSON(data []byte) error {
+	type plain ImportFormat
+	var raw struct {
+		plain
+		ParsingProfile json.RawMessage `json:"parsing_profile,omitempty"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	*f = ImportFormat(raw.plain)
+	if len(raw.ParsingProfile) > 0 && string(raw.ParsingProfile) != "null" {
+		profile, err := ParseParsingProfile(raw.ParsingProfile)
+		if err != nil {
+			return fmt.Errorf("%w: parsing_profile: %v", ErrInvalidImportFormat, err)
+		}
+		f.ParsingProfile = &profile
+	}
+	return nil
+}
+
+// Normalize fills in what's left out of a format's dialect and names its encoding canonically,
+// then checks the format can be used to read files
+func (f *ImportFormat) Normalize() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidImportFormat, fmt.Sprintf(format, args...))
+	}
+	f.Name = strings.TrimSpace(f.Name)
+	if f.Name == "" {
+		return invalid("name is required")
+	}
+	if len(f.Name) > 255 {
+		return invalid("name can't be longer than 255 bytes")
+	}
+	if f.Columns == nil {
+		f.Columns = []FormatColumn{}
+	}
+	seen := map[string]bool{}
+	for i, column := range f.Columns {
+		if strings.TrimSpace(column.Name) == "" {
+			return invalid("column %d has no name", i+1)
+		}
+		if seen[column.Name] {
+			return invalid("column %q is listed twice", column.Name)
+		}
+		seen[column.Name] = true
+		if !knownType(column.Type) {
+			return invalid("column %q has unknown type %q", column.Name, column.Type)
+		}
+	}
+	if f.KeyColumn != "" && len(f.Columns) > 0 && !seen[f.KeyColumn] {
+		return invalid("key_column %q isn't one of the columns", f.KeyColumn)
+	}
+	if f.Dialect != nil {
+		d := *f.Dialect
+		if d.Delimiter == 0 {
+			d.Delimiter = DefaultDialect.Delimiter
+		}
+		if d.Quote == 0 {
+			d.Quote = DefaultDialect.Quote
+		}
+		if d.Escape == "" {
+			d.Escape = DefaultDialect.Escape
+		}
+		if d.LineTerminator == "" {
+			d.LineTerminator = DefaultDialect.LineTerminator
+		}
+		if err := d.Validate(); err != nil {
+			return invalid("dialect: %v", err)
+		}
+		f.Dialect = &d
+	}
+	if f.Encoding != "" {
+		_, name, err := LookupEncoding(f.Encoding)
+		if err != nil {
+			return invalid("%v", err)
+		}
+		f.Encoding = name
+	}
+	if f.ParsingProfile != nil {
+		if err := f.ParsingProfile.Validate(); err != nil {
+			return invalid("parsing_profile: %v", err)
+		}
+	}
+	if f.FixedWidth != nil {
+		if err := f.FixedWidth.Validate(); err != nil {
+			return invalid("fixed_width: %v", err)
+		}
+	}
+	if f.Mapping != nil {
+		if err := f.Mapping.Validate(); err != nil {
+			return invalid("mapping: %v", err)
+		}
+	}
+	if f.Rules == nil {
+		f.Rules = []ValidationRule{}
+	}
+	for i, rule := range f.Rules {
+		if err := rule.Validate(); err != nil {
+			return invalid("rule %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// knownType reports whether a column can be declared with type t. Empty means text.
+func knownType(t ColumnType) bool {
+	if t == "" || t == TypeText {
+		return true
+	}
+	for _, inferable := range inferableTypes {
+		if t == inferable {
+			return true
+		}
+	}
+	return false
+}
+
+type ImportFormatModel struct {
+	DB *DB
+}
+
+const importFormatColumns = `id, name, description, columns, dialect, COALESCE(encoding, ''), COALESCE(key_column, ''),
+	parsing_profile, fixed_width, mapping, rules, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanImportFormat(row rowScanner) (ImportFormat, error) {
+	var f ImportFormat
+	var columns, rules []byte
+	var dialect, profile, fixedWidth, mapping sql.NullString
+	err := row.Scan(&f.ID, &f.Name, &f.Description, &columns, &dialect, &f.Encoding, &f.KeyColumn, &profile, &fixedWidth, &mapping, &rules, &f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(columns, &f.Columns); err != nil {
+		return f, fmt.Errorf("error reading columns of import format %d: %w", f.ID, err)
+	}
+	if err := json.Unmarshal(rules, &f.Rules); err != nil {
+		return f, fmt.Errorf("error reading rules of import format %d: %w", f.ID, err)
+	}
+	if dialect.Valid {
+		f.Dialect = &Dialect{}
+		if err := json.Unmarshal([]byte(dialect.String), f.Dialect); err != nil {
+			return f, fmt.Errorf("error reading dialect of import format %d: %w", f.ID, err)
+		}
+	}
+	if profile.Valid {
+		p, err := ParseParsingProfile([]byte(profile.String))
+		if err != nil {
+			return f, fmt.Errorf("error reading parsing profile of import format %d: %w", f.ID, err)
+		}
+		f.ParsingProfile = &p
+	}
+	if fixedWidth.Valid {
+		f.FixedWidth, err = ParseFixedWidthLayout([]byte(fixedWidth.String))
+		if err != nil {
+			return f, fmt.Errorf("error reading fixed-width layout of import format %d: %w", f.ID, err)
+		}
+	}
+	if mapping.Valid {
+		f.Mapping = &Mapping{}
+		if err := json.Unmarshal([]byte(mapping.String), f.Mapping); err != nil {
+			return f, fmt.Errorf("error reading mapping of import format %d: %w", f.ID, err)
+		}
+	}
+	return f, nil
+}
+
+const allImportFormats = "SELECT " + importFormatColumns + " FROM core_import_formats ORDER BY name, id"
+
+// All returns the import formats in name order
+func (m ImportFormatModel) All(ctx context.Context) ([]ImportFormat, error) {
+	return scanImportFormats(m.DB.QueryWithContext(ctx, allImportFormats))
+}
+
+// ListImportFormats returns the import formats in name order as part of an upload's transaction
+func ListImportFormats(ctx context.Context, tx *Tx) ([]ImportFormat, error) {
+	return scanImportFormats(tx.QueryContext(ctx, allImportFormats))
+}
+
+func scanImportFormats(rows *sql.Rows, err error) ([]ImportFormat, error) {
+	if err != nil {
+		return nil, fmt.Errorf("error reading import formats: %w", err)
+	}
+	defer rows.Close()
+
+	formats := []ImportFormat{}
+	for rows.Next() {
+		f, err := scanImportFormat(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading import formats: %w", err)
+		}
+		formats = append(formats, f)
+	}
+	return formats, rows.Err()
+}
+
+func (m ImportFormatModel) Get(ctx context.Context, id int64) (ImportFormat, error) {
+	f, err := scanImportFormat(m.DB.QueryRowContext(ctx, "SELECT "+importFormatColumns+" FROM core_import_formats WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return f, ErrFormatNotFound
+	}
+	return f, err
+}
+
+// GetImportFormat reads an import format as part of an upload's transaction
+func GetImportFormat(ctx context.Context, tx *Tx, id int64) (ImportFormat, error) {
+	f, err := scanImportFormat(tx.QueryRowContext(ctx, "SELECT "+importFormatColumns+" FROM core_import_formats WHERE id = $1", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return f, ErrFormatNotFound
+	}
+	return f, err
+}
+
+// formatValues returns the JSON columns of a format, NULL where it has nothing
+func formatValues(f ImportFormat) (columns, rules string, dialect, profile, fixedWidth, mapping interface{}, err error) {
+	encode := func(v interface{}) (interface{}, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+	columnsJSON, err := json.Marshal(f.Columns)
+	if err != nil {
+		return "", "", nil, nil, nil, nil, err
+	}
+	if f.Dialect != nil {
+		if dialect, err = encode(f.Dialect); err != nil {
+			return "", "", nil, nil, nil, nil, err
+		}
+	}
+	if f.ParsingProfile != nil {
+		if profile, err = encode(f.ParsingProfile); err != nil {
+			return "", "", nil, nil, nil, nil, err
+		}
+	}
+	if f.FixedWidth != nil {
+		if fixedWidth, err = encode(f.FixedWidth); err != nil {
+			return "", "", nil, nil, nil, nil, err
+		}
+	}
+	if f.Mapping != nil {
+		if mapping, err = encode(f.Mapping); err != nil {
+			return "", "", nil, nil, nil, nil, err
+		}
+	}
+	rulesJSON, err := json.Marshal(f.Rules)
+	if err != nil {
+		return "", "", nil, nil, nil, nil, err
+	}
+	return string(columnsJSON), string(rulesJSON), dialect, profile, fixedWidth, mapping, nil
+}
+
+// formatError turns a violation of the unique name into ErrFormatNameTaken
+func formatError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrFormatNameTaken
+	}
+	return err
+}
+
+// Insert saves a new import format and returns it as saved
+func (m ImportFormatModel) Insert(ctx context.Context, f ImportFormat) (ImportFormat, error) {
+	if err := f.Normalize(); err != nil {
+		return f, err
+	}
+	columns, rules, dialect, profile, fixedWidth, mapping, err := formatValues(f)
+	if err != nil {
+		return f, err
+	}
+	query := `INSERT INTO core_import_formats (name, description, columns, dialect, encoding, key_column, parsing_profile, fixed_width, mapping, rules)
+	VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7, $8, $9, $10)
+	RETURNING ` + importFormatColumns
+	saved, err := scanImportFormat(m.DB.QueryRowContext(ctx, query, f.Name, f.Description, columns, dialect, f.Encoding, f.KeyColumn, profile, fixedWidth, mapping, rules))
+	if err != nil {
+		return f, fmt.Errorf("error saving import format: %w", formatError(err))
+	}
+	return saved, nil
+}
+
+// Update replaces an import format with f, keeping its ID, and returns it as saved
+func (m ImportFormatModel) Update(ctx context.Context, f ImportFormat) (ImportFormat, error) {
+	if err := f.Normalize(); err != nil {
+		return f, err
+	}
+	columns, rules, dialect, profile, fixedWidth, mapping, err := formatValues(f)
+	if err != nil {
+		return f, err
+	}
+	query := `UPDATE core_import_formats SET name = $2, description = $3, columns = $4, dialect = $5, encoding = NULLIF($6, ''),
+		key_column = NULLIF($7, ''), parsing_profile = $8, fixed_width = $9, mapping = $10, rules = $11, updated_at = now()
+	WHERE id = $1
+	RETURNING ` + importFormatColumns
+	saved, err := scanImportFormat(m.DB.QueryRowContext(ctx, query, f.ID, f.Name, f.Description, columns, dialect, f.Encoding, f.KeyColumn, profile, fixedWidth, mapping, rules))
+	if errors.Is(err, sql.ErrNoRows) {
+		return f, ErrFormatNotFound
+	}
+	if err != nil {
+		return f, fmt.Errorf("error saving import format %d: %w", f.ID, formatError(err))
+	}
+	return saved, nil
+}
+
+// Delete removes an import format that no upload uses
+func (m ImportFormatModel) Delete(ctx context.Context, id int64) error {
+	query := `DELETE FROM core_import_formats
+	WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM core_raw_tables WHERE format_id = $1)
+	RETURNING id`
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&id)
+	if !errors.Is(err, sql.ErrNoRows) {
+		if err != nil {
+			return fmt.Errorf("error deleting import format %d: %w", id, err)
+		}
+		return nil
+	}
+	// Either it doesn't exist or it's in use
+	if _, err := m.Get(ctx, id); err != nil {
+		return err
+	}
+	return ErrFormatInUse
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestImportFormatNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{"name only", `{"name": "Supplier prices"}`, false},
+		{"full", `{"name": "Orders", "description": "Monthly orders", "columns": [{"name": "Order ID", "type": "integer", "required": true}, {"name": "Placed", "type": "date"}],
+			"dialect": {"delimiter": ";"}, "encoding": "latin1", "key_column": "Order ID", "parsing_profile": {"name": "de-DE"}}`, false},
+		{"no name", `{"name": "  "}`, true},
+		{"unknown type", `{"name": "Orders", "columns": [{"name": "Total", "type": "money"}]}`, true},
+		{"column twice", `{"name": "Orders", "columns": [{"name": "Total"}, {"name": "Total"}]}`, true},
+		{"key not a column", `{"name": "Orders", "columns": [{"name": "Total"}], "key_column": "Order ID"}`, true},
+		{"bad dialect", `{"name": "Orders", "dialect": {"delimiter": "\""}}`, true},
+		{"unknown encoding", `{"name": "Orders", "encoding": "klingon"}`, true},
+		{"bad fixed width", `{"name": "Orders", "fixed_width": {"fields": []}}`, true},
+		{"profile named and overridden", `{"name": "Orders", "parsing_profile": {"name": "de-DE", "date_order": "ymd"}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f ImportFormat
+			if err := json.Unmarshal([]byte(tt.json), &f); err != nil {
+				t.Fatal(err)
+			}
+			err := f.Normalize()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Normalize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidImportFormat) {
+				t.Errorf("Normalize() error = %v, want ErrInvalidImportFormat", err)
+			}
+		})
+	}
+}
+
+func TestImportFormatNormalizeFillsIn(t *testing.T) {
+	var f ImportFormat
+	if err := json.Unmarshal([]byte(`{"name": " Orders ", "dialect": {"delimiter": ";"}, "encoding": "latin1"}`), &f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultDialect
+	want.Delimiter = ';'
+	_, encoding, _ := LookupEncoding("latin1")
+	if f.Name != "Orders" || *f.Dialect != want || f.Encoding != encoding || f.Columns == nil {
+		t.Errorf("Normalize() = %+v, dialect %+v", f, *f.Dialect)
+	}
+}
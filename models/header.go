@@ -0,0 +1,164 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Number of records read from the start of a file when looking for the header row
+const layoutSampleRecords = 50
+
+// HeaderLayout says where the table starts in a file
+type HeaderLayout struct {
+	Offset    int  `json:"offset"` // lines before the header row, or before the first data row if there is no header
+	HasHeader bool `json:"has_header"`
+}
+
+var DefaultHeaderLayout = HeaderLayout{HasHeader: true}
+
+// DetectLayout looks for preamble lines and a header row in the first records of the file
+func (f File) DetectLayout() (HeaderLayout, error) {
+	f.File.Seek(0, io.SeekStart)
+	defer f.File.Seek(0, io.SeekStart)
+
+	reader := f.newRawCSVReader(f.File)
+	records := [][]string{}
+	lines := []int{}
+	for len(records) < layoutSampleRecords {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(records) == 0 {
+				return HeaderLayout{}, fmt.Errorf("error reading CSV file: %w", err)
+			}
+			break // work with the records before the broken one
+		}
+		line, _ := reader.FieldPos(0)
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+	return DetectLayout(records, lines, f.Profile), nil
+}
+
+// DetectLayout finds where the table starts among the first records of a file and whether
+// it begins with a header row. lines holds the line number each record starts on.
+//
+// The table starts at the first record that has the most common number of fields, at least two
+// of them filled in, and is followed by a record of the same width. Titles, report dates and
+// other preamble lines before it are skipped. The first row of the table is a header unless its
+// values look like the data below it: numbers above numbers, dates above dates and so on.
+func DetectLayout(records [][]string, lines []int, profile ParsingProfile) HeaderLayout {
+	if len(records) == 0 {
+		return DefaultHeaderLayout
+	}
+
+	widths := map[int]int{}
+	for _, record := range records {
+		widths[len(record)]++
+	}
+	width, widthFreq := 0, 0
+	for w, freq := range widths {
+		if freq > widthFreq || (freq == widthFreq && w > width) {
+			width, widthFreq = w, freq
+		}
+	}
+
+	minFilled := 2
+	if width < minFilled {
+		minFilled = width
+	}
+	start := 0
+	for i, record := range records {
+		if len(record) != width || filledFields(record) < minFilled {
+			continue
+		}
+		if i+1 < len(records) && len(records[i+1]) != width {
+			continue
+		}
+		start = i
+		break
+	}
+	layout := HeaderLayout{Offset: lines[start] - 1, HasHeader: true}
+
+	data := [][]string{}
+	for _, record := range records[start+1:] {
+		if len(record) == width {
+			data = append(data, record)
+		}
+	}
+	if len(data) == 0 {
+		return layout
+	}
+	layout.HasHeader = looksLikeHeader(records[start], data, profile)
+	return layout
+}
+
+// looksLikeHeader votes column by column on whether candidate is a header above data
+func looksLikeHeader(candidate []string, data [][]string, profile ParsingProfile) bool {
+	inferrer := NewTypeInferrer(DefaultTypeInferenceOptions, profile)
+	for _, record := range data {
+		inferrer.Add(record)
+	}
+	types := inferrer.Types()
+
+	votes := 0
+	seen := map[string]bool{}
+	for i, cell := range candidate {
+		cell = strings.TrimSpace(cell)
+		if cell == "" {
+			continue
+		}
+		if seen[cell] {
+			votes-- // headers are rarely repeated
+		}
+		seen[cell] = true
+		if i >= len(types) {
+			continue
+		}
+		if types[i].Type != TypeText {
+			if _, err := profile.Convert(types[i].Type, cell); err == nil {
+				votes--
+			} else {
+				votes++
+			}
+			continue
+		}
+		// Text columns of fixed width values, such as codes, under a header of a different length
+		length, fixed := -1, true
+		for _, record := range data {
+			if length == -1 {
+				length = len(record[i])
+			} else if len(record[i]) != length {
+				fixed = false
+				break
+			}
+		}
+		if fixed && len(data) > 1 && len(cell) != length {
+			votes++
+		}
+	}
+	// With no evidence either way, keep treating the first row as the header
+	return votes >= 0
+}
+
+func filledFields(record []string) int {
+	filled := 0
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			filled++
+		}
+	}
+	return filled
+}
+
+// ColumnNames returns generated names column_1, column_2, ... for files without a header row
+func ColumnNames(count int) []string {
+	names := make([]string, count)
+	for i := range names {
+		names[i] = fmt.Sprintf("column_%d", i+1)
+	}
+	return names
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectLayout(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		want HeaderLayout
+	}{
+		{
+			name: "Plain header",
+			csv:  "name,age\nJane,30\nJohn,40\n",
+			want: HeaderLayout{Offset: 0, HasHeader: true},
+		},
+		{
+			name: "Bank statement preamble",
+			csv:  "Account statement\nAccount:,12345678\n\nDate,Description,Amount\n2023-01-02,Coffee,-3.50\n2023-01-03,Salary,2500.00\n",
+			want: HeaderLayout{Offset: 3, HasHeader: true},
+		},
+		{
+			name: "Preamble padded with delimiters",
+			csv:  "Price list 2023,,\n,,\nsku,price,qty\nA1,1.5,2\nB2,3,4\n",
+			want: HeaderLayout{Offset: 2, HasHeader: true},
+		},
+		{
+			name: "No header",
+			csv:  "1,2023-01-02,3.5\n2,2023-01-03,4.5\n3,2023-01-04,5\n",
+			want: HeaderLayout{Offset: 0, HasHeader: false},
+		},
+		{
+			name: "Text only columns keep the header",
+			csv:  "first,last\nJane,Doe\nJohn,Smith\n",
+			want: HeaderLayout{Offset: 0, HasHeader: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := DefaultDialect.NewReader(strings.NewReader(tt.csv))
+			reader.FieldsPerRecord = -1
+			records, lines := [][]string{}, []int{}
+			for {
+				record, err := reader.Read()
+				if err != nil {
+					break
+				}
+				line, _ := reader.FieldPos(0)
+				records = append(records, record)
+				lines = append(lines, line)
+			}
+			if got := DetectLayout(records, lines, DefaultParsingProfile); got != tt.want {
+				t.Errorf("DetectLayout() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewReaderAfterLines(t *testing.T) {
+	reader := DefaultDialect.NewReaderAfterLines(strings.NewReader("Report\n\"multi\nline\"\nsku,qty\nA1,2\n"), 3)
+	record, err := reader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(record, "|") != "sku|qty" {
+		t.Errorf("Read() = %q, want header row", record)
+	}
+}
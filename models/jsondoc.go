@@ -0,0 +1,368 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// How arrays inside JSON records are loaded
+const (
+	ArraysText  = "text"  // the array's JSON in a single column
+	ArraysTable = "table" // one row per element in a child table
+)
+
+// ParentRowColumn of an array's child table holds the _id of the row the array was in.
+// Raw tables are loaded in order, so a row's _id is its position in the table.
+const ParentRowColumn = "parent_row"
+
+// JSONOptions controls how JSON records are flattened into columns
+type JSONOptions struct {
+	MaxDepth int    `json:"max_depth"` // levels of nested objects flattened into dotted columns, deeper objects are kept as JSON text
+	Arrays   string `json:"arrays"`
+}
+
+var DefaultJSONOptions = JSONOptions{MaxDepth: 3, Arrays: ArraysText}
+
+var ErrInvalidJSON = errors.New("invalid JSON")
+
+func (o JSONOptions) Validate() error {
+	if o.MaxDepth < 0 {
+		return fmt.Errorf("max_depth can't be negative")
+	}
+	if o.Arrays != ArraysText && o.Arrays != ArraysTable {
+		return fmt.Errorf("arrays must be %q or %q", ArraysText, ArraysTable)
+	}
+	return nil
+}
+
+// JSONTable is the flattened records of a JSON file, or the elements of the arrays found
+// at one path in them
+type JSONTable struct {
+	Path    string // dotted path of the arrays, empty for the records themselves
+	Headers []string
+	Rows    [][]Cell
+}
+
+// jsonObject keeps the members of a JSON object in the order they were written,
+// so columns come out in the file's order
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key   string
+	value interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, member := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := marshalJSON(member.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := marshalJSON(member.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(key)
+		buf.WriteByte(':')
+		buf.WriteString(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// marshalJSON encodes v without escaping HTML characters
+func marshalJSON(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// IsJSON reports whether a sample from the start of a file is a JSON document or
+// newline-delimited JSON. The sample may end in the middle of a value.
+func IsJSON(sample []byte) bool {
+	sample = bytes.TrimLeft(bytes.TrimPrefix(sample, []byte("\uFEFF")), " \t\r\n")
+	if len(sample) == 0 || (sample[0] != '{' && sample[0] != '[') {
+		return false
+	}
+	dec := json.NewDecoder(bytes.NewReader(sample))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// ReadJSON flattens the records of a JSON file into tables. A file is either an array of
+// records or a sequence of records, one per line in newline-delimited JSON. The records'
+// table comes first, followed by a table for each path of exploded arrays.
+func ReadJSON(r io.Reader, opts JSONOptions) ([]JSONTable, error) {
+	dec := json.NewDecoder(skipBOM(r))
+	dec.UseNumber()
+	invalid := func(err error) error {
+		return fmt.Errorf("%w at byte %d: %v", ErrInvalidJSON, dec.InputOffset(), err)
+	}
+
+	f := &jsonFlattener{opts: opts, byPath: map[string]*jsonTableBuilder{}}
+	f.table("")
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return f.result(), nil
+	}
+	if err != nil {
+		return nil, invalid(err)
+	}
+	if tok == json.Delim('[') {
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, invalid(err)
+			}
+			f.addRow("", 0, value)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, invalid(err)
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, invalid(fmt.Errorf("unexpected content after the array of records"))
+		}
+		return f.result(), nil
+	}
+	for {
+		value, err := decodeJSONToken(dec, tok)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		f.addRow("", 0, value)
+		tok, err = dec.Token()
+		if err == io.EOF {
+			return f.result(), nil
+		}
+		if err != nil {
+			return nil, invalid(err)
+		}
+	}
+}
+
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSONToken(dec, tok)
+}
+
+// decodeJSONToken decodes the value that starts with tok. Objects are decoded as
+// jsonObject, arrays as []interface{} and numbers as json.Number.
+func decodeJSONToken(dec *json.Decoder, tok json.Token) (interface{}, error) {
+	switch tok {
+	case json.Delim('{'):
+		object := jsonObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, jsonMember{key: key.(string), value: value})
+		}
+		_, err := dec.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err := dec.Token()
+		return array, err
+	}
+	return tok, nil
+}
+
+type jsonFlattener struct {
+	opts   JSONOptions
+	tables []*jsonTableBuilder // in the order their paths were first seen
+	byPath map[string]*jsonTableBuilder
+}
+
+type jsonTableBuilder struct {
+	path    string
+	headers []string
+	columns map[string]int
+	rows    [][]Cell
+}
+
+func (f *jsonFlattener) table(path string) *jsonTableBuilder {
+	t, ok := f.byPath[path]
+	if !ok {
+		t = &jsonTableBuilder{path: path, columns: map[string]int{}}
+		f.byPath[path] = t
+		f.tables = append(f.tables, t)
+	}
+	return t
+}
+
+func (t *jsonTableBuilder) column(header string) int {
+	i, ok := t.columns[header]
+	if !ok {
+		i = len(t.headers)
+		t.columns[header] = i
+		t.headers = append(t.headers, header)
+	}
+	return i
+}
+
+// addRow flattens a record, or an element of an exploded array, into a new row of the table at path
+func (f *jsonFlattener) addRow(path string, parentRow int, value interface{}) {
+	t := f.table(path)
+	rowNumber := len(t.rows) + 1
+	row := []Cell{}
+	set := func(header string, cell Cell) {
+		i := t.column(header)
+		for len(row) <= i {
+			row = append(row, Cell{})
+		}
+		row[i] = cell
+	}
+	if path != "" {
+		set(ParentRowColumn, Cell{Value: strconv.Itoa(parentRow), Type: TypeNumeric})
+	}
+	f.flatten(path, "", value, 0, rowNumber, set)
+	t.rows = append(t.rows, row)
+}
+
+// flatten sets the columns of a row from a value found at prefix in the row's record or element.
+// Values that aren't objects are stored in a column named "value".
+func (f *jsonFlattener) flatten(path, prefix string, value interface{}, depth, rowNumber int, set func(string, Cell)) {
+	header := prefix
+	if header == "" {
+		header = "value"
+	}
+	switch v := value.(type) {
+	case jsonObject:
+		if prefix != "" && (depth > f.opts.MaxDepth || len(v) == 0) {
+			set(header, jsonCell(v))
+			return
+		}
+		for _, member := range v {
+			key := member.key
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			f.flatten(path, key, member.value, depth+1, rowNumber, set)
+		}
+	case []interface{}:
+		if f.opts.Arrays != ArraysTable || prefix == "" {
+			set(header, jsonCell(v))
+			return
+		}
+		childPath := prefix
+		if path != "" {
+			childPath = path + "." + prefix
+		}
+		f.table(childPath)
+		for _, element := range v {
+			f.addRow(childPath, rowNumber, element)
+		}
+	default:
+		set(header, jsonCell(v))
+	}
+}
+
+func (f *jsonFlattener) result() []JSONTable {
+	tables := make([]JSONTable, len(f.tables))
+	for i, t := range f.tables {
+		for j, row := range t.rows {
+			for len(row) < len(t.headers) {
+				row = append(row, Cell{})
+			}
+			t.rows[j] = row
+		}
+		tables[i] = JSONTable{Path: t.path, Headers: t.headers, Rows: t.rows}
+	}
+	return tables
+}
+
+// jsonCell converts a JSON value to a cell typed by the value. Strings are dates or
+// timestamps if they're written as ISO dates, and objects and arrays are JSON text.
+func jsonCell(value interface{}) Cell {
+	switch v := value.(type) {
+	case nil:
+		return Cell{}
+	case bool:
+		return Cell{Value: strconv.FormatBool(v), Type: TypeBoolean}
+	case json.Number:
+		s := v.String()
+		// Postgres numerics can't be written with an exponent
+		if strings.ContainsAny(s, "eE") {
+			if f, err := v.Float64(); err == nil {
+				s = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+		}
+		return Cell{Value: s, Type: TypeNumeric}
+	case string:
+		if v == "" {
+			return Cell{}
+		}
+		for _, t := range []ColumnType{TypeDate, TypeTimestamp} {
+			if _, err := DefaultParsingProfile.Convert(t, v); err == nil {
+				return Cell{Value: v, Type: t}
+			}
+		}
+		return Cell{Value: v, Type: TypeText}
+	}
+	text, err := marshalJSON(value)
+	if err != nil {
+		return Cell{}
+	}
+	return Cell{Value: text, Type: TypeText}
+}
+
+// CompactJSON writes each value of a JSON file read from r to w without any BOM or insignificant
+// whitespace, one value to a line, so files that only differ in formatting have the same content
+func (f File) CompactJSON(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(skipBOM(r))
+	var compacted bytes.Buffer
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w at byte %d: %v", ErrInvalidJSON, dec.InputOffset(), err)
+		}
+		compacted.Reset()
+		if err := json.Compact(&compacted, raw); err != nil {
+			return err
+		}
+		compacted.WriteByte('\n')
+		if _, err := compacted.WriteTo(w); err != nil {
+			return err
+		}
+	}
+}
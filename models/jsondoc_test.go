@@ -0,0 +1,128 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsJSON(t *testing.T) {
+	tests := []struct {
+		sample string
+		want   bool
+	}{
+		{`[{"id": 1, "name": "Jane"}, {"id": 2, "na`, true},
+		{"\uFEFF{\"id\": 1}\n{\"id\": 2}\n", true},
+		{"  [\n  ]", true},
+		{"id,name\n1,Jane\n", false},
+		{"[id],[name]\n1,Jane\n", false},
+		{"{a},{b}\n", false},
+	}
+	for _, tt := range tests {
+		if got := IsJSON([]byte(tt.sample)); got != tt.want {
+			t.Errorf("IsJSON(%q) = %v, want %v", tt.sample, got, tt.want)
+		}
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	array := `[
+		{"id": 1, "name": "Jane", "address": {"city": "Oslo", "geo": {"lat": 59.9}}, "tags": ["a", "b"], "joined": "2023-01-02"},
+		{"id": 2, "active": true, "address": {}, "tags": [], "joined": null, "score": 1.5e3}
+	]`
+	ndjson := "{\"id\": 1, \"name\": \"Jane\", \"address\": {\"city\": \"Oslo\", \"geo\": {\"lat\": 59.9}}, \"tags\": [\"a\", \"b\"], \"joined\": \"2023-01-02\"}\n\n" +
+		"{\"id\": 2, \"active\": true, \"address\": {}, \"tags\": [], \"joined\": null, \"score\": 1.5e3}\n"
+	tests := []struct {
+		name string
+		opts JSONOptions
+		want []JSONTable
+	}{
+		{
+			name: "Arrays as text",
+			opts: JSONOptions{MaxDepth: 1, Arrays: ArraysText},
+			want: []JSONTable{{
+				Headers: []string{"id", "name", "address.city", "address.geo", "tags", "joined", "active", "address", "score"},
+				Rows: [][]Cell{
+					{{"1", TypeNumeric}, {"Jane", TypeText}, {"Oslo", TypeText}, {`{"lat":59.9}`, TypeText}, {`["a","b"]`, TypeText}, {"2023-01-02", TypeDate}, {}, {}, {}},
+					{{"2", TypeNumeric}, {}, {}, {}, {"[]", TypeText}, {}, {"true", TypeBoolean}, {"{}", TypeText}, {"1500", TypeNumeric}},
+				},
+			}},
+		},
+		{
+			name: "Arrays as child tables",
+			opts: JSONOptions{MaxDepth: 3, Arrays: ArraysTable},
+			want: []JSONTable{
+				{
+					Headers: []string{"id", "name", "address.city", "address.geo.lat", "joined", "active", "address", "score"},
+					Rows: [][]Cell{
+						{{"1", TypeNumeric}, {"Jane", TypeText}, {"Oslo", TypeText}, {"59.9", TypeNumeric}, {"2023-01-02", TypeDate}, {}, {}, {}},
+						{{"2", TypeNumeric}, {}, {}, {}, {}, {"true", TypeBoolean}, {"{}", TypeText}, {"1500", TypeNumeric}},
+					},
+				},
+				{
+					Path:    "tags",
+					Headers: []string{"parent_row", "value"},
+					Rows: [][]Cell{
+						{{"1", TypeNumeric}, {"a", TypeText}},
+						{{"1", TypeNumeric}, {"b", TypeText}},
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		for format, input := range map[string]string{"array": array, "ndjson": ndjson} {
+			t.Run(tt.name+" "+format, func(t *testing.T) {
+				got, err := ReadJSON(strings.NewReader(input), tt.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("ReadJSON() = %+v, want %+v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestReadJSONNestedArrays(t *testing.T) {
+	input := `{"order": 7, "lines": [{"sku": "A1", "serials": ["x", "y"]}, {"sku": "B2", "serials": ["z"]}]}`
+	got, err := ReadJSON(strings.NewReader(input), JSONOptions{MaxDepth: 3, Arrays: ArraysTable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, table := range got {
+		paths = append(paths, table.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"", "lines", "lines.serials"}) {
+		t.Fatalf("paths = %q", paths)
+	}
+	parents := []string{}
+	for _, row := range got[2].Rows {
+		parents = append(parents, row[0].Value)
+	}
+	if !reflect.DeepEqual(parents, []string{"1", "1", "2"}) {
+		t.Errorf("parent rows of lines.serials = %q, want the rows of lines", parents)
+	}
+}
+
+func TestReadJSONInvalid(t *testing.T) {
+	for _, input := range []string{`[{"id": 1},`, `[{"id": 1}] {"id": 2}`, "{\"id\": 1}\n{id: 2}\n"} {
+		if _, err := ReadJSON(strings.NewReader(input), DefaultJSONOptions); !errors.Is(err, ErrInvalidJSON) {
+			t.Errorf("ReadJSON(%q) error = %v, want ErrInvalidJSON", input, err)
+		}
+	}
+}
+
+func TestCompactJSON(t *testing.T) {
+	var got strings.Builder
+	err := File{}.CompactJSON(strings.NewReader("\uFEFF[\n  {\"a\": 1},\n  {\"b\": [1, 2]}\n]\n{\"c\": 3}\n"), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "[{\"a\":1},{\"b\":[1,2]}]\n{\"c\":3}\n" {
+		t.Errorf("CompactJSON() = %q", got.String())
+	}
+}
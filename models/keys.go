@@ -0,0 +1,301 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Buckets the keys of an upload are sorted into when they're reconciled against earlier
+// uploads of the same import format
+const (
+	KeysNew        = "new"        // not in any earlier upload
+	KeysOld        = "old"        // already in an earlier upload
+	KeysUnique     = "unique"     // in one row of the upload
+	KeysDuplicated = "duplicated" // in more than one row of the upload
+)
+
+var (
+	ErrNoKeyColumn      = errors.New("the upload has no key column")
+	ErrUnknownKeyColumn = errors.New("the upload has no such column")
+	ErrNoTable          = errors.New("the upload has no table of its own")
+	ErrUnknownBucket    = fmt.Errorf("bucket must be %q, %q, %q or %q", KeysNew, KeysOld, KeysUnique, KeysDuplicated)
+)
+
+// KeyCounts are the counts of an upload's distinct keys in each bucket. NULL keys aren't counted.
+type KeyCounts struct {
+	Column     string `json:"key_column"`
+	New        int64  `json:"key_count_new"`
+	Old        int64  `json:"key_count_old"`
+	Unique     int64  `json:"key_count_unique"`
+	Duplicated int64  `json:"key_count_dup"`
+}
+
+// KeyCount is a key of an upload and the number of rows it's in
+type KeyCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// keySource is a raw table and its key column
+type keySource struct {
+	table  string
+	column string
+}
+
+// SetKeyColumn makes a column of an upload's table its key, and reconciles the keys against
+// earlier uploads. The column is named by its name in the table or its header in the file.
+func SetKeyColumn(ctx context.Context, tx *Tx, uploadID int64, column string) (KeyCounts, error) {
+	// An upload linked to a duplicate has the duplicate's columns
+	query := `SELECT c.id FROM core_raw_table_columns c
+	JOIN core_raw_tables u ON c.raw_table_id = COALESCE(u.duplicate_of, u.id)
+	WHERE u.id = $1 AND (c.column_name = $2 OR c.original_header = $2)
+	ORDER BY c.column_name = $2 DESC, c.position
+	LIMIT 1`
+	var columnID int64
+	err := tx.QueryRowContext(ctx, query, uploadID, column).Scan(&columnID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return KeyCounts{}, fmt.Errorf("%w: %q", ErrUnknownKeyColumn, column)
+	}
+	if err != nil {
+		return KeyCounts{}, fmt.Errorf("error finding key column of upload %d: %w", uploadID, err)
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE core_raw_tables SET key_field_id = $2 WHERE id = $1", uploadID, columnID)
+	if err != nil {
+		return KeyCounts{}, fmt.Errorf("error saving key column of upload %d: %w", uploadID, err)
+	}
+	return ReconcileKeys(ctx, tx, uploadID)
+}
+
+// keySources returns the table and key column of an upload, and those of the earlier uploads of
+// its import format that have key columns. Uploads without a format have nothing to compare with.
+func keySources(ctx context.Context, tx *Tx, uploadID int64) (keySource, []keySource, error) {
+	query := `SELECT u.name, c.column_name, u.format_id
+	FROM core_raw_tables u
+	LEFT JOIN core_raw_table_columns c ON c.id = u.key_field_id
+	WHERE u.id = $1`
+	var table, column sql.NullString
+	var formatID sql.NullInt64
+	err := tx.QueryRowContext(ctx, query, uploadID).Scan(&table, &column, &formatID)
+	if err != nil {
+		return keySource{}, nil, fmt.Errorf("error reading upload %d: %w", uploadID, err)
+	}
+	if !table.Valid {
+		return keySource{}, nil, ErrNoTable
+	}
+	if !column.Valid {
+		return keySource{}, nil, ErrNoKeyColumn
+	}
+	current := keySource{table: table.String, column: column.String}
+	if !formatID.Valid {
+		return current, nil, nil
+	}
+
+	query = `SELECT u.name, c.column_name, u.deleted
+	FROM core_raw_tables u
+	JOIN core_raw_table_columns c ON c.id = u.key_field_id
+	WHERE u.format_id = $1 AND u.id < $2 AND u.name IS NOT NULL
+	ORDER BY u.name, c.column_name`
+	rows, err := tx.QueryContext(ctx, query, formatID.Int64, uploadID)
+	if err != nil {
+		return current, nil, fmt.Errorf("error reading earlier uploads of upload %d: %w", uploadID, err)
+	}
+	defer rows.Close()
+	var uploads []earlierUpload
+	for rows.Next() {
+		var upload earlierUpload
+		if err := rows.Scan(&upload.source.table, &upload.source.column, &upload.deleted); err != nil {
+			return current, nil, fmt.Errorf("error reading earlier uploads of upload %d: %w", uploadID, err)
+		}
+		uploads = append(uploads, upload)
+	}
+	return current, earlierKeySources(uploads), rows.Err()
+}
+
+// earlierUpload is the key source of an earlier upload of the same import format
+type earlierUpload struct {
+	source  keySource
+	deleted bool
+}
+
+// earlierKeySources are the distinct sources whose keys count as seen before, in order. The keys of
+// deleted uploads don't, though their tables are kept until they're purged, unless an upload that
+// isn't deleted is linked to the same table.
+func earlierKeySources(uploads []earlierUpload) []keySource {
+	sources := []keySource{}
+	seen := map[keySource]bool{}
+	for _, upload := range uploads {
+		if upload.deleted || seen[upload.source] {
+			continue
+		}
+		seen[upload.source] = true
+		sources = append(sources, upload.source)
+	}
+	return sources
+}
+
+// keysQuery returns the common table expressions keys, with each key of the current table and
+// its row count, and seen, with the distinct keys of the earlier tables. Keys are compared as text.
+// Rows without a key are counted under a NULL key, which inBucket leaves out of every bucket.
+func keysQuery(current keySource, earlier []keySource) string {
+	query := fmt.Sprintf(`WITH keys AS (
+		SELECT %s::text AS key, count(*) AS n FROM %s GROUP BY 1
+	), seen AS (`, pq.QuoteIdentifier(current.column), pq.QuoteIdentifier(current.table))
+	if len(earlier) == 0 {
+		return query + "SELECT NULL::text AS key WHERE false)"
+	}
+	selects := make([]string, len(earlier))
+	for i, source := range earlier {
+		selects[i] = fmt.Sprintf("SELECT %s::text AS key FROM %s", pq.QuoteIdentifier(source.column), pq.QuoteIdentifier(source.table))
+	}
+	return query + strings.Join(selects, " UNION ") + ")"
+}
+
+// keyGroup is the distinct keys of an upload that are alike in whether they're NULL, whether an
+// earlier upload has them and whether more than one row has them. keyGroupColumns are those of
+// keys k left joined to seen s.
+type keyGroup struct {
+	null, seen, repeated bool
+}
+
+const keyGroupColumns = "k.key IS NULL, s.key IS NOT NULL, k.n > 1"
+
+var keyGroups = []keyGroup{
+	{false, false, false}, {false, false, true}, {false, true, false}, {false, true, true},
+	{true, false, false}, {true, false, true},
+}
+
+// inBucket reports whether the keys of a group are in a bucket. NULL keys aren't in any.
+func inBucket(bucket string, g keyGroup) bool {
+	if g.null {
+		return false
+	}
+	switch bucket {
+	case KeysNew:
+		return !g.seen
+	case KeysOld:
+		return g.seen
+	case KeysUnique:
+		return !g.repeated
+	case KeysDuplicated:
+		return g.repeated
+	}
+	return false
+}
+
+// bucketCondition selects the keys of a bucket from keys k left joined to seen s
+func bucketCondition(bucket string) (string, bool) {
+	var groups []string
+	for _, g := range keyGroups {
+		if inBucket(bucket, g) {
+			groups = append(groups, fmt.Sprintf("(%t, %t, %t)", g.null, g.seen, g.repeated))
+		}
+	}
+	if len(groups) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("(%s) IN (%s)", keyGroupColumns, strings.Join(groups, ", ")), true
+}
+
+// countKeys adds up the distinct keys of each group into the counts of the buckets
+func countKeys(column string, groups map[keyGroup]int64) KeyCounts {
+	counts := KeyCounts{Column: column}
+	buckets := map[string]*int64{KeysNew: &counts.New, KeysOld: &counts.Old, KeysUnique: &counts.Unique, KeysDuplicated: &counts.Duplicated}
+	for g, n := range groups {
+		for bucket, count := range buckets {
+			if inBucket(bucket, g) {
+				*count += n
+			}
+		}
+	}
+	return counts
+}
+
+// ReconcileKeys counts the keys of an upload in each bucket and records the counts
+func ReconcileKeys(ctx context.Context, tx *Tx, uploadID int64) (KeyCounts, error) {
+	current, earlier, err := keySources(ctx, tx, uploadID)
+	if err != nil {
+		return KeyCounts{}, err
+	}
+	query := keysQuery(current, earlier) + fmt.Sprintf(`
+	SELECT %s, count(*) FROM keys k LEFT JOIN seen s ON s.key = k.key GROUP BY 1, 2, 3`, keyGroupColumns)
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return KeyCounts{}, fmt.Errorf("error counting keys of upload %d: %w", uploadID, err)
+	}
+	groups := map[keyGroup]int64{}
+	for rows.Next() {
+		var g keyGroup
+		var n int64
+		if err := rows.Scan(&g.null, &g.seen, &g.repeated, &n); err != nil {
+			rows.Close()
+			return KeyCounts{}, fmt.Errorf("error counting keys of upload %d: %w", uploadID, err)
+		}
+		groups[g] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return KeyCounts{}, fmt.Errorf("error counting keys of upload %d: %w", uploadID, err)
+	}
+	counts := countKeys(current.column, groups)
+
+	query = "UPDATE core_raw_tables SET key_count_new = $2, key_count_old = $3, key_count_unique = $4, key_count_dup = $5 WHERE id = $1"
+	_, err = tx.ExecContext(ctx, query, uploadID, counts.New, counts.Old, counts.Unique, counts.Duplicated)
+	if err != nil {
+		return KeyCounts{}, fmt.Errorf("error saving key counts of upload %d: %w", uploadID, err)
+	}
+	return counts, nil
+}
+
+// GetKeyCounts returns the key counts recorded for an upload, or nil if it has no key column
+func GetKeyCounts(ctx context.Context, tx *Tx, uploadID int64) (*KeyCounts, error) {
+	query := `SELECT c.column_name, u.key_count_new, u.key_count_old, u.key_count_unique, u.key_count_dup
+	FROM core_raw_tables u
+	JOIN core_raw_table_columns c ON c.id = u.key_field_id
+	WHERE u.id = $1 AND u.key_count_new IS NOT NULL`
+	var counts KeyCounts
+	err := tx.QueryRowContext(ctx, query, uploadID).Scan(&counts.Column, &counts.New, &counts.Old, &counts.Unique, &counts.Duplicated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading key counts of upload %d: %w", uploadID, err)
+	}
+	return &counts, nil
+}
+
+// ListKeys returns a page of the keys of an upload in a bucket, in key order
+func ListKeys(ctx context.Context, tx *Tx, uploadID int64, bucket string, limit, offset int) ([]KeyCount, error) {
+	condition, ok := bucketCondition(bucket)
+	if !ok {
+		return nil, ErrUnknownBucket
+	}
+	current, earlier, err := keySources(ctx, tx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	query := keysQuery(current, earlier) + fmt.Sprintf(`
+	SELECT k.key, k.n FROM keys k LEFT JOIN seen s ON s.key = k.key
+	WHERE %s
+	ORDER BY k.key
+	LIMIT $1 OFFSET $2`, condition)
+	rows, err := tx.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys of upload %d: %w", uploadID, err)
+	}
+	defer rows.Close()
+
+	keys := []KeyCount{}
+	for rows.Next() {
+		var key KeyCount
+		if err := rows.Scan(&key.Key, &key.Count); err != nil {
+			return nil, fmt.Errorf("error listing keys of upload %d: %w", uploadID, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
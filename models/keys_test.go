@@ -0,0 +1,125 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeysQuery(t *testing.T) {
+	current := keySource{table: "raw_table_3", column: "order_id"}
+	tests := []struct {
+		name    string
+		earlier []keySource
+		want    string
+	}{
+		{
+			name: "no earlier uploads",
+			want: `WITH keys AS (
+		SELECT "order_id"::text AS key, count(*) AS n FROM "raw_table_3" GROUP BY 1
+	), seen AS (SELECT NULL::text AS key WHERE false)`,
+		},
+		{
+			name:    "earlier uploads",
+			earlier: []keySource{{table: "raw_table_1", column: "order_id"}, {table: "raw_table_2", column: `order "id"`}},
+			want: `WITH keys AS (
+		SELECT "order_id"::text AS key, count(*) AS n FROM "raw_table_3" GROUP BY 1
+	), seen AS (SELECT "order_id"::text AS key FROM "raw_table_1" UNION SELECT "order ""id"""::text AS key FROM "raw_table_2")`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keysQuery(current, tt.earlier); got != tt.want {
+				t.Errorf("keysQuery() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInBucket(t *testing.T) {
+	tests := []struct {
+		name  string
+		group keyGroup
+		want  []string
+	}{
+		{"new and unique", keyGroup{seen: false, repeated: false}, []string{KeysNew, KeysUnique}},
+		{"new and duplicated", keyGroup{seen: false, repeated: true}, []string{KeysNew, KeysDuplicated}},
+		{"old and unique", keyGroup{seen: true, repeated: false}, []string{KeysOld, KeysUnique}},
+		{"old and duplicated", keyGroup{seen: true, repeated: true}, []string{KeysOld, KeysDuplicated}},
+		{"NULL in one row", keyGroup{null: true}, nil},
+		{"NULL in many rows", keyGroup{null: true, repeated: true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, bucket := range []string{KeysNew, KeysOld, KeysUnique, KeysDuplicated, "all"} {
+				if inBucket(bucket, tt.group) {
+					got = append(got, bucket)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("in buckets %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountKeys(t *testing.T) {
+	groups := map[keyGroup]int64{
+		{seen: false, repeated: false}: 5,
+		{seen: false, repeated: true}:  2,
+		{seen: true, repeated: false}:  3,
+		{seen: true, repeated: true}:   1,
+		{null: true, repeated: true}:   1, // rows without a key
+	}
+	want := KeyCounts{Column: "order_id", New: 7, Old: 4, Unique: 8, Duplicated: 3}
+	if got := countKeys("order_id", groups); got != want {
+		t.Errorf("countKeys() = %+v, want %+v", got, want)
+	}
+	if got := countKeys("order_id", nil); got != (KeyCounts{Column: "order_id"}) {
+		t.Errorf("countKeys() of no keys = %+v", got)
+	}
+}
+
+func TestBucketCondition(t *testing.T) {
+	tests := []struct {
+		bucket string
+		want   string
+		ok     bool
+	}{
+		{KeysNew, "(k.key IS NULL, s.key IS NOT NULL, k.n > 1) IN ((false, false, false), (false, false, true))", true},
+		{KeysDuplicated, "(k.key IS NULL, s.key IS NOT NULL, k.n > 1) IN ((false, false, true), (false, true, true))", true},
+		{"all", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bucket, func(t *testing.T) {
+			got, ok := bucketCondition(tt.bucket)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("bucketCondition() = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEarlierKeySources(t *testing.T) {
+	first := keySource{table: "raw_table_1", column: "order_id"}
+	second := keySource{table: "raw_table_2", column: "id"}
+	tests := []struct {
+		name    string
+		uploads []earlierUpload
+		want    []keySource
+	}{
+		{"none", nil, []keySource{}},
+		{"deleted upload", []earlierUpload{{first, true}, {second, false}}, []keySource{second}},
+		{"all deleted", []earlierUpload{{first, true}, {second, true}}, []keySource{}},
+		// An upload linked to a duplicate has the duplicate's table
+		{"deleted duplicate of a linked upload", []earlierUpload{{first, true}, {first, false}}, []keySource{first}},
+		{"linked upload", []earlierUpload{{first, false}, {first, false}, {second, false}}, []keySource{first, second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := earlierKeySources(tt.uploads); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("earlierKeySources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrFileNotFound = errors.New("file not found")
+	ErrNotDeleted   = errors.New("the file isn't deleted")
+	ErrUploadLinked = errors.New("other uploads are linked to the file's tables; purge them first")
+)
+
+// Purged is what purging an upload removed. MappedRows counts the rows it loaded into canonical
+// tables. File is the name of its stored file in the file store, for the caller to release once the
+// purge is committed. It's empty for uploads from before files were stored by content.
+type Purged struct {
+	ID         int64    `json:"id"`
+	Tables     []string `json:"tables"`
+	MappedRows int64    `json:"mapped_rows"`
+	File       string   `json:"file,omitempty"`
+}
+
+// Delete marks an upload deleted. It's left out of All and can be restored until it's purged.
+func (m UploadModel) Delete(ctx context.Context, id int64) error {
+	query := `UPDATE core_raw_tables SET deleted = true, deleted_at = COALESCE(deleted_at, now())
+	WHERE id = $1 AND parent_id IS NULL
+	RETURNING id`
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting upload %d: %w", id, err)
+	}
+	return nil
+}
+
+// Restore undoes the deletion of an upload that hasn't been purged
+func (m UploadModel) Restore(ctx context.Context, id int64) error {
+	var deleted bool
+	err := m.DB.QueryRowContext(ctx, "SELECT deleted FROM core_raw_tables WHERE id = $1 AND parent_id IS NULL", id).Scan(&deleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error reading upload %d: %w", id, err)
+	}
+	if !deleted {
+		return ErrNotDeleted
+	}
+	err = m.DB.QueryRowContext(ctx, "UPDATE core_raw_tables SET deleted = false, deleted_at = NULL WHERE id = $1 RETURNING id", id).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("error restoring upload %d: %w", id, err)
+	}
+	return nil
+}
+
+// Purge removes a deleted upload for good: the raw tables of it and its parts, the rows they loaded
+// into canonical tables, and its metadata, in one transaction. The stored file is left for the
+// caller to remove after the purge, as the filesystem can't be rolled back.
+func (m UploadModel) Purge(ctx context.Context, id int64) (Purged, error) {
+	tx, err := m.DB.BeginTx(ctx)
+	if err != nil {
+		return Purged{ID: id}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	purged, err := purgeUpload(ctx, tx, id)
+	if err != nil {
+		return purged, err
+	}
+	if err := tx.Commit(); err != nil {
+		return purged, fmt.Errorf("error committing purge of upload %d: %w", id, err)
+	}
+	return purged, nil
+}
+
+func purgeUpload(ctx context.Context, tx *Tx, id int64) (Purged, error) {
+	purged := Purged{ID: id, Tables: []string{}}
+	var deleted bool
+	var saved sql.NullString
+	query := "SELECT deleted, saved_filename FROM core_raw_tables WHERE id = $1 AND parent_id IS NULL FOR UPDATE"
+	err := tx.QueryRowContext(ctx, query, id).Scan(&deleted, &saved)
+	if errors.Is(err, sql.ErrNoRows) {
+		return purged, ErrFileNotFound
+	}
+	if err != nil {
+		return purged, fmt.Errorf("error reading upload %d: %w", id, err)
+	}
+
+	// The upload and the sheets, members and child tables under it, however deep
+	query = `WITH RECURSIVE tree AS (
+		SELECT id FROM core_raw_tables WHERE id = $1
+		UNION ALL
+		SELECT c.id FROM core_raw_tables c JOIN tree t ON c.parent_id = t.id
+	)
+	SELECT id FROM tree`
+	rows, err := tx.QueryContext(ctx, query, id)
+	if err != nil {
+		return purged, fmt.Errorf("error reading parts of upload %d: %w", id, err)
+	}
+	var tree []int64
+	for rows.Next() {
+		var part int64
+		if err := rows.Scan(&part); err != nil {
+			rows.Close()
+			return purged, fmt.Errorf("error reading parts of upload %d: %w", id, err)
+		}
+		tree = append(tree, part)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return purged, fmt.Errorf("error reading parts of upload %d: %w", id, err)
+	}
+
+	var links int
+	query = "SELECT count(*) FROM core_raw_tables WHERE duplicate_of = ANY($1) AND NOT (id = ANY($1))"
+	if err := tx.QueryRowContext(ctx, query, pq.Array(tree)).Scan(&links); err != nil {
+		return purged, fmt.Errorf("error reading links to upload %d: %w", id, err)
+	}
+	if err := checkPurge(deleted, links); err != nil {
+		return purged, err
+	}
+
+	// Links within the upload name the tables of what they link to, which are dropped with it
+	query = `SELECT name, dedup_name FROM core_raw_tables
+	WHERE id = ANY($1) AND duplicate_of IS NULL AND name IS NOT NULL`
+	rows, err = tx.QueryContext(ctx, query, pq.Array(tree))
+	if err != nil {
+		return purged, fmt.Errorf("error reading tables of upload %d: %w", id, err)
+	}
+	for rows.Next() {
+		var name string
+		var dedupName sql.NullString
+		if err := rows.Scan(&name, &dedupName); err != nil {
+			rows.Close()
+			return purged, fmt.Errorf("error reading tables of upload %d: %w", id, err)
+		}
+		purged.Tables = append(purged.Tables, name)
+		if dedupName.Valid {
+			purged.Tables = append(purged.Tables, dedupName.String)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return purged, fmt.Errorf("error reading tables of upload %d: %w", id, err)
+	}
+	for _, table := range purged.Tables {
+		if _, err := tx.ExecContext(ctx, "DROP TABLE IF EXISTS "+pq.QuoteIdentifier(table)); err != nil {
+			return purged, fmt.Errorf("error dropping table %s: %w", table, err)
+		}
+	}
+
+	// Canonical tables are shared by uploads, so only the rows the parts loaded are deleted. A table
+	// dropped by hand has no rows left to delete.
+	query = `SELECT DISTINCT mapped_table FROM core_raw_tables
+	WHERE id = ANY($1) AND mapped_table IS NOT NULL AND to_regclass(quote_ident(mapped_table)) IS NOT NULL`
+	rows, err = tx.QueryContext(ctx, query, pq.Array(tree))
+	if err != nil {
+		return purged, fmt.Errorf("error reading canonical tables of upload %d: %w", id, err)
+	}
+	var mapped []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return purged, fmt.Errorf("error reading canonical tables of upload %d: %w", id, err)
+		}
+		mapped = append(mapped, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return purged, fmt.Errorf("error reading canonical tables of upload %d: %w", id, err)
+	}
+	for _, table := range mapped {
+		result, err := tx.ExecContext(ctx, mappedRowsQuery(table), pq.Array(tree))
+		if err != nil {
+			return purged, fmt.Errorf("error deleting rows of upload %d from %s: %w", id, table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return purged, err
+		}
+		purged.MappedRows += n
+	}
+
+	// The parts, their columns, rejected rows, repairs and violations go with it
+	if _, err := tx.ExecContext(ctx, "DELETE FROM core_raw_tables WHERE id = $1", id); err != nil {
+		return purged, fmt.Errorf("error deleting upload %d: %w", id, err)
+	}
+
+	purged.File = purgedFile(saved)
+	return purged, nil
+}
+
+// checkPurge returns why an upload can't be purged, if it can't. links counts the uploads outside
+// it that are linked to it or its parts as duplicates. They read its tables, so they have to go first.
+func checkPurge(deleted bool, links int) error {
+	if !deleted {
+		return ErrNotDeleted
+	}
+	if links > 0 {
+		return ErrUploadLinked
+	}
+	return nil
+}
+
+// purgedFile is the stored file a purged upload leaves for the caller to release. Stored files are
+// counted by the uploads that refer to them when they're released, under the lock on their name.
+// Uploads from before files were stored by content were stored under their client's filename, so
+// their files are left alone rather than removed by a name the client chose.
+func purgedFile(saved sql.NullString) string {
+	if !saved.Valid {
+		return ""
+	}
+	return saved.String
+}
+
+// mappedRowsQuery deletes the rows of a canonical table loaded by the uploads in $1
+func mappedRowsQuery(table string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1)", pq.QuoteIdentifier(table), TargetUploadColumn)
+}
+
+// PurgeDeleted purges the uploads deleted before a time. Each is purged in a transaction of its own.
+func (m UploadModel) PurgeDeleted(ctx context.Context, before time.Time) ([]Purged, error) {
+	query := "SELECT id FROM core_raw_tables WHERE deleted AND parent_id IS NULL AND deleted_at < $1"
+	rows, err := m.DB.QueryWithContext(ctx, query, before)
+	if err != nil {
+		return nil, fmt.Errorf("error reading deleted uploads: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error reading deleted uploads: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading deleted uploads: %w", err)
+	}
+
+	return purgeNewestFirst(ids, func(id int64) (Purged, error) {
+		return m.Purge(ctx, id)
+	})
+}
+
+// purgeNewestFirst purges uploads newest first, so that uploads linked to a duplicate go before it,
+// as a link is always to an earlier upload. Uploads that can't be purged yet because of links from
+// uploads that aren't deleted are skipped. It stops at the first other error.
+func purgeNewestFirst(ids []int64, purge func(id int64) (Purged, error)) ([]Purged, error) {
+	ids = append([]int64(nil), ids...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	purged := []Purged{}
+	for _, id := range ids {
+		p, err := purge(id)
+		if errors.Is(err, ErrUploadLinked) {
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, p)
+	}
+	return purged, nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheckPurge(t *testing.T) {
+	tests := []struct {
+		name    string
+		deleted bool
+		links   int
+		want    error
+	}{
+		{"deleted", true, 0, nil},
+		{"not deleted", false, 0, ErrNotDeleted},
+		{"not deleted and linked", false, 2, ErrNotDeleted},
+		{"linked", true, 1, ErrUploadLinked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkPurge(tt.deleted, tt.links); !errors.Is(err, tt.want) {
+				t.Errorf("checkPurge() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgedFile(t *testing.T) {
+	stored := sql.NullString{String: "sha256/ab/ab12", Valid: true}
+	tests := []struct {
+		name  string
+		saved sql.NullString
+		want  string
+	}{
+		{"stored by content", stored, "sha256/ab/ab12"},
+		{"stored by name, from before files were stored by content", sql.NullString{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := purgedFile(tt.saved); got != tt.want {
+				t.Errorf("purgedFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeNewestFirst(t *testing.T) {
+	// 4 is linked to 1 and 3 to 2, and 5, which isn't deleted, to 2 as well
+	linkedTo := map[int64][]int64{1: {4}, 2: {3, 5}}
+	exists := map[int64]bool{1: true, 2: true, 3: true, 4: true, 5: true}
+	var order []int64
+	purge := func(id int64) (Purged, error) {
+		order = append(order, id)
+		for _, link := range linkedTo[id] {
+			if exists[link] {
+				return Purged{}, ErrUploadLinked
+			}
+		}
+		if id == 6 {
+			return Purged{}, errors.New("connection lost")
+		}
+		delete(exists, id)
+		return Purged{ID: id}, nil
+	}
+
+	purged, err := purgeNewestFirst([]int64{1, 2, 3, 4}, purge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{4, 3, 2, 1}; !reflect.DeepEqual(order, want) {
+		t.Errorf("purged in order %v, want %v", order, want)
+	}
+	if want := []Purged{{ID: 4}, {ID: 3}, {ID: 1}}; !reflect.DeepEqual(purged, want) {
+		t.Errorf("purgeNewestFirst() = %v, want %v, skipping 2", purged, want)
+	}
+
+	purged, err = purgeNewestFirst([]int64{6, 7, 8}, purge)
+	if err == nil || !reflect.DeepEqual(purged, []Purged{{ID: 8}, {ID: 7}}) {
+		t.Errorf("purgeNewestFirst() = %v, %v, want the uploads before the error and the error", purged, err)
+	}
+}
+
+func TestMappedRowsQuery(t *testing.T) {
+	want := `DELETE FROM "orders ""2023""" WHERE _upload_id = ANY($1)`
+	if got := mappedRowsQuery(`orders "2023"`); got != want {
+		t.Errorf("mappedRowsQuery() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,302 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Transforms applied to a source value, in the order they're listed, before it's cast
+const (
+	TransformTrim         = "trim"
+	TransformUpper        = "upper"
+	TransformLower        = "lower"
+	TransformRegexReplace = "regex_replace"
+)
+
+// Postgres limits identifiers to 63 bytes
+const maxTargetIdentifierBytes = 63
+
+// Columns every canonical table has besides the mapped ones
+const (
+	TargetIDColumn     = "_id"
+	TargetUploadColumn = "_upload_id" // the upload that produced the row
+)
+
+var (
+	ErrNoFormat            = errors.New("the upload has no import format")
+	ErrNoMapping           = errors.New("the import format has no mapping")
+	ErrUnknownSourceColumn = errors.New("the upload has no such column")
+	targetIdentifier       = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+	reservedTargetPrefixes = []string{"core_", "raw_table_", "pg_"}
+	reservedTargetColumns  = map[string]bool{TargetIDColumn: true, TargetUploadColumn: true}
+)
+
+// Transform is a change made to a value on its way into a canonical table
+type Transform struct {
+	Op          string `json:"op"`
+	Pattern     string `json:"pattern,omitempty"`     // regex_replace only. A Postgres regular expression.
+	Replacement string `json:"replacement,omitempty"` // regex_replace only. \1 refers to the first group.
+}
+
+// ColumnMapping fills a column of a canonical table from a column of the raw table
+type ColumnMapping struct {
+	Source     string      `json:"source,omitempty"` // header or column name in the raw table. The default fills the column if empty.
+	Target     string      `json:"target"`
+	Cast       ColumnType  `json:"cast,omitempty"`    // text if empty. Empty values are cast to NULL.
+	Default    *string     `json:"default,omitempty"` // used where the value is NULL, or the source column is missing
+	Transforms []Transform `json:"transforms,omitempty"`
+}
+
+// Mapping is how the raw tables of an import format are loaded into its canonical table
+type Mapping struct {
+	TargetTable string          `json:"target_table"`
+	Columns     []ColumnMapping `json:"columns"`
+}
+
+// MappingResult is what running a mapping for an upload loaded
+type MappingResult struct {
+	UploadID    int64    `json:"upload_id"`
+	TargetTable string   `json:"target_table"`
+	Rows        int64    `json:"rows"`
+	Defaulted   []string `json:"defaulted,omitempty"` // target columns whose source column the upload doesn't have
+}
+
+func validTargetIdentifier(name string) error {
+	if len(name) > maxTargetIdentifierBytes || !targetIdentifier.MatchString(name) {
+		return fmt.Errorf("%q must be lowercase letters, digits and underscores, starting with a letter or underscore, at most %d bytes", name, maxTargetIdentifierBytes)
+	}
+	return nil
+}
+
+// Validate checks that a mapping can be run. Regular expressions are checked with Go's syntax,
+// which Postgres mostly shares; one it can't compile fails when the mapping is run.
+func (m Mapping) Validate() error {
+	if err := validTargetIdentifier(m.TargetTable); err != nil {
+		return fmt.Errorf("target_table: %w", err)
+	}
+	for _, prefix := range reservedTargetPrefixes {
+		if strings.HasPrefix(m.TargetTable, prefix) {
+			return fmt.Errorf("target_table can't start with %q", prefix)
+		}
+	}
+	if len(m.Columns) == 0 {
+		return fmt.Errorf("columns are required")
+	}
+	targets := map[string]bool{}
+	for i, column := range m.Columns {
+		if err := validTargetIdentifier(column.Target); err != nil {
+			return fmt.Errorf("column %d target: %w", i+1, err)
+		}
+		if reservedTargetColumns[column.Target] {
+			return fmt.Errorf("column %d target can't be %s", i+1, column.Target)
+		}
+		if targets[column.Target] {
+			return fmt.Errorf("target %q is mapped twice", column.Target)
+		}
+		targets[column.Target] = true
+		if column.Source == "" && column.Default == nil {
+			return fmt.Errorf("target %q needs a source or a default", column.Target)
+		}
+		if !knownType(column.Cast) {
+			return fmt.Errorf("target %q has unknown cast %q", column.Target, column.Cast)
+		}
+		for _, t := range column.Transforms {
+			switch t.Op {
+			case TransformTrim, TransformUpper, TransformLower:
+			case TransformRegexReplace:
+				if _, err := regexp.Compile(t.Pattern); err != nil {
+					return fmt.Errorf("target %q: invalid pattern: %v", column.Target, err)
+				}
+			default:
+				return fmt.Errorf("target %q has unknown transform %q", column.Target, t.Op)
+			}
+		}
+	}
+	return nil
+}
+
+// targetType is the type of a target column in SQL
+func targetType(cast ColumnType) string {
+	if cast == "" || cast == TypeText {
+		return "text"
+	}
+	return string(cast)
+}
+
+// mappingQuery returns the statement that loads rawTable into the mapping's target table, and its
+// arguments. sources maps each target column to its column in the raw table, if it has one.
+// The upload ID is the first argument.
+func mappingQuery(m Mapping, rawTable string, sources map[string]string, uploadID int64) (string, []interface{}) {
+	args := []interface{}{uploadID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	targets := make([]string, 0, len(m.Columns)+1)
+	values := make([]string, 0, len(m.Columns)+1)
+	for _, column := range m.Columns {
+		targets = append(targets, pq.QuoteIdentifier(column.Target))
+		typ := targetType(column.Cast)
+
+		source, ok := sources[column.Target]
+		if !ok {
+			values = append(values, arg(*column.Default)+"::"+typ)
+			continue
+		}
+		value := pq.QuoteIdentifier(source) + "::text"
+		for _, t := range column.Transforms {
+			switch t.Op {
+			case TransformTrim:
+				value = "btrim(" + value + ")"
+			case TransformUpper:
+				value = "upper(" + value + ")"
+			case TransformLower:
+				value = "lower(" + value + ")"
+			case TransformRegexReplace:
+				value = fmt.Sprintf("regexp_replace(%s, %s, %s, 'g')", value, arg(t.Pattern), arg(t.Replacement))
+			}
+		}
+		if typ != "text" {
+			value = "NULLIF(" + value + ", '')::" + typ
+		}
+		if column.Default != nil {
+			value = fmt.Sprintf("COALESCE(%s, %s::%s)", value, arg(*column.Default), typ)
+		}
+		values = append(values, value)
+	}
+	targets = append(targets, TargetUploadColumn)
+	values = append(values, "$1")
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ORDER BY %s",
+		pq.QuoteIdentifier(m.TargetTable), strings.Join(targets, ", "), strings.Join(values, ", "), pq.QuoteIdentifier(rawTable), TargetIDColumn)
+	return query, args
+}
+
+// targetTableStatements create the mapping's target table if it doesn't exist, and add the mapped
+// columns to it if it does
+func targetTableStatements(m Mapping) []string {
+	table := pq.QuoteIdentifier(m.TargetTable)
+	definitions := []string{TargetIDColumn + " SERIAL PRIMARY KEY"}
+	additions := []string{}
+	for _, column := range m.Columns {
+		definition := pq.QuoteIdentifier(column.Target) + " " + targetType(column.Cast)
+		definitions = append(definitions, definition)
+		additions = append(additions, "ADD COLUMN IF NOT EXISTS "+definition)
+	}
+	definitions = append(definitions, TargetUploadColumn+" integer")
+	additions = append(additions, "ADD COLUMN IF NOT EXISTS "+TargetUploadColumn+" integer")
+	return []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table, strings.Join(definitions, ", ")),
+		fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(additions, ", ")),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)",
+			pq.QuoteIdentifier(truncateIdentifier(m.TargetTable, "_upload_id_idx")), table, TargetUploadColumn),
+	}
+}
+
+// truncateIdentifier appends suffix to name, shortening name so the two fit in an identifier
+func truncateIdentifier(name, suffix string) string {
+	if n := maxTargetIdentifierBytes - len(suffix); len(name) > n {
+		name = name[:n]
+	}
+	return name + suffix
+}
+
+// mappingSources finds the raw table column of each target column by header or column name
+func mappingSources(m Mapping, columns []Column) (map[string]string, []string, error) {
+	sources := map[string]string{}
+	var defaulted []string
+	for _, mapped := range m.Columns {
+		if mapped.Source == "" {
+			continue
+		}
+		found := ""
+		for _, column := range columns {
+			if column.Name == mapped.Source {
+				found = column.Name
+				break
+			}
+			if found == "" && column.Header == mapped.Source {
+				found = column.Name
+			}
+		}
+		switch {
+		case found != "":
+			sources[mapped.Target] = found
+		case mapped.Default != nil:
+			defaulted = append(defaulted, mapped.Target)
+		default:
+			return nil, nil, fmt.Errorf("%w: %q", ErrUnknownSourceColumn, mapped.Source)
+		}
+	}
+	return sources, defaulted, nil
+}
+
+// MapUpload loads an upload's raw table into the canonical table of its import format's mapping.
+// Rows the upload loaded before are replaced, so running it again doesn't duplicate them.
+func MapUpload(ctx context.Context, tx *Tx, uploadID int64) (MappingResult, error) {
+	result := MappingResult{UploadID: uploadID}
+	var table sql.NullString
+	var formatID sql.NullInt64
+	var rawTableID int64
+	query := "SELECT name, format_id, COALESCE(duplicate_of, id) FROM core_raw_tables WHERE id = $1"
+	err := tx.QueryRowContext(ctx, query, uploadID).Scan(&table, &formatID, &rawTableID)
+	if err != nil {
+		return result, fmt.Errorf("error reading upload %d: %w", uploadID, err)
+	}
+	if !table.Valid {
+		return result, ErrNoTable
+	}
+	if !formatID.Valid {
+		return result, ErrNoFormat
+	}
+	format, err := GetImportFormat(ctx, tx, formatID.Int64)
+	if err != nil {
+		return result, fmt.Errorf("error reading import format of upload %d: %w", uploadID, err)
+	}
+	if format.Mapping == nil {
+		return result, ErrNoMapping
+	}
+	m := *format.Mapping
+	result.TargetTable = m.TargetTable
+
+	columns, err := GetColumns(ctx, tx, rawTableID)
+	if err != nil {
+		return result, err
+	}
+	sources, defaulted, err := mappingSources(m, columns)
+	if err != nil {
+		return result, err
+	}
+	result.Defaulted = defaulted
+
+	for _, statement := range targetTableStatements(m) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return result, fmt.Errorf("error creating table %s: %w", m.TargetTable, err)
+		}
+	}
+	deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", pq.QuoteIdentifier(m.TargetTable), TargetUploadColumn)
+	if _, err := tx.ExecContext(ctx, deleteQuery, uploadID); err != nil {
+		return result, fmt.Errorf("error replacing rows of upload %d in %s: %w", uploadID, m.TargetTable, err)
+	}
+	insert, args := mappingQuery(m, table.String, sources, uploadID)
+	loaded, err := tx.ExecContext(ctx, insert, args...)
+	if err != nil {
+		return result, fmt.Errorf("error loading upload %d into %s: %w", uploadID, m.TargetTable, err)
+	}
+	result.Rows, err = loaded.RowsAffected()
+	if err != nil {
+		return result, err
+	}
+
+	query = "UPDATE core_raw_tables SET mapped_table = $2, mapped_row_count = $3, mapped_at = now() WHERE id = $1"
+	if _, err := tx.ExecContext(ctx, query, uploadID, m.TargetTable, result.Rows); err != nil {
+		return result, fmt.Errorf("error recording mapping of upload %d: %w", uploadID, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMappingValidate(t *testing.T) {
+	none := "n/a"
+	tests := []struct {
+		name    string
+		mapping Mapping
+		wantErr bool
+	}{
+		{"valid", Mapping{TargetTable: "customers", Columns: []ColumnMapping{{Source: "Name", Target: "name", Transforms: []Transform{{Op: TransformTrim}}}}}, false},
+		{"default only", Mapping{TargetTable: "customers", Columns: []ColumnMapping{{Target: "region", Default: &none}}}, false},
+		{"bad table", Mapping{TargetTable: "Customers", Columns: []ColumnMapping{{Source: "Name", Target: "name"}}}, true},
+		{"system table", Mapping{TargetTable: "core_raw_tables", Columns: []ColumnMapping{{Source: "Name", Target: "name"}}}, true},
+		{"no columns", Mapping{TargetTable: "customers"}, true},
+		{"reserved target", Mapping{TargetTable: "customers", Columns: []ColumnMapping{{Source: "ID", Target: "_upload_id"}}}, true},
+		{"target twice", Mapping{TargetTable: "customers", Columns: []ColumnMapping{{Source: "A", Target: "name"}, {Source: "B", Target: "name"}}}, true},
+		{"no source or default", Mapping{TargetTable: "customers", Columns: []ColumnMapping{{Target: "name"}}}, true},
+		{"unknown cast", Mapping{TargetTable: "customers", Columns: []ColumnMapping{{Source: "A", Target: "a", Cast: "money"}}}, true},
+		{"unknown transform", Mapping{TargetTable: "customers", Columns: []ColumnMapping{{Source: "A", Target: "a", Transforms: []Transform{{Op: "reverse"}}}}}, true},
+		{"bad pattern", Mapping{TargetTable: "customers", Columns: []ColumnMapping{{Source: "A", Target: "a", Transforms: []Transform{{Op: TransformRegexReplace, Pattern: "("}}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.mapping.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMappingQuery(t *testing.T) {
+	zero, unknown := "0", "unknown"
+	m := Mapping{TargetTable: "price_list", Columns: []ColumnMapping{
+		{Source: "SKU", Target: "sku", Transforms: []Transform{{Op: TransformTrim}, {Op: TransformUpper}}},
+		{Source: "Price", Target: "price", Cast: TypeNumeric, Default: &zero,
+			Transforms: []Transform{{Op: TransformRegexReplace, Pattern: `[^0-9.]`, Replacement: ""}}},
+		{Source: "Region", Target: "region", Default: &unknown},
+	}}
+	columns := []Column{{Name: "sku", Header: "SKU"}, {Name: "price_eur", Header: "Price"}}
+
+	sources, defaulted, err := mappingSources(m, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"region"}; !reflect.DeepEqual(defaulted, want) {
+		t.Errorf("mappingSources() defaulted = %v, want %v", defaulted, want)
+	}
+
+	query, args := mappingQuery(m, "raw_table_7", sources, 7)
+	wantQuery := `INSERT INTO "price_list" ("sku", "price", "region", _upload_id) SELECT upper(btrim("sku"::text)), ` +
+		`COALESCE(NULLIF(regexp_replace("price_eur"::text, $2, $3, 'g'), '')::numeric, $4::numeric), $5::text, $1 ` +
+		`FROM "raw_table_7" ORDER BY _id`
+	if query != wantQuery {
+		t.Errorf("mappingQuery() =\n%s\nwant\n%s", query, wantQuery)
+	}
+	if wantArgs := []interface{}{int64(7), `[^0-9.]`, "", "0", "unknown"}; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("mappingQuery() args = %v, want %v", args, wantArgs)
+	}
+
+	if _, _, err := mappingSources(Mapping{Columns: []ColumnMapping{{Source: "Missing", Target: "x"}}}, columns); err == nil {
+		t.Error("mappingSources() found a column the upload doesn't have")
+	}
+}
@@ -0,0 +1,338 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DateOrderYMD = "ymd" // ISO 8601 dates only
+	DateOrderDMY = "dmy" // 31/12/2023 as well as ISO dates
+	DateOrderMDY = "mdy" // 12/31/2023 as well as ISO dates
+)
+
+// ParsingProfile describes how numbers and dates are written in a file, so that
+// values such as 1.234,56 and 31/12/2023 can be recognised and loaded
+type ParsingProfile struct {
+	Name               string   `json:"name,omitempty"`
+	DecimalSeparator   string   `json:"decimal_separator"`
+	ThousandsSeparator string   `json:"thousands_separator"`
+	DateOrder          string   `json:"date_order"`
+	DateLayouts        []string `json:"date_layouts,omitempty"` // Go time layouts tried before the ones implied by DateOrder
+}
+
+var DefaultParsingProfile = ParsingProfiles["iso"]
+
+// Built in profiles that can be chosen by name
+var ParsingProfiles = map[string]ParsingProfile{
+	"iso":   {Name: "iso", DecimalSeparator: ".", DateOrder: DateOrderYMD},
+	"en-US": {Name: "en-US", DecimalSeparator: ".", ThousandsSeparator: ",", DateOrder: DateOrderMDY},
+	"en-GB": {Name: "en-GB", DecimalSeparator: ".", ThousandsSeparator: ",", DateOrder: DateOrderDMY},
+	"de-DE": {Name: "de-DE", DecimalSeparator: ",", ThousandsSeparator: ".", DateOrder: DateOrderDMY},
+	"de-CH": {Name: "de-CH", DecimalSeparator: ".", ThousandsSeparator: "'", DateOrder: DateOrderDMY},
+	"fr-FR": {Name: "fr-FR", DecimalSeparator: ",", ThousandsSeparator: " ", DateOrder: DateOrderDMY},
+}
+
+var (
+	integerRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)$`) // leading zeros are identifiers such as zip codes, not numbers
+	numericRe = regexp.MustCompile(`^-?((0|[1-9][0-9]*)(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+	groupRe   = regexp.MustCompile(`^[0-9]{3}$`)
+	uuidRe    = regexp.MustCompile(`^\{?[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\}?$`)
+)
+
+var booleanValues = map[string]bool{
+	"true": true, "t": true, "yes": true, "y": true,
+	"false": false, "f": false, "no": false, "n": false,
+}
+
+// Go's "2" and "1" accept one or two digit days and months
+var (
+	isoDateLayouts = []string{"2006-01-02", "2006/01/02", "20060102"}
+	dmyDateLayouts = []string{"2/1/2006", "2.1.2006", "2-1-2006", "2/1/06", "2.1.06", "2-1-06"}
+	mdyDateLayouts = []string{"1/2/2006", "1-2-2006", "1.2.2006", "1/2/06", "1-2-06"}
+	// Dates with month names are unambiguous whatever the date order
+	namedMonthDateLayouts = []string{"2-Jan-2006", "2-Jan-06", "2 Jan 2006", "2 January 2006", "Jan 2, 2006", "January 2, 2006", "2. January 2006"}
+	timeLayouts           = []string{" 15:04:05.999999999", "T15:04:05.999999999", " 15:04", "T15:04"}
+	timestampTZLayouts    = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z07", "2006-01-02 15:04:05.999999999 -0700", "2006-01-02T15:04:05.999999999-0700"}
+)
+
+// LookupParsingProfile returns a built in profile by name
+func LookupParsingProfile(name string) (ParsingProfile, error) {
+	for key, profile := range ParsingProfiles {
+		if strings.EqualFold(key, name) {
+			return profile, nil
+		}
+	}
+	return ParsingProfile{}, fmt.Errorf("unknown parsing profile %q", name)
+}
+
+// ParseParsingProfile reads a profile stored as JSON. Fields that are left out are taken
+// from the built in profile it names, or from DefaultParsingProfile.
+func ParseParsingProfile(data []byte) (ParsingProfile, error) {
+	var named struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil {
+		return ParsingProfile{}, err
+	}
+	profile := DefaultParsingProfile
+	if named.Name != "" {
+		if builtIn, err := LookupParsingProfile(named.Name); err == nil {
+			profile = builtIn
+		}
+	}
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return ParsingProfile{}, err
+	}
+	return profile, profile.Validate()
+}
+
+// Validate checks that the profile's separators don't clash and its date settings are usable
+func (p ParsingProfile) Validate() error {
+	if len([]rune(p.DecimalSeparator)) != 1 || strings.ContainsAny(p.DecimalSeparator, "0123456789+-") {
+		return fmt.Errorf("decimal separator must be a single character other than a digit or sign")
+	}
+	if len([]rune(p.ThousandsSeparator)) > 1 || strings.ContainsAny(p.ThousandsSeparator, "0123456789+-") {
+		return fmt.Errorf("thousands separator must be empty or a single character other than a digit or sign")
+	}
+	if p.ThousandsSeparator == p.DecimalSeparator {
+		return fmt.Errorf("thousands separator must be different from the decimal separator")
+	}
+	if p.DateOrder != "" && p.DateOrder != DateOrderYMD && p.DateOrder != DateOrderDMY && p.DateOrder != DateOrderMDY {
+		return fmt.Errorf("date order must be %q, %q or %q", DateOrderYMD, DateOrderDMY, DateOrderMDY)
+	}
+	for _, layout := range p.DateLayouts {
+		if !strings.ContainsAny(layout, "0126") {
+			return fmt.Errorf("date layout %q has no day, month or year", layout)
+		}
+	}
+	return nil
+}
+
+// profileLayouts are the layouts a profile reads dates and timestamps with. The built in ones are
+// grouped by their shape, so a value is only tried against the few with the same shape rather
+// than all of them. The profile's own layouts are always tried, first, as their shape can't be
+// worked out from formatting a time with them: "_2" pads with a space, for instance.
+type profileLayouts struct {
+	customDates, customTimestamps []string
+	dates, timestamps             map[string][]string
+}
+
+// layoutCache holds the profileLayouts of each combination of date order and date layouts
+var layoutCache sync.Map
+
+func (p ParsingProfile) layouts() *profileLayouts {
+	key := p.DateOrder + "\x00" + strings.Join(p.DateLayouts, "\x00")
+	if cached, ok := layoutCache.Load(key); ok {
+		return cached.(*profileLayouts)
+	}
+	builtIn := append([]string{}, isoDateLayouts...)
+	switch p.DateOrder {
+	case DateOrderDMY:
+		builtIn = append(builtIn, dmyDateLayouts...)
+	case DateOrderMDY:
+		builtIn = append(builtIn, mdyDateLayouts...)
+	}
+	builtIn = append(builtIn, namedMonthDateLayouts...)
+
+	l := &profileLayouts{
+		customDates: p.DateLayouts,
+		dates:       layoutsByShape(builtIn),
+	}
+	for _, date := range p.DateLayouts {
+		for _, t := range timeLayouts {
+			l.customTimestamps = append(l.customTimestamps, date+t)
+		}
+	}
+	var timestamps []string
+	for _, date := range builtIn {
+		for _, t := range timeLayouts {
+			timestamps = append(timestamps, date+t)
+		}
+	}
+	l.timestamps = layoutsByShape(timestamps)
+	cached, _ := layoutCache.LoadOrStore(key, l)
+	return cached.(*profileLayouts)
+}
+
+// layoutsByShape groups layouts by the shape of the times they format, in their order
+func layoutsByShape(layouts []string) map[string][]string {
+	reference := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC)
+	byShape := map[string][]string{}
+	for _, layout := range layouts {
+		shape := timeShape(reference.Format(layout))
+		byShape[shape] = append(byShape[shape], layout)
+	}
+	return byShape
+}
+
+// timeShape is value with each run of digits written as 0 and each run of letters as a, so
+// 31/12/2023 23:59 and 1/2/06 0:00 are both 0/0/0 0:0. A fraction of a second is left out, as
+// layouts read one whether or not it's there.
+func timeShape(value string) string {
+	shape := make([]byte, 0, len(value))
+	var last byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case '0' <= c && c <= '9':
+			c = '0'
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', c >= 0x80:
+			c = 'a'
+		}
+		if (c == '0' || c == 'a') && c == last {
+			continue
+		}
+		shape = append(shape, c)
+		last = c
+	}
+	s := string(shape)
+	for _, fraction := range []string{":0.0", ":0,0"} {
+		if strings.HasSuffix(s, fraction) {
+			return s[:len(s)-2]
+		}
+	}
+	return s
+}
+
+// normalizeNumber rewrites a number written with the profile's separators in the
+// form Postgres expects, e.g. 1.234,56 becomes 1234.56 for de-DE
+func (p ParsingProfile) normalizeNumber(value string) (string, bool) {
+	sign := ""
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		if value[0] == '-' {
+			sign = "-"
+		}
+		value = value[1:]
+	}
+	thousands := p.ThousandsSeparator
+	if thousands == " " {
+		// spaces used for grouping are often non-breaking
+		value = strings.NewReplacer("\u00a0", " ", "\u202f", " ").Replace(value)
+	}
+	intPart, fraction := value, ""
+	if i := strings.LastIndex(value, p.DecimalSeparator); i >= 0 {
+		intPart, fraction = value[:i], "."+value[i+len(p.DecimalSeparator):]
+	}
+	if thousands != "" && strings.Contains(intPart, thousands) {
+		groups := strings.Split(intPart, thousands)
+		if len(groups[0]) == 0 || len(groups[0]) > 3 {
+			return "", false
+		}
+		for _, group := range groups[1:] {
+			if !groupRe.MatchString(group) {
+				return "", false
+			}
+		}
+		intPart = strings.Join(groups, "")
+	}
+	normalized := sign + intPart + fraction
+	return normalized, numericRe.MatchString(normalized)
+}
+
+// Convert parses a CSV value into the form it is sent to COPY in.
+// Empty values of every type except text are NULL.
+func (p ParsingProfile) Convert(t ColumnType, value string) (interface{}, error) {
+	if t == TypeText || t == "" {
+		return value, nil
+	}
+	if p.DecimalSeparator == "" {
+		p = DefaultParsingProfile
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	switch t {
+	case TypeBoolean:
+		b, ok := booleanValues[strings.ToLower(value)]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a boolean", value)
+		}
+		return b, nil
+	case TypeInteger, TypeBigint:
+		normalized, ok := p.normalizeNumber(value)
+		if !ok || !integerRe.MatchString(normalized) {
+			return nil, fmt.Errorf("%q is not an integer", value)
+		}
+		bitSize := 64
+		if t == TypeInteger {
+			bitSize = 32
+		}
+		return strconv.ParseInt(normalized, 10, bitSize)
+	case TypeNumeric:
+		normalized, ok := p.normalizeNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return normalized, nil
+	case TypeDate:
+		l := p.layouts()
+		d, err := parseTime(value, l.customDates, l.dates)
+		if err != nil {
+			return nil, err
+		}
+		return d.Format("2006-01-02"), nil
+	case TypeTimestamp:
+		l := p.layouts()
+		ts, err := parseTime(value, l.customTimestamps, l.timestamps)
+		if err != nil {
+			ts, err = parseTime(value, l.customDates, l.dates)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ts.Format("2006-01-02 15:04:05.999999999"), nil
+	case TypeTimestampTZ:
+		ts, err := parseTime(value, timestampTZLayouts, nil)
+		if err != nil {
+			return nil, err
+		}
+		return ts.Format(time.RFC3339Nano), nil
+	case TypeUUID:
+		if !uuidRe.MatchString(value) {
+			return nil, fmt.Errorf("%q is not a UUID", value)
+		}
+		return strings.ToLower(strings.Trim(value, "{}")), nil
+	}
+	return nil, fmt.Errorf("unknown column type %q", t)
+}
+
+// ConvertRow converts the values of a row for the table's columns. The missing values of short
+// rows are NULL. A value that doesn't fit its column's type rejects the row, so that its text is
+// kept with the rejected rows rather than loaded as NULL.
+func (p ParsingProfile) ConvertRow(columns []Column, row Row) ([]interface{}, *RowError) {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		if column.Index >= len(row.Values) {
+			continue
+		}
+		value, err := p.Convert(column.Type, row.Values[column.Index])
+		if err != nil {
+			return nil, &RowError{Line: row.Line, Raw: row.Raw, Message: fmt.Sprintf("column %s: %v", column.Name, err), Column: column.Name}
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// parseTime reads value with the first of layouts that fits, or else the first of the layouts
+// of its shape that fits
+func parseTime(value string, layouts []string, byShape map[string][]string) (time.Time, error) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range byShape[timeShape(value)] {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a recognised date or time", value)
+}
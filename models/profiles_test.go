@@ -0,0 +1,131 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsingProfileConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		typ     ColumnType
+		value   string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "German decimal", profile: "de-DE", typ: TypeNumeric, value: "1.234,56", want: "1234.56"},
+		{name: "German integer", profile: "de-DE", typ: TypeInteger, value: "-1.234", want: int64(-1234)},
+		{name: "Bad grouping", profile: "de-DE", typ: TypeNumeric, value: "1.23,4", wantErr: true},
+		{name: "US thousands", profile: "en-US", typ: TypeNumeric, value: "1,234.5", want: "1234.5"},
+		{name: "French non-breaking space", profile: "fr-FR", typ: TypeNumeric, value: "1 234,5", want: "1234.5"},
+		{name: "ISO rejects separators", profile: "iso", typ: TypeNumeric, value: "1,234.5", wantErr: true},
+		{name: "Day first", profile: "en-GB", typ: TypeDate, value: "31/12/2023", want: "2023-12-31"},
+		{name: "Month first", profile: "en-US", typ: TypeDate, value: "12/31/2023", want: "2023-12-31"},
+		{name: "Month first rejects day first", profile: "en-US", typ: TypeDate, value: "31/12/2023", wantErr: true},
+		{name: "Month name", profile: "en-GB", typ: TypeDate, value: "12-Jan-23", want: "2023-01-12"},
+		{name: "Day first timestamp", profile: "de-DE", typ: TypeTimestamp, value: "31.12.2023 23:59", want: "2023-12-31 23:59:00"},
+		{name: "Timestamp with fraction", profile: "iso", typ: TypeTimestamp, value: "2023-12-31T23:59:58.25", want: "2023-12-31 23:59:58.25"},
+		{name: "Timestamp of a date", profile: "iso", typ: TypeTimestamp, value: "2023-12-31", want: "2023-12-31 00:00:00"},
+		{name: "Named month timestamp", profile: "en-US", typ: TypeTimestamp, value: "January 2, 2023 7:05", want: "2023-01-02 07:05:00"},
+		{name: "Impossible date", profile: "iso", typ: TypeDate, value: "2023-02-30", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := LookupParsingProfile(tt.profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := profile.Convert(tt.typ, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Convert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Convert() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParsingProfile(t *testing.T) {
+	profile, err := ParseParsingProfile([]byte(`{"name": "de-DE", "date_layouts": ["02.01.2006"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.DecimalSeparator != "," || profile.DateOrder != DateOrderDMY || len(profile.DateLayouts) != 1 {
+		t.Errorf("ParseParsingProfile() = %+v", profile)
+	}
+	if _, err := ParseParsingProfile([]byte(`{"decimal_separator": ".", "thousands_separator": "."}`)); err == nil {
+		t.Errorf("ParseParsingProfile() accepted matching separators")
+	}
+}
+
+func TestTimeShape(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"31/12/2023", "0/0/0"},
+		{"1/2/06 0:00", "0/0/0 0:0"},
+		{"2023-12-31T23:59:58.123456", "0-0-0a0:0:0"},
+		{"2023-12-31 23:59:58,5", "0-0-0 0:0:0"},
+		{"12-Jan-23", "0-a-0"},
+		{"2. Januar 2023", "0. a 0"},
+	}
+	for _, tt := range tests {
+		if got := timeShape(tt.value); got != tt.want {
+			t.Errorf("timeShape(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParsingProfileCustomLayouts(t *testing.T) {
+	// A space padded day has no shape of its own, so custom layouts are tried before any shape
+	profile := DefaultParsingProfile
+	profile.DateLayouts = []string{"Jan _2 2006"}
+	got, err := profile.Convert(TypeDate, "Feb  3 2023")
+	if err != nil || got != "2023-02-03" {
+		t.Errorf("Convert() = %v, %v, want 2023-02-03", got, err)
+	}
+}
+
+func TestConvertRow(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Index: 0, Type: TypeInteger},
+		{Name: "placed", Index: 2, Type: TypeDate},
+	}
+	profile := ParsingProfiles["en-GB"]
+	tests := []struct {
+		name    string
+		row     Row
+		want    []interface{}
+		wantErr *RowError
+	}{
+		{
+			name: "converted",
+			row:  Row{Line: 2, Values: []string{"7", "skipped", "31/12/2023"}, Raw: "7,skipped,31/12/2023"},
+			want: []interface{}{int64(7), "2023-12-31"},
+		},
+		{
+			name: "short row",
+			row:  Row{Line: 3, Values: []string{"8"}, Raw: "8"},
+			want: []interface{}{int64(8), nil},
+		},
+		{
+			name:    "value that doesn't fit is rejected with its text",
+			row:     Row{Line: 4, Values: []string{"9", "", "soon"}, Raw: "9,,soon"},
+			wantErr: &RowError{Line: 4, Raw: "9,,soon", Message: `column placed: "soon" is not a recognised date or time`, Column: "placed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rowErr := profile.ConvertRow(columns, tt.row)
+			if !reflect.DeepEqual(rowErr, tt.wantErr) {
+				t.Fatalf("ConvertRow() error = %+v, want %+v", rowErr, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ConvertRow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
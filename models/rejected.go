@@ -0,0 +1,79 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+// InsertRejectedRows records the rows of an upload that weren't loaded into its raw table
+func InsertRejectedRows(ctx context.Context, tx *Tx, uploadID int64, rows []RowError) error {
+	query := `INSERT INTO core_raw_table_rejected_rows (raw_table_id, line_number, raw_text, error_message)
+	VALUES ($1, $2, $3, $4)`
+	for _, row := range rows {
+		_, err := tx.ExecContext(ctx, query, uploadID, row.Line, row.Raw, row.Message)
+		if err != nil {
+			return fmt.Errorf("error saving rejected row at line %d: %w", row.Line, err)
+		}
+	}
+	return nil
+}
+
+// RejectedRows returns the rows an upload rejected in file order, or for an upload linked to
+// a duplicate, the rows the duplicate rejected
+func (m UploadModel) RejectedRows(ctx context.Context, id int) ([]RowError, error) {
+	query := `SELECT line_number, raw_text, error_message
+	FROM core_raw_table_rejected_rows
+	WHERE raw_table_id = (SELECT COALESCE(duplicate_of, id) FROM core_raw_tables WHERE id = $1)
+	ORDER BY line_number, id`
+	rows, err := m.DB.QueryWithContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rejected rows of upload %d: %w", id, err)
+	}
+	defer rows.Close()
+
+	rejected := []RowError{}
+	for rows.Next() {
+		var row RowError
+		if err := rows.Scan(&row.Line, &row.Raw, &row.Message); err != nil {
+			return nil, fmt.Errorf("error reading rejected rows of upload %d: %w", id, err)
+		}
+		rejected = append(rejected, row)
+	}
+	return rejected, rows.Err()
+}
+
+// InsertRepairs records the repairs made to an upload's rows in recovery mode
+func InsertRepairs(ctx context.Context, tx *Tx, uploadID int64, repairs []Repair) error {
+	query := `INSERT INTO core_raw_table_repairs (raw_table_id, line_number, raw_text, action)
+	VALUES ($1, $2, $3, $4)`
+	for _, repair := range repairs {
+		_, err := tx.ExecContext(ctx, query, uploadID, repair.Line, repair.Raw, repair.Action)
+		if err != nil {
+			return fmt.Errorf("error saving repair at line %d: %w", repair.Line, err)
+		}
+	}
+	return nil
+}
+
+// GetRepairs returns the repairs made to an upload's rows in file order
+func GetRepairs(ctx context.Context, tx *Tx, uploadID int64) ([]Repair, error) {
+	query := `SELECT line_number, raw_text, action
+	FROM core_raw_table_repairs
+	WHERE raw_table_id = $1
+	ORDER BY line_number, id`
+	rows, err := tx.QueryContext(ctx, query, uploadID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading repairs of upload %d: %w", uploadID, err)
+	}
+	defer rows.Close()
+
+	repairs := []Repair{}
+	for rows.Next() {
+		var repair Repair
+		if err := rows.Scan(&repair.Line, &repair.Raw, &repair.Action); err != nil {
+			return nil, fmt.Errorf("error reading repairs of upload %d: %w", uploadID, err)
+		}
+		repairs = append(repairs, repair)
+	}
+	return repairs, rows.Err()
+}
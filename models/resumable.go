@@ -0,0 +1,331 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidUpload    = errors.New("invalid upload")
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrUploadBusy       = errors.New("another chunk of the upload is being written")
+	ErrOffsetMismatch   = errors.New("offset doesn't match the upload")
+	ErrUploadTooLarge   = errors.New("chunk goes past the declared size of the upload")
+	ErrUploadIncomplete = errors.New("upload is incomplete")
+)
+
+var uploadIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// ResumableUpload is a file being uploaded in chunks that can be resumed after a disconnect
+type ResumableUpload struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size,omitempty"`   // declared total size, 0 if it wasn't declared
+	SHA256    string    `json:"sha256,omitempty"` // declared checksum of the whole file
+	Offset    int64     `json:"offset"`           // bytes received so far
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ResumableStore keeps resumable uploads in a directory, each as the data received so far
+// and a JSON file describing it. Uploads that go without a chunk for the TTL expire.
+type ResumableStore struct {
+	dir string
+	ttl time.Duration
+	mu  sync.Mutex // guards the metadata files and locks
+	// The write locks of uploads that exist. An upload is only removed while its lock is held.
+	locks map[string]*sync.Mutex
+}
+
+func NewResumableStore(dir string, ttl time.Duration) (*ResumableStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating upload directory: %w", err)
+	}
+	return &ResumableStore{dir: dir, ttl: ttl, locks: map[string]*sync.Mutex{}}, nil
+}
+
+func (s *ResumableStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".part")
+}
+
+func (s *ResumableStore) metaPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Create starts an upload. size and sha256 may be left empty if they aren't known up front.
+func (s *ResumableStore) Create(filename string, size int64, sha256 string) (ResumableUpload, error) {
+	if size < 0 {
+		return ResumableUpload{}, fmt.Errorf("%w: size can't be negative", ErrInvalidUpload)
+	}
+	if sha256 != "" && !sha256Re.MatchString(sha256) {
+		return ResumableUpload{}, fmt.Errorf("%w: sha256 must be 64 hexadecimal digits", ErrInvalidUpload)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ResumableUpload{}, err
+	}
+	now := time.Now()
+	upload := ResumableUpload{
+		ID:        hex.EncodeToString(b),
+		Filename:  filepath.Base(filename),
+		Size:      size,
+		SHA256:    strings.ToLower(sha256),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	data, err := os.OpenFile(s.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return ResumableUpload{}, fmt.Errorf("error creating upload: %w", err)
+	}
+	data.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(upload); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return ResumableUpload{}, err
+	}
+	return upload, nil
+}
+
+var sha256Re = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// save writes the upload's metadata, replacing it in one step so it's never read half written
+func (s *ResumableStore) save(upload ResumableUpload) error {
+	upload.Offset = 0 // the size of the data file is the offset
+	meta, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := s.metaPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, meta, 0644); err != nil {
+		return fmt.Errorf("error saving upload: %w", err)
+	}
+	return os.Rename(tmp, s.metaPath(upload.ID))
+}
+
+// Get returns an upload that hasn't expired
+func (s *ResumableStore) Get(id string) (ResumableUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(id)
+}
+
+func (s *ResumableStore) get(id string) (ResumableUpload, error) {
+	if !uploadIDRe.MatchString(id) {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+	meta, err := os.ReadFile(s.metaPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return ResumableUpload{}, fmt.Errorf("error reading upload: %w", err)
+	}
+	var upload ResumableUpload
+	if err := json.Unmarshal(meta, &upload); err != nil {
+		return ResumableUpload{}, fmt.Errorf("error reading upload: %w", err)
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+	info, err := os.Stat(s.dataPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ResumableUpload{}, ErrUploadNotFound
+	}
+	if err != nil {
+		return ResumableUpload{}, fmt.Errorf("error reading upload: %w", err)
+	}
+	upload.Offset = info.Size()
+	return upload, nil
+}
+
+// lock takes the write lock of an upload that exists, or returns ErrUploadBusy if a chunk is
+// already being written
+func (s *ResumableStore) lock(id string) (*sync.Mutex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.get(id); err != nil {
+		return nil, err
+	}
+	l, ok := s.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	if !l.TryLock() {
+		return nil, ErrUploadBusy
+	}
+	return l, nil
+}
+
+// remove removes an upload unless its lock is held, and reports whether it did. s.mu must be held.
+func (s *ResumableStore) remove(id string) bool {
+	l, ok := s.locks[id]
+	if ok && !l.TryLock() {
+		return false
+	}
+	os.Remove(s.metaPath(id))
+	os.Remove(s.dataPath(id))
+	delete(s.locks, id)
+	if ok {
+		l.Unlock()
+	}
+	return true
+}
+
+// Append writes a chunk read from r at offset, which must be where the upload has got to.
+// Whatever arrives before r fails is kept, so the client can resume from the new offset.
+func (s *ResumableStore) Append(id string, offset int64, r io.Reader) (ResumableUpload, error) {
+	l, err := s.lock(id)
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+	defer l.Unlock()
+
+	upload, err := s.Get(id)
+	if err != nil {
+		return ResumableUpload{}, err
+	}
+	if offset != upload.Offset {
+		return upload, fmt.Errorf("%w: the upload is at %d, not %d", ErrOffsetMismatch, upload.Offset, offset)
+	}
+	data, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return upload, fmt.Errorf("error opening upload: %w", err)
+	}
+	defer data.Close()
+
+	if upload.Size > 0 {
+		r = io.LimitReader(r, upload.Size-upload.Offset+1)
+	}
+	n, copyErr := io.Copy(data, r)
+	if upload.Size > 0 && upload.Offset+n > upload.Size {
+		// Keep what fits
+		if err := data.Truncate(upload.Size); err != nil {
+			return upload, fmt.Errorf("error truncating upload: %w", err)
+		}
+		n = upload.Size - upload.Offset
+		copyErr = fmt.Errorf("%w of %d bytes", ErrUploadTooLarge, upload.Size)
+	}
+	upload.Offset += n
+
+	s.mu.Lock()
+	upload.ExpiresAt = time.Now().Add(s.ttl)
+	err = s.save(upload)
+	s.mu.Unlock()
+	if copyErr != nil {
+		return upload, copyErr
+	}
+	return upload, err
+}
+
+// Open returns the complete file of an upload, hashed like a spooled upload. The upload stays
+// locked until Finish, so no chunk can be added to what was hashed while it's being imported.
+func (s *ResumableStore) Open(id string) (File, error) {
+	l, err := s.lock(id)
+	if err != nil {
+		return File{}, err
+	}
+	f, err := s.open(id)
+	if err != nil {
+		l.Unlock()
+		return File{}, err
+	}
+	return f, nil
+}
+
+func (s *ResumableStore) open(id string) (File, error) {
+	upload, err := s.Get(id)
+	if err != nil {
+		return File{}, err
+	}
+	if upload.Size > 0 && upload.Offset != upload.Size {
+		return File{}, fmt.Errorf("%w: %d of %d bytes received", ErrUploadIncomplete, upload.Offset, upload.Size)
+	}
+	data, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return File{}, fmt.Errorf("error opening upload: %w", err)
+	}
+	hasher := newContentHasher()
+	if _, err := io.Copy(hasher, data); err != nil {
+		data.Close()
+		return File{}, fmt.Errorf("error hashing upload: %w", err)
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		data.Close()
+		return File{}, err
+	}
+	f := File{File: data, Header: &multipart.FileHeader{Filename: upload.Filename, Size: upload.Offset}}
+	f.Hash, f.HashNoBOM = hasher.sums()
+	return f, nil
+}
+
+// Finish closes the file Open returned and unlocks the upload. An upload that's been imported
+// is deleted. One that hasn't stays in the store, so it can be imported again.
+func (s *ResumableStore) Finish(id string, f File, imported bool) error {
+	err := f.File.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.locks[id]
+	if imported {
+		os.Remove(s.metaPath(id))
+		os.Remove(s.dataPath(id))
+		delete(s.locks, id)
+	}
+	l.Unlock()
+	return err
+}
+
+// Delete removes an upload and whatever of its data is still in the store, unless a chunk of it
+// is being written
+func (s *ResumableStore) Delete(id string) error {
+	if !uploadIDRe.MatchString(id) {
+		return ErrUploadNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.metaPath(id)); errors.Is(err, os.ErrNotExist) {
+		return ErrUploadNotFound
+	}
+	if !s.remove(id) {
+		return ErrUploadBusy
+	}
+	return nil
+}
+
+// Expire deletes the uploads that have gone without a chunk for longer than the TTL,
+// and returns how many there were. Uploads with a chunk being written are left for next time.
+func (s *ResumableStore) Expire(now time.Time) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, path := range paths {
+		id := strings.TrimSuffix(filepath.Base(path), ".json")
+		s.mu.Lock()
+		var upload ResumableUpload
+		meta, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(meta, &upload)
+		}
+		// Unreadable metadata can't be resumed either
+		if (err != nil || now.After(upload.ExpiresAt)) && s.remove(id) {
+			expired++
+		}
+		s.mu.Unlock()
+	}
+	return expired, nil
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumableStore(t *testing.T) {
+	content := "id,name\n1,Jane\n2,John\n"
+	sum := sha256.Sum256([]byte(content))
+	store, err := NewResumableStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := store.Create("../people.csv", int64(len(content)), hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.Filename != "people.csv" || upload.Offset != 0 {
+		t.Errorf("Create() = %+v", upload)
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		chunk  string
+		want   int64
+		err    error
+	}{
+		{"first chunk", 0, content[:10], 10, nil},
+		{"resent chunk", 0, content[:10], 10, ErrOffsetMismatch},
+		{"gap", 12, content[12:], 10, ErrOffsetMismatch},
+		{"too long", 10, content[10:] + "3,Joe\n", int64(len(content)), ErrUploadTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := store.Append(upload.ID, tt.offset, strings.NewReader(tt.chunk))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Append() error = %v, want %v", err, tt.err)
+			}
+			if got.Offset != tt.want {
+				t.Errorf("Append() offset = %d, want %d", got.Offset, tt.want)
+			}
+		})
+	}
+
+	f, err := store.Open(upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, _ := io.ReadAll(f.File)
+	if string(received) != content || f.Hash != upload.SHA256 || f.Header.Filename != "people.csv" {
+		t.Errorf("Open() = %q, hash %s", received, f.Hash)
+	}
+	// Nothing can be added to what was hashed until the import is finished
+	if _, err := store.Append(upload.ID, int64(len(content)), strings.NewReader("3,Joe\n")); !errors.Is(err, ErrUploadBusy) {
+		t.Errorf("Append() while open error = %v, want %v", err, ErrUploadBusy)
+	}
+	if err := store.Delete(upload.ID); !errors.Is(err, ErrUploadBusy) {
+		t.Errorf("Delete() while open error = %v, want %v", err, ErrUploadBusy)
+	}
+	if err := store.Finish(upload.ID, f, false); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = store.Open(upload.ID); err != nil {
+		t.Fatalf("Open() after an import that failed error = %v", err)
+	}
+	if err := store.Finish(upload.ID, f, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(upload.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(upload.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("Get() after Delete() error = %v", err)
+	}
+}
+
+func TestResumableStoreFinishImported(t *testing.T) {
+	store, err := NewResumableStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, _ := store.Create("people.csv", 0, "")
+	f, err := store.Open(upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Finish(upload.ID, f, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(upload.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("Get() of an imported upload error = %v", err)
+	}
+	if len(store.locks) != 0 {
+		t.Errorf("locks after Finish() = %d, want 0", len(store.locks))
+	}
+}
+
+func TestResumableStoreExpire(t *testing.T) {
+	store, err := NewResumableStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := store.Create("stale.csv", 0, "")
+	if f, err := store.Open(stale.ID); err != nil {
+		t.Errorf("Open() of an upload without a declared size error = %v", err)
+	} else {
+		store.Finish(stale.ID, f, false)
+	}
+	incomplete, _ := store.Create("incomplete.csv", 100, "")
+	if _, err := store.Open(incomplete.ID); !errors.Is(err, ErrUploadIncomplete) {
+		t.Errorf("Open() of an incomplete upload error = %v", err)
+	}
+
+	if expired, _ := store.Expire(time.Now().Add(30 * time.Minute)); expired != 0 {
+		t.Errorf("Expire() before the TTL = %d, want 0", expired)
+	}
+	if expired, _ := store.Expire(time.Now().Add(2 * time.Hour)); expired != 2 {
+		t.Errorf("Expire() after the TTL = %d, want 2", expired)
+	}
+	if _, err := store.Get(stale.ID); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("Get() of an expired upload error = %v", err)
+	}
+}
+
+func TestResumableStoreLocks(t *testing.T) {
+	store, err := NewResumableStore(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"../etc", strings.Repeat("a", 32)} {
+		if _, err := store.Append(id, 0, strings.NewReader("x")); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("Append(%q) error = %v, want %v", id, err, ErrUploadNotFound)
+		}
+	}
+	if len(store.locks) != 0 {
+		t.Errorf("locks of unknown uploads = %d, want 0", len(store.locks))
+	}
+
+	busy, _ := store.Create("busy.csv", 0, "")
+	l, err := store.lock(busy.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Append(busy.ID, 0, strings.NewReader("x")); !errors.Is(err, ErrUploadBusy) {
+		t.Errorf("Append() of a busy upload error = %v, want %v", err, ErrUploadBusy)
+	}
+	if err := store.Delete(busy.ID); !errors.Is(err, ErrUploadBusy) {
+		t.Errorf("Delete() of a busy upload error = %v, want %v", err, ErrUploadBusy)
+	}
+	if expired, _ := store.Expire(time.Now().Add(2 * time.Hour)); expired != 0 {
+		t.Errorf("Expire() of a busy upload = %d, want 0", expired)
+	}
+	l.Unlock()
+	if expired, _ := store.Expire(time.Now().Add(2 * time.Hour)); expired != 1 {
+		t.Errorf("Expire() once it's no longer busy = %d, want 1", expired)
+	}
+	if len(store.locks) != 0 {
+		t.Errorf("locks after Expire() = %d, want 0", len(store.locks))
+	}
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// RowCounts are the row counts recorded for a raw table. Like row_count in core_raw_tables,
+// Rows counts the header row too, if the upload had one. Distinct only counts loaded rows.
+type RowCounts struct {
+	Rows     int64 `json:"row_count"`
+	Distinct int64 `json:"row_count_dedup"`
+}
+
+// distinctRowsQuery counts the distinct rows of a raw table, told apart by the loaded columns.
+// NULL and empty strings are different values.
+func distinctRowsQuery(tableName string, columnNames []string) string {
+	if len(columnNames) == 0 {
+		// A table without columns has at most one distinct row
+		return fmt.Sprintf("SELECT LEAST(count(*), 1) FROM %s", pq.QuoteIdentifier(tableName))
+	}
+	quoted := make([]string, len(columnNames))
+	for i, name := range columnNames {
+		quoted[i] = pq.QuoteIdentifier(name)
+	}
+	return fmt.Sprintf("SELECT count(*) FROM (SELECT DISTINCT %s FROM %s) t", strings.Join(quoted, ", "), pq.QuoteIdentifier(tableName))
+}
+
+// CountRows counts the rows of a raw table once they're loaded. rows is how many were loaded,
+// plus one for a header row if header is set. Distinct rows are counted by Postgres, so nothing
+// is kept per row while loading, from the deduplicated table if one was made.
+func CountRows(ctx context.Context, tx *Tx, tableName string, columnNames []string, rows int64, header bool, dedupTable string) (RowCounts, error) {
+	counts := RowCounts{Rows: rows}
+	if header {
+		counts.Rows++
+	}
+	query := distinctRowsQuery(tableName, columnNames)
+	if dedupTable != "" {
+		query = fmt.Sprintf("SELECT count(*) FROM %s", pq.QuoteIdentifier(dedupTable))
+	}
+	if err := tx.QueryRowContext(ctx, query).Scan(&counts.Distinct); err != nil {
+		return counts, fmt.Errorf("error counting distinct rows of %s: %w", tableName, err)
+	}
+	return counts, nil
+}
+
+// SetRowCounts records the row counts of an upload's table, and the name of its deduplicated
+// companion table if one was made
+func SetRowCounts(ctx context.Context, tx *Tx, uploadID int64, counts RowCounts, dedupTable string) error {
+	query := "UPDATE core_raw_tables SET row_count = $2, row_count_dedup = $3, dedup_name = NULLIF($4, '') WHERE id = $1"
+	_, err := tx.ExecContext(ctx, query, uploadID, counts.Rows, counts.Distinct, dedupTable)
+	if err != nil {
+		return fmt.Errorf("error saving row counts of upload %d: %w", uploadID, err)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package models
+
+import "testing"
+
+func TestDistinctRowsQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []string
+		want    string
+	}{
+		{"columns", []string{"id", "Full Name"}, `SELECT count(*) FROM (SELECT DISTINCT "id", "Full Name" FROM "t") t`},
+		{"no columns", nil, `SELECT LEAST(count(*), 1) FROM "t"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := distinctRowsQuery("t", tt.columns); got != tt.want {
+				t.Errorf("distinctRowsQuery() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
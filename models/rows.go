@@ -0,0 +1,361 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// What to do with a row that has fewer or more fields than the table has columns
+const (
+	RowsPad      = "pad"      // short rows: the missing values are NULL
+	RowsTruncate = "truncate" // long rows: the values past the last column are dropped
+	RowsExtra    = "extra"    // long rows: the values past the last column are kept in an _extra column
+	RowsReject   = "reject"   // the row is not loaded and is kept in the rejected rows instead
+)
+
+// ExtraColumn holds the overflow of long rows, as a JSON array, when LongRows is RowsExtra
+const ExtraColumn = "_extra"
+
+// MaxRejectedRows is how many rows an upload can reject, or repair in recovery mode,
+// before it is abandoned as the wrong format
+const MaxRejectedRows = 10000
+
+// How many lines recovery mode looks through for the start of the next row after a broken one
+const maxResyncLines = 100
+
+// RowPolicy says what happens to ragged rows, whose number of fields doesn't match the header,
+// and to rows that can't be parsed
+type RowPolicy struct {
+	ShortRows string `json:"short_rows"`
+	LongRows  string `json:"long_rows"`
+	Recover   bool   `json:"recover"` // repair rows with stray quotes instead of rejecting them
+}
+
+var DefaultRowPolicy = RowPolicy{ShortRows: RowsPad, LongRows: RowsReject}
+
+// Validate checks that both policies are ones that apply to their kind of row
+func (p RowPolicy) Validate() error {
+	if p.ShortRows != RowsPad && p.ShortRows != RowsReject {
+		return fmt.Errorf("short_rows must be %q or %q", RowsPad, RowsReject)
+	}
+	if p.LongRows != RowsTruncate && p.LongRows != RowsExtra && p.LongRows != RowsReject {
+		return fmt.Errorf("long_rows must be %q, %q or %q", RowsTruncate, RowsExtra, RowsReject)
+	}
+	return nil
+}
+
+// Row is a data row of an uploaded file after the row policy has been applied
+type Row struct {
+	Line   int      // line of the file the row starts on, counting from 1
+	Values []string // no more values than the table has columns. Short rows have fewer
+	Extra  []string // values past the last column, with the RowsExtra policy
+	Raw    string   // the row's text as it was read from the file
+}
+
+// RowError is a row that was rejected, either because it couldn't be parsed or
+// because of the row policy, with its text as it was read from the file
+type RowError struct {
+	Line    int    `json:"line"`
+	Raw     string `json:"raw"`
+	Message string `json:"error"`
+	Column  string `json:"column,omitempty"` // the column of a value that didn't fit its type
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Repair is a change made to read a malformed row in recovery mode
+type Repair struct {
+	Line   int    `json:"line"`
+	Raw    string `json:"raw"`
+	Action string `json:"action"`
+}
+
+// RowReader reads the data rows of a file, past any preamble and header row.
+// Rows that are rejected are returned as a *RowError and reading can carry on after them.
+type RowReader struct {
+	reader  *csv.Reader
+	raw     *rawRecorder
+	dialect Dialect
+	policy  RowPolicy
+	offset  int // lines of the file before the first line of raw
+	header  []string
+	width   int
+	repairs []Repair
+	fixed   *FixedWidthLayout // set for fixed-width files, which are read by line instead of with reader
+	lines   *bufio.Reader
+	line    int // lines read from lines
+}
+
+// NewRowReader reads the file from the start with its encoding, dialect, layout and row policy.
+// The header row, if there is one, is read straight away and sets the width of the table.
+// Otherwise the first row does. Fixed-width files take their header from the field names.
+func (f File) NewRowReader() (*RowReader, error) {
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f.newRowReader(f.File)
+}
+
+// newRowReader is NewRowReader reading the file's content from r
+func (f File) newRowReader(r io.Reader) (*RowReader, error) {
+	policy := f.Policy
+	if policy.ShortRows == "" && policy.LongRows == "" {
+		policy.ShortRows, policy.LongRows = DefaultRowPolicy.ShortRows, DefaultRowPolicy.LongRows
+	}
+	rr := &RowReader{dialect: f.Dialect, policy: policy}
+	if f.FixedWidth != nil {
+		rr.fixed = f.FixedWidth
+		rr.lines = bufio.NewReader(DefaultDialect.normalize(NewDecodingReader(r, f.Encoding), f.Layout.Offset))
+		rr.offset = f.Layout.Offset
+		rr.header = f.FixedWidth.Names()
+		rr.width = len(rr.header)
+		return rr, nil
+	}
+	rr.restart(f.Dialect.normalize(NewDecodingReader(r, f.Encoding), f.Layout.Offset), f.Layout.Offset)
+	if f.Layout.HasHeader {
+		header, err := rr.reader.Read()
+		if err == io.EOF {
+			return nil, fmt.Errorf("the file has no header row")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV header: %w", err)
+		}
+		rr.raw.take(rr.reader.InputOffset())
+		rr.header = header
+		rr.width = len(header)
+	}
+	return rr, nil
+}
+
+// Header returns the header row, or nil if the file has none
+func (rr *RowReader) Header() []string {
+	return rr.header
+}
+
+// Repairs returns the repairs made to the rows read so far in recovery mode
+func (rr *RowReader) Repairs() []Repair {
+	return rr.repairs
+}
+
+// Read returns the next row, a *RowError if the row was rejected, or io.EOF
+func (rr *RowReader) Read() (Row, error) {
+	if rr.fixed != nil {
+		return rr.readFixedWidth()
+	}
+	values, err := rr.reader.Read()
+	if err == io.EOF {
+		return Row{}, err
+	}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if !errors.As(err, &parseErr) {
+			return Row{}, fmt.Errorf("error reading CSV file: %w", err)
+		}
+		if rr.policy.Recover {
+			return rr.recover(parseErr)
+		}
+		raw := rr.raw.take(rr.reader.InputOffset())
+		return Row{}, &RowError{Line: parseErr.StartLine + rr.offset, Raw: raw, Message: parseErrorMessage(parseErr)}
+	}
+	raw := rr.raw.take(rr.reader.InputOffset())
+	line, _ := rr.reader.FieldPos(0)
+	return rr.apply(Row{Line: line + rr.offset, Values: values}, raw)
+}
+
+// readFixedWidth reads the next non-blank line of a fixed-width file
+func (rr *RowReader) readFixedWidth() (Row, error) {
+	for {
+		line, err := rr.lines.ReadString('\n')
+		if line == "" && err == io.EOF {
+			return Row{}, err
+		}
+		if err != nil && err != io.EOF {
+			return Row{}, fmt.Errorf("error reading fixed-width file: %w", err)
+		}
+		rr.line++
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		return Row{Line: rr.line + rr.offset, Values: rr.fixed.Split(line), Raw: line}, nil
+	}
+}
+
+// apply applies the row policy to a row of the file
+func (rr *RowReader) apply(row Row, raw string) (Row, error) {
+	row.Raw = raw
+	values := row.Values
+	if rr.width == 0 {
+		rr.width = len(values)
+	}
+
+	switch {
+	case len(values) < rr.width && rr.policy.ShortRows == RowsReject,
+		len(values) > rr.width && rr.policy.LongRows == RowsReject:
+		return Row{}, &RowError{Line: row.Line, Raw: raw, Message: fmt.Sprintf("row has %d fields, expected %d", len(values), rr.width)}
+	case len(values) > rr.width:
+		if rr.policy.LongRows == RowsExtra {
+			row.Extra = values[rr.width:]
+		}
+		row.Values = values[:rr.width]
+	}
+	return row, nil
+}
+
+// recover repairs or skips a row that couldn't be parsed and starts reading again after it.
+// The row is first read on its own line, keeping stray quotes as text. If that doesn't give
+// a row as wide as the table, it is read together with the lines up to the next line that
+// parses as a row, for a quoted field that was never closed. If that fails too, those lines
+// are rejected.
+func (rr *RowReader) recover(parseErr *csv.ParseError) (Row, error) {
+	if err := rr.raw.fill(maxResyncLines + 1); err != nil {
+		return Row{}, fmt.Errorf("error reading CSV file: %w", err)
+	}
+	lines := splitLines(string(rr.raw.buf))
+	line := rr.raw.line + rr.offset
+	// Blank and comment lines before the row were skipped by csv.Reader
+	for len(lines) > 1 && rr.skippable(lines[0]) {
+		lines = lines[1:]
+		line++
+	}
+
+	end := 1
+	values, action := rr.repairRow(lines[0])
+	if values == nil {
+		for end = 1; end < len(lines) && end <= maxResyncLines; end++ {
+			if rr.plausibleRow(lines[end]) {
+				break
+			}
+		}
+		if end == len(lines) || end > maxResyncLines {
+			end = 1
+		}
+		if end > 1 {
+			values, action = rr.repairRow(strings.Join(lines[:end], ""))
+		}
+	}
+	raw := strings.Trim(strings.Join(lines[:end], ""), "\r\n")
+	rr.restart(strings.NewReader(strings.Join(lines[end:], "")), line+end-1)
+
+	if values == nil {
+		action = fmt.Sprintf("skipped line %d", line)
+		if end > 1 {
+			action = fmt.Sprintf("skipped lines %d-%d", line, line+end-1)
+		}
+		rr.repairs = append(rr.repairs, Repair{Line: line, Raw: raw, Action: action})
+		return Row{}, &RowError{Line: line, Raw: raw, Message: parseErrorMessage(parseErr)}
+	}
+	rr.repairs = append(rr.repairs, Repair{Line: line, Raw: raw, Action: action})
+	return rr.apply(Row{Line: line, Values: values}, raw)
+}
+
+// repairRow tries to read text as a single row as wide as the table
+func (rr *RowReader) repairRow(text string) ([]string, string) {
+	lazy := rr.dialect.csvReader(strings.NewReader(text))
+	lazy.LazyQuotes = true
+	lazy.FieldsPerRecord = -1
+	if records, err := lazy.ReadAll(); err == nil && len(records) == 1 && rr.fits(records[0]) {
+		return records[0], "read quotes inside fields as text"
+	}
+	delimiter := rr.dialect.Delimiter
+	if delimiter == 0 {
+		delimiter = DefaultDialect.Delimiter
+	}
+	if fields := strings.Split(strings.TrimRight(text, "\r\n"), string(delimiter)); rr.fits(fields) {
+		return fields, "read all quotes as text"
+	}
+	return nil, ""
+}
+
+// plausibleRow says whether a line could be the start of the next row after a broken one
+func (rr *RowReader) plausibleRow(line string) bool {
+	if rr.skippable(line) {
+		return true
+	}
+	records, err := rr.dialect.csvReader(strings.NewReader(line)).ReadAll()
+	return err == nil && len(records) == 1 && rr.fits(records[0])
+}
+
+// skippable says whether csv.Reader skips a line as blank or a comment
+func (rr *RowReader) skippable(line string) bool {
+	return strings.Trim(line, "\r\n") == "" || (rr.dialect.Comment != 0 && strings.HasPrefix(line, string(rr.dialect.Comment)))
+}
+
+func (rr *RowReader) fits(values []string) bool {
+	return rr.width == 0 || len(values) == rr.width
+}
+
+// restart reads on from r, which starts after line offset of the file
+func (rr *RowReader) restart(r io.Reader, offset int) {
+	if rr.raw != nil {
+		r = io.MultiReader(r, rr.raw.r)
+	}
+	rr.raw = &rawRecorder{r: r, line: 1}
+	rr.reader = rr.dialect.csvReader(rr.raw)
+	rr.reader.FieldsPerRecord = -1
+	rr.offset = offset
+}
+
+func parseErrorMessage(err *csv.ParseError) string {
+	return fmt.Sprintf("column %d: %v", err.Column, err.Err)
+}
+
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// rawRecorder keeps the text read through it that csv.Reader hasn't finished with,
+// so that rejected rows can be stored as they appeared in the file
+type rawRecorder struct {
+	r    io.Reader
+	buf  []byte
+	base int64 // input offset of buf[0]
+	line int   // line of buf[0], counting from 1
+}
+
+func (rr *rawRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the text up to offset, the csv.Reader input offset at the end of a record,
+// without its line endings, and forgets it
+func (rr *rawRecorder) take(offset int64) string {
+	n := int(offset - rr.base)
+	if n > len(rr.buf) {
+		n = len(rr.buf)
+	}
+	raw := string(rr.buf[:n])
+	rr.buf = rr.buf[n:]
+	rr.base = offset
+	rr.line += strings.Count(raw, "\n")
+	return strings.Trim(raw, "\r\n")
+}
+
+// fill reads ahead until the recorder holds at least n lines or the input ends
+func (rr *rawRecorder) fill(n int) error {
+	chunk := make([]byte, 4096)
+	for bytes.Count(rr.buf, []byte{'\n'}) < n {
+		m, err := rr.r.Read(chunk)
+		rr.buf = append(rr.buf, chunk[:m]...)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+// testFile is an uploaded file read from a string
+type testFile struct {
+	*strings.Reader
+}
+
+func (testFile) Close() error { return nil }
+
+func newTestFile(csv string, policy RowPolicy) File {
+	return File{File: testFile{strings.NewReader(csv)}, Dialect: DefaultDialect, Layout: DefaultHeaderLayout, Policy: policy}
+}
+
+func TestRowReader(t *testing.T) {
+	// The short row has a quoted line break, so it takes up lines 3 and 4
+	csv := "a,b,c\n1,2,3\n4,\"5\nfive\"\n6,7,8,9\n10,\"bad\"x,12\n13,14,15\n"
+	tests := []struct {
+		name     string
+		policy   RowPolicy
+		want     []Row
+		rejected []RowError
+	}{
+		{
+			name:   "Default pads short rows and rejects long ones",
+			policy: DefaultRowPolicy,
+			want: []Row{
+				{Line: 2, Values: []string{"1", "2", "3"}, Raw: "1,2,3"},
+				{Line: 3, Values: []string{"4", "5\nfive"}, Raw: "4,\"5\nfive\""},
+				{Line: 7, Values: []string{"13", "14", "15"}, Raw: "13,14,15"},
+			},
+			rejected: []RowError{
+				{Line: 5, Raw: "6,7,8,9", Message: "row has 4 fields, expected 3"},
+				{Line: 6, Raw: "10,\"bad\"x,12", Message: "column 8: extraneous or missing \" in quoted-field"},
+			},
+		},
+		{
+			name:   "Reject short rows and truncate long ones",
+			policy: RowPolicy{ShortRows: RowsReject, LongRows: RowsTruncate},
+			want: []Row{
+				{Line: 2, Values: []string{"1", "2", "3"}, Raw: "1,2,3"},
+				{Line: 5, Values: []string{"6", "7", "8"}, Raw: "6,7,8,9"},
+				{Line: 7, Values: []string{"13", "14", "15"}, Raw: "13,14,15"},
+			},
+			rejected: []RowError{
+				{Line: 3, Raw: "4,\"5\nfive\"", Message: "row has 2 fields, expected 3"},
+				{Line: 6, Raw: "10,\"bad\"x,12", Message: "column 8: extraneous or missing \" in quoted-field"},
+			},
+		},
+		{
+			name:   "Overflow kept as extra",
+			policy: RowPolicy{ShortRows: RowsPad, LongRows: RowsExtra},
+			want: []Row{
+				{Line: 2, Values: []string{"1", "2", "3"}, Raw: "1,2,3"},
+				{Line: 3, Values: []string{"4", "5\nfive"}, Raw: "4,\"5\nfive\""},
+				{Line: 5, Values: []string{"6", "7", "8"}, Extra: []string{"9"}, Raw: "6,7,8,9"},
+				{Line: 7, Values: []string{"13", "14", "15"}, Raw: "13,14,15"},
+			},
+			rejected: []RowError{
+				{Line: 6, Raw: "10,\"bad\"x,12", Message: "column 8: extraneous or missing \" in quoted-field"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := newTestFile(csv, tt.policy)
+			reader, err := file.NewRowReader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(reader.Header(), []string{"a", "b", "c"}) {
+				t.Errorf("Header() = %q", reader.Header())
+			}
+			rows, rejected := []Row{}, []RowError{}
+			for {
+				row, err := reader.Read()
+				if err == io.EOF {
+					break
+				}
+				var rowErr *RowError
+				if errors.As(err, &rowErr) {
+					rejected = append(rejected, *rowErr)
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				rows = append(rows, row)
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("rows = %+v, want %+v", rows, tt.want)
+			}
+			if !reflect.DeepEqual(rejected, tt.rejected) {
+				t.Errorf("rejected = %+v, want %+v", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestRowReaderPreamble(t *testing.T) {
+	file := newTestFile("Report\n\nid,name\n1,Jane\n2,John,extra\n", DefaultRowPolicy)
+	file.Layout = HeaderLayout{Offset: 2, HasHeader: true}
+	reader, err := file.NewRowReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := reader.Read()
+	if err != nil || row.Line != 4 {
+		t.Errorf("Read() = %+v, %v, want line 4", row, err)
+	}
+	_, err = reader.Read()
+	var rowErr *RowError
+	if !errors.As(err, &rowErr) || rowErr.Line != 5 || rowErr.Raw != "2,John,extra" {
+		t.Errorf("Read() error = %v, want line 5 rejected", err)
+	}
+}
+
+func TestRowReaderBOM(t *testing.T) {
+	// Excel saves CSV with a byte order mark, before a quoted first header
+	csv := "\uFEFF\"id\",\"name\"\n1,Jane\n"
+	tests := []struct {
+		name     string
+		content  string
+		encoding string
+	}{
+		{"UTF-8", csv, EncodingUTF8},
+		{"No encoding", csv, ""},
+		{"UTF-16LE", string(encode(t, csv, xunicode.UTF16(xunicode.LittleEndian, xunicode.IgnoreBOM).NewEncoder())), EncodingUTF16LE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := newTestFile(tt.content, DefaultRowPolicy)
+			file.Encoding = tt.encoding
+			reader, err := file.NewRowReader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(reader.Header(), []string{"id", "name"}) {
+				t.Errorf("Header() = %q, want [id name]", reader.Header())
+			}
+			row, err := reader.Read()
+			if err != nil || !reflect.DeepEqual(row.Values, []string{"1", "Jane"}) {
+				t.Errorf("Read() = %+v, %v", row, err)
+			}
+		})
+	}
+}
+
+func TestRowPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy  RowPolicy
+		wantErr bool
+	}{
+		{DefaultRowPolicy, false},
+		{RowPolicy{ShortRows: RowsReject, LongRows: RowsExtra}, false},
+		{RowPolicy{ShortRows: RowsTruncate, LongRows: RowsReject}, true},
+		{RowPolicy{ShortRows: RowsPad, LongRows: RowsPad}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v.Validate() error = %v, wantErr %v", tt.policy, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRowReaderRecover(t *testing.T) {
+	csv := "a,b,c\n1,x\"y,3\n4,\"bad\"x,6\n\n7,\"unclosed,9\n10,11,12\n13,\"x\"y,14,15\n16,17,18\n"
+	file := newTestFile(csv, RowPolicy{ShortRows: RowsPad, LongRows: RowsReject, Recover: true})
+	reader, err := file.NewRowReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, rejected := []Row{}, []RowError{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var rowErr *RowError
+		if errors.As(err, &rowErr) {
+			rejected = append(rejected, *rowErr)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+
+	wantRows := []Row{
+		{Line: 2, Values: []string{"1", "x\"y", "3"}, Raw: "1,x\"y,3"},
+		{Line: 3, Values: []string{"4", "\"bad\"x", "6"}, Raw: "4,\"bad\"x,6"},
+		{Line: 5, Values: []string{"7", "\"unclosed", "9"}, Raw: "7,\"unclosed,9"},
+		{Line: 6, Values: []string{"10", "11", "12"}, Raw: "10,11,12"},
+		{Line: 8, Values: []string{"16", "17", "18"}, Raw: "16,17,18"},
+	}
+	if !reflect.DeepEqual(rows, wantRows) {
+		t.Errorf("rows = %+v, want %+v", rows, wantRows)
+	}
+	wantRejected := []RowError{
+		{Line: 7, Raw: "13,\"x\"y,14,15", Message: "column 6: extraneous or missing \" in quoted-field"},
+	}
+	if !reflect.DeepEqual(rejected, wantRejected) {
+		t.Errorf("rejected = %+v, want %+v", rejected, wantRejected)
+	}
+	wantRepairs := []Repair{
+		{Line: 2, Raw: "1,x\"y,3", Action: "read quotes inside fields as text"},
+		{Line: 3, Raw: "4,\"bad\"x,6", Action: "read all quotes as text"},
+		{Line: 5, Raw: "7,\"unclosed,9", Action: "read all quotes as text"},
+		{Line: 7, Raw: "13,\"x\"y,14,15", Action: "skipped line 7"},
+	}
+	if !reflect.DeepEqual(reader.Repairs(), wantRepairs) {
+		t.Errorf("Repairs() = %+v, want %+v", reader.Repairs(), wantRepairs)
+	}
+}
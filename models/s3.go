@@ -0,0 +1,370 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config is where an S3BlobStore keeps files. Endpoint is the scheme and host of an S3
+// compatible service, such as https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for
+// MinIO. Files are stored under Prefix in Bucket.
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle puts the bucket in the path rather than the host name, which MinIO needs
+	PathStyle bool
+}
+
+// S3 takes a single PUT of up to 5 GiB, and multipart uploads of up to 10,000 parts
+const (
+	s3PartSize = 64 << 20
+	s3MaxParts = 10000
+)
+
+// S3BlobStore keeps files in an S3 bucket, so any number of instances can share them. Requests
+// are signed with AWS Signature Version 4. Bodies are streamed and sent unsigned, which HTTPS
+// protects. Files larger than a part are sent as a multipart upload, a part at a time.
+type S3BlobStore struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	partSize int64
+}
+
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("no S3 bucket")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("no S3 credentials")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	return &S3BlobStore{config: config, endpoint: endpoint, client: http.DefaultClient, partSize: s3PartSize}, nil
+}
+
+// objectURL is the URL of the object a file is stored in
+func (s *S3BlobStore) objectURL(name string) (*url.URL, error) {
+	if err := checkBlobName(name); err != nil {
+		return nil, err
+	}
+	key := name
+	if s.config.Prefix != "" {
+		key = s.config.Prefix + "/" + name
+	}
+	u := *s.endpoint
+	if s.config.PathStyle {
+		key = s.config.Bucket + "/" + key
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+	return &u, nil
+}
+
+func (s *S3BlobStore) do(ctx context.Context, method, name string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u, err := s.objectURL(name)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		// A length has to be sent, as S3 doesn't take chunked bodies
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	signS3Request(req, "UNSIGNED-PAYLOAD", s.config, time.Now())
+	return s.client.Do(req)
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if size > s.partSize {
+		return s.putMultipart(ctx, name, r, size)
+	}
+	resp, err := s.do(ctx, http.MethodPut, name, nil, r, size)
+	if err != nil {
+		return fmt.Errorf("error storing file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error storing file: %w", s3Error(resp))
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart stores a file as a multipart upload, which S3 only shows once it's completed.
+// An upload that fails is aborted, so its parts aren't kept.
+func (s *S3BlobStore) putMultipart(ctx context.Context, name string, r io.Reader, size int64) error {
+	uploadID, err := s.createMultipartUpload(ctx, name)
+	if err != nil {
+		return fmt.Errorf("error storing file: %w", err)
+	}
+	partSize := s.partSize
+	if min := (size + s3MaxParts - 1) / s3MaxParts; partSize < min {
+		partSize = min
+	}
+	var parts []s3Part
+	for offset := int64(0); offset < size; offset += partSize {
+		n := partSize
+		if size-offset < n {
+			n = size - offset
+		}
+		etag, err := s.uploadPart(ctx, name, uploadID, len(parts)+1, io.LimitReader(r, n), n)
+		if err != nil {
+			return s.abortMultipartUpload(name, uploadID, err)
+		}
+		parts = append(parts, s3Part{PartNumber: len(parts) + 1, ETag: etag})
+	}
+	if err := s.completeMultipartUpload(ctx, name, uploadID, parts); err != nil {
+		return s.abortMultipartUpload(name, uploadID, err)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) createMultipartUpload(ctx context.Context, name string) (string, error) {
+	resp, err := s.do(ctx, http.MethodPost, name, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp)
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("S3 didn't start a multipart upload: %v", err)
+	}
+	return result.UploadID, nil
+}
+
+func (s *S3BlobStore) uploadPart(ctx context.Context, name, uploadID string, number int, r io.Reader, size int64) (string, error) {
+	query := url.Values{"partNumber": {fmt.Sprint(number)}, "uploadId": {uploadID}}
+	resp, err := s.do(ctx, http.MethodPut, name, query, r, size)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", s3Error(resp)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *S3BlobStore) completeMultipartUpload(ctx context.Context, name, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPost, name, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	// S3 can report an error after it has responded 200, in the body
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error completing multipart upload: %w", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("S3 couldn't complete the multipart upload: %s %s", result.Code, result.Message)
+	}
+	return nil
+}
+
+// abortMultipartUpload drops the parts of an upload that failed with err, and returns err. It's
+// done even if the request was cancelled, as the parts would be kept, and paid for, otherwise.
+func (s *S3BlobStore) abortMultipartUpload(name, uploadID string, err error) error {
+	resp, abortErr := s.do(context.Background(), http.MethodDelete, name, url.Values{"uploadId": {uploadID}}, nil, 0)
+	if abortErr == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+			abortErr = s3Error(resp)
+		}
+	}
+	if abortErr != nil {
+		return fmt.Errorf("error storing file: %w, and aborting the multipart upload: %v", err, abortErr)
+	}
+	return fmt.Errorf("error storing file: %w", err)
+}
+
+func (s *S3BlobStore) Open(ctx context.Context, name string) (Blob, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil, 0)
+	if err != nil {
+		return Blob{}, fmt.Errorf("error reading stored file: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return Blob{}, fmt.Errorf("%w: %s", ErrBlobNotFound, name)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return Blob{}, fmt.Errorf("error reading stored file: %w", s3Error(resp))
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Blob{ReadCloser: resp.Body, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3BlobStore) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil, nil, 0)
+	if err != nil {
+		return false, fmt.Errorf("error checking stored file: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("error checking stored file: S3 responded %s", resp.Status)
+}
+
+func (s *S3BlobStore) Remove(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, nil, 0)
+	if err != nil {
+		return fmt.Errorf("error removing stored file: %w", err)
+	}
+	defer resp.Body.Close()
+	// Deleting an object that doesn't exist succeeds on S3, but not on every S3 compatible service
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("error removing stored file: %w", s3Error(resp))
+	}
+	return nil
+}
+
+// s3Error describes an error response, which has the status and an XML body explaining it
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// s3Escape URI encodes s the way AWS signatures expect: everything but unreserved characters,
+// and slashes unless encodeSlash is set
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request adds an AWS Signature Version 4 Authorization header to req, signing the host
+// and every header set on it. payloadHash is the hex SHA-256 of the body or UNSIGNED-PAYLOAD.
+func signS3Request(req *http.Request, payloadHash string, config S3Config, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+config.SecretAccessKey), date)
+	key = hmacSHA256(key, config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.AccessKeyID, scope, signedHeaders, signature))
+}
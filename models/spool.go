@@ -0,0 +1,140 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"os"
+)
+
+var utf8BOM = []byte("\uFEFF")
+
+// contentHasher hashes what's written to it, both as it is and without a leading UTF-8 BOM
+type contentHasher struct {
+	all   hash.Hash
+	noBOM hash.Hash
+	start []byte // the first bytes written, until there are enough to tell if they're a BOM
+	past  bool   // whether the start has been checked for a BOM
+}
+
+func newContentHasher() *contentHasher {
+	return &contentHasher{all: sha256.New(), noBOM: sha256.New()}
+}
+
+func (h *contentHasher) Write(p []byte) (int, error) {
+	h.all.Write(p)
+	if h.past {
+		h.noBOM.Write(p)
+		return len(p), nil
+	}
+	h.start = append(h.start, p...)
+	if len(h.start) >= len(utf8BOM) {
+		h.checkStart()
+	}
+	return len(p), nil
+}
+
+func (h *contentHasher) checkStart() {
+	h.noBOM.Write(bytes.TrimPrefix(h.start, utf8BOM))
+	h.start, h.past = nil, true
+}
+
+// sums returns the hex encoded hashes of the content and of the content without a BOM
+func (h *contentHasher) sums() (string, string) {
+	if !h.past {
+		h.checkStart()
+	}
+	return hex.EncodeToString(h.all.Sum(nil)), hex.EncodeToString(h.noBOM.Sum(nil))
+}
+
+// ScanSettings works out how a file's columns will be read from the file's first SampleSize
+// bytes, given as sample, and returns sample with its settings set. It returns false if they
+// can't be worked out, or the file isn't read by columns.
+type ScanSettings func(sample File) (File, TypeInferenceOptions, bool)
+
+// sampleFile is the start of a file being spooled
+type sampleFile struct {
+	*bytes.Reader
+}
+
+func (sampleFile) Close() error { return nil }
+
+// SpoolUpload copies an uploaded file to a temporary file in dir as it's received,
+// hashing it on the way, so the request body only has to be read once. If settings is set and
+// returns the settings the file's columns will be read with, they're scanned on the way too.
+func SpoolUpload(r io.Reader, dir, filename string, settings ScanSettings) (File, error) {
+	tmp, err := os.CreateTemp(dir, filename+"_tmp_*")
+	if err != nil {
+		return File{}, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	f, err := spool(tmp, r, filename, settings)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return File{}, err
+	}
+	return f, nil
+}
+
+// spool copies r to tmp, hashing it on the way, and rewinds tmp to be read as name
+func spool(tmp *os.File, r io.Reader, name string, settings ScanSettings) (File, error) {
+	hasher := newContentHasher()
+	var scanned *File
+	var opts TypeInferenceOptions
+	if settings != nil {
+		sample := make([]byte, SampleSize)
+		n, err := io.ReadFull(r, sample)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return File{}, err
+		}
+		sample = sample[:n]
+		r = io.MultiReader(bytes.NewReader(sample), r)
+		f, o, ok := settings(File{File: sampleFile{bytes.NewReader(sample)}, Header: &multipart.FileHeader{Filename: name, Size: int64(n)}})
+		if ok {
+			scanned, opts = &f, o
+		}
+	}
+
+	var w io.Writer = io.MultiWriter(tmp, hasher)
+	var pw *io.PipeWriter
+	var scan chan *columnScan
+	if scanned != nil {
+		// The columns are scanned from a copy of the content as it's written
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		scan = make(chan *columnScan, 1)
+		go func() {
+			stats, err := scanned.scanContent(pr, opts)
+			io.Copy(io.Discard, pr) // keep the content flowing if the scan stopped early
+			scan <- &columnScan{key: scanned.scanKey(opts), stats: stats, err: err}
+		}()
+		w = io.MultiWriter(tmp, hasher, pw)
+	}
+	n, err := io.Copy(w, r)
+	var spooledScan *columnScan
+	if scan != nil {
+		pw.CloseWithError(err)
+		spooledScan = <-scan
+	}
+	if err != nil {
+		return File{}, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return File{}, err
+	}
+	f := File{File: tmp, Header: &multipart.FileHeader{Filename: name, Size: n}, spooledScan: spooledScan}
+	f.Hash, f.HashNoBOM = hasher.sums()
+	return f, nil
+}
+
+// Path returns where a spooled or extracted file is on disk, or "" for other files
+func (f File) Path() string {
+	if tmp, ok := f.File.(*os.File); ok {
+		return tmp.Name()
+	}
+	return ""
+}
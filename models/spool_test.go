@@ -0,0 +1,116 @@
+package models
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSpoolUpload(t *testing.T) {
+	content := "\uFEFFid,name\n1,Jane\n"
+	// One byte at a time, so the BOM is split across writes
+	f, err := SpoolUpload(iotest.OneByteReader(strings.NewReader(content)), t.TempDir(), "people.csv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.RemoveTemp()
+
+	if f.Header.Filename != "people.csv" || f.Header.Size != int64(len(content)) {
+		t.Errorf("Header = %s, %d bytes", f.Header.Filename, f.Header.Size)
+	}
+	spooled, _ := io.ReadAll(f.File)
+	if string(spooled) != content {
+		t.Errorf("spooled %q, want %q", spooled, content)
+	}
+	hash, _ := f.CalculateFileHash(strings.NewReader(content))
+	hashNoBOM, _ := f.CalculateFileHash(strings.NewReader(strings.TrimPrefix(content, "\uFEFF")))
+	if f.Hash != hash || f.HashNoBOM != hashNoBOM {
+		t.Errorf("hashes = %s, %s, want %s, %s", f.Hash, f.HashNoBOM, hash, hashNoBOM)
+	}
+
+	path := f.Path()
+	f.RemoveTemp()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("RemoveTemp() left %s behind", path)
+	}
+}
+
+func TestScanColumns(t *testing.T) {
+	file := newTestFile("Report\nid,name,joined\n1,Jane,2023-01-02\n\n2,John\n3,Joe,2023-01-03,x\n", DefaultRowPolicy)
+	file.Layout = HeaderLayout{Offset: 1, HasHeader: true}
+	stats, err := file.ScanColumns(DefaultTypeInferenceOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(stats.Header, ",") != "id,name,joined" {
+		t.Errorf("Header = %q", stats.Header)
+	}
+	// The long row is rejected, so it isn't measured
+	if len(stats.MaxLengths) != 3 || stats.MaxLengths[1] != 4 || stats.MaxLengths[2] != 10 {
+		t.Errorf("MaxLengths = %v", stats.MaxLengths)
+	}
+	if stats.Types[0].Type != TypeInteger || stats.Types[2].Type != TypeDate {
+		t.Errorf("Types = %v", stats.Types)
+	}
+
+	padded := newTestFile("Report\n\n id , name,joined\n1,Jane ,2023-01-02,\n\n\n2,John\n3,Joe,2023-01-03,x\n", DefaultRowPolicy)
+	padded.Layout = file.Layout
+	paddedStats, err := padded.ScanColumns(DefaultTypeInferenceOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.HashTrimmed == "" || paddedStats.HashTrimmed != stats.HashTrimmed {
+		t.Errorf("HashTrimmed = %s and %s for files that only differ in blank lines and padding", stats.HashTrimmed, paddedStats.HashTrimmed)
+	}
+}
+
+func TestSpoolUploadScansColumns(t *testing.T) {
+	content := "Report\nid,name,joined\n1,Jane,2023-01-02\n2,John,2023-01-03\n"
+	layout := HeaderLayout{Offset: 1, HasHeader: true}
+	settings := func(sample File) (File, TypeInferenceOptions, bool) {
+		if !strings.HasPrefix(readAll(t, sample.File), "Report\n") {
+			t.Errorf("settings got a sample that isn't the start of the file")
+		}
+		sample.Dialect, sample.Layout, sample.Policy = DefaultDialect, layout, DefaultRowPolicy
+		return sample, DefaultTypeInferenceOptions, true
+	}
+	f, err := SpoolUpload(iotest.OneByteReader(strings.NewReader(content)), t.TempDir(), "people.csv", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.RemoveTemp()
+	if f.spooledScan == nil || f.spooledScan.err != nil {
+		t.Fatalf("spooled scan = %+v", f.spooledScan)
+	}
+
+	f.Dialect, f.Layout, f.Policy = DefaultDialect, layout, DefaultRowPolicy
+	want, err := f.ScanColumns(DefaultTypeInferenceOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.spooledScan.stats, want) {
+		t.Errorf("spooled scan = %+v, want %+v", f.spooledScan.stats, want)
+	}
+
+	// Settings that changed after spooling need another scan
+	f.Layout = HeaderLayout{Offset: 0, HasHeader: true}
+	got, err := f.ColumnStats(DefaultTypeInferenceOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Header[0] != "Report" {
+		t.Errorf("ColumnStats() with other settings has header %q, want the file scanned again", got.Header)
+	}
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	t.Helper()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// FileStore keeps uploaded files as they were sent, named by the SHA-256 of their content, so
+// uploads with the same name don't overwrite each other and identical uploads are stored once.
+// core_raw_tables.saved_filename refers to a stored file. It's removed once nothing refers to it.
+//
+// Storing a file and referring to it, and counting the references to a file and removing it, are
+// each done under a transaction lock on its name, so a file is never removed between being stored
+// and the upload referring to it being committed.
+type FileStore struct {
+	db    *DB
+	blobs BlobStore
+}
+
+func NewFileStore(db *DB, blobs BlobStore) *FileStore {
+	return &FileStore{db: db, blobs: blobs}
+}
+
+// StoredName is the name content with a hash is stored under, relative to the store
+func StoredName(hash string) string {
+	return path.Join("sha256", hash[:2], hash)
+}
+
+// lockStoredName locks a stored name until the end of tx
+func lockStoredName(ctx context.Context, tx *Tx, name string) error {
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", name); err != nil {
+		return fmt.Errorf("error locking stored file %s: %w", name, err)
+	}
+	return nil
+}
+
+// Put stores the file at src and returns its stored name, which the caller refers to in tx. hash
+// is the hex SHA-256 of its content. The name stays locked until tx ends. If tx is rolled back
+// the caller releases the name, as the file may be referred to by nothing.
+func (s *FileStore) Put(ctx context.Context, tx *Tx, src, hash string) (string, error) {
+	name, err := storedName(hash)
+	if err != nil {
+		return "", err
+	}
+	if err := lockStoredName(ctx, tx, name); err != nil {
+		return "", err
+	}
+	return s.put(ctx, src, hash)
+}
+
+func storedName(hash string) (string, error) {
+	if !sha256Re.MatchString(hash) {
+		return "", fmt.Errorf("%w: %q isn't a SHA-256", ErrInvalidStoredName, hash)
+	}
+	return StoredName(strings.ToLower(hash)), nil
+}
+
+// put stores the file at src. Content that's already stored isn't written again.
+func (s *FileStore) put(ctx context.Context, src, hash string) (string, error) {
+	name, err := storedName(hash)
+	if err != nil {
+		return "", err
+	}
+	stored, err := s.blobs.Exists(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if stored {
+		return name, nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return "", fmt.Errorf("error storing file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("error storing file: %w", err)
+	}
+	if err := s.blobs.Put(ctx, name, f, info.Size()); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Release removes a stored file unless an upload refers to it
+func (s *FileStore) Release(ctx context.Context, name string) error {
+	tx, err := s.db.BeginTx(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := lockStoredName(ctx, tx, name); err != nil {
+		return err
+	}
+	var referred bool
+	query := "SELECT EXISTS (SELECT 1 FROM core_raw_tables WHERE saved_filename = $1)"
+	if err := tx.QueryRowContext(ctx, query, name).Scan(&referred); err != nil {
+		return fmt.Errorf("error counting uploads of stored file %s: %w", name, err)
+	}
+	if referred {
+		return nil
+	}
+	if err := s.Remove(ctx, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Open opens a stored file for reading
+func (s *FileStore) Open(ctx context.Context, name string) (Blob, error) {
+	return s.blobs.Open(ctx, name)
+}
+
+// Remove removes a stored file whether or not anything refers to it. One that's already gone
+// isn't an error.
+func (s *FileStore) Remove(ctx context.Context, name string) error {
+	return s.blobs.Remove(ctx, name)
+}
+
+var ErrNotStored = errors.New("the file was uploaded before files were kept")
+
+// StoredFile returns the name an upload was sent as and the name of its file in the store
+func (m UploadModel) StoredFile(ctx context.Context, id int64) (filename, saved string, err error) {
+	var name sql.NullString
+	query := "SELECT source_filename, saved_filename FROM core_raw_tables WHERE id = $1 AND parent_id IS NULL AND NOT deleted"
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(&filename, &name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrFileNotFound
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("error reading upload %d: %w", id, err)
+	}
+	if !name.Valid {
+		return filename, "", ErrNotStored
+	}
+	return filename, name.String, nil
+}
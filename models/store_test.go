@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBlobStore exercises a blob store through a FileStore: dedup, reading back, removing
+func testBlobStore(t *testing.T, blobs BlobStore) {
+	ctx := context.Background()
+	counted := &countingBlobStore{BlobStore: blobs}
+	store := NewFileStore(nil, counted)
+	dir := t.TempDir()
+	put := func(content string) string {
+		t.Helper()
+		src := filepath.Join(dir, "upload")
+		if err := os.WriteFile(src, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256([]byte(content))
+		name, err := store.put(ctx, src, hex.EncodeToString(sum[:]))
+		if err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+		return name
+	}
+
+	first := put("id,name\n1,a\n")
+	if again := put("id,name\n1,a\n"); again != first {
+		t.Errorf("Put() of the same content = %s, want %s", again, first)
+	}
+	if counted.puts != 1 {
+		t.Errorf("Put() of the same content twice wrote it %d times, want once", counted.puts)
+	}
+	if other := put("id,name\n2,b\n"); other == first {
+		t.Errorf("Put() of other content = %s, the same as the first", other)
+	}
+	if empty := put(""); !strings.HasSuffix(empty, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855") {
+		t.Errorf("Put() of no content = %s", empty)
+	}
+
+	blob, err := store.Open(ctx, first)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	content, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(content) != "id,name\n1,a\n" || blob.Size != int64(len(content)) {
+		t.Errorf("Open() = %q, size %d", content, blob.Size)
+	}
+
+	if err := store.Remove(ctx, first); err != nil {
+		t.Errorf("Remove() error = %v", err)
+	}
+	if err := store.Remove(ctx, first); err != nil {
+		t.Errorf("Remove() of a removed file error = %v", err)
+	}
+	if _, err := store.Open(ctx, first); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Open() of a removed file error = %v, want ErrBlobNotFound", err)
+	}
+
+	for _, name := range []string{"", "..", "../passwd", "sha256/../../passwd", "/etc/passwd", "sha256//x"} {
+		if _, err := store.Open(ctx, name); !errors.Is(err, ErrInvalidStoredName) {
+			t.Errorf("Open(%q) error = %v, want ErrInvalidStoredName", name, err)
+		}
+	}
+	if _, err := store.put(ctx, filepath.Join(dir, "upload"), "../../etc"); !errors.Is(err, ErrInvalidStoredName) {
+		t.Errorf("Put() with a bad hash error = %v, want ErrInvalidStoredName", err)
+	}
+}
+
+// countingBlobStore counts the files written to a blob store
+type countingBlobStore struct {
+	BlobStore
+	puts int
+}
+
+func (s *countingBlobStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	s.puts++
+	return s.BlobStore.Put(ctx, name, r, size)
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	blobs, err := NewLocalBlobStore(filepath.Join(t.TempDir(), "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, blobs)
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"context"
+	"fmt"
+)
+
+// RawTable is a table that part of an upload, such as a worksheet of a workbook or the arrays
+// of a JSON file, was loaded into
+type RawTable struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"table"`
+	SheetName string `json:"sheet_name,omitempty"`
+	JSONPath  string `json:"json_path,omitempty"`
+}
+
+// GetChildTables returns the tables loaded from the parts of an upload in the order they were loaded
+func GetChildTables(ctx context.Context, tx *Tx, parentID int64) ([]RawTable, error) {
+	query := `SELECT id, name, COALESCE(sheet_name, ''), COALESCE(json_path, '')
+	FROM core_raw_tables
+	WHERE parent_id = $1
+	ORDER BY id`
+	rows, err := tx.QueryContext(ctx, query, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tables of upload %d: %w", parentID, err)
+	}
+	defer rows.Close()
+
+	tables := []RawTable{}
+	for rows.Next() {
+		var table RawTable
+		if err := rows.Scan(&table.ID, &table.Name, &table.SheetName, &table.JSONPath); err != nil {
+			return nil, fmt.Errorf("error reading tables of upload %d: %w", parentID, err)
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
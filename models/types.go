@@ -0,0 +1,120 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ColumnType is the Postgres type chosen for a column of an uploaded file
+type ColumnType string
+
+const (
+	TypeBoolean     ColumnType = "boolean"
+	TypeInteger     ColumnType = "integer"
+	TypeBigint      ColumnType = "bigint"
+	TypeNumeric     ColumnType = "numeric"
+	TypeDate        ColumnType = "date"
+	TypeTimestamp   ColumnType = "timestamp"
+	TypeTimestampTZ ColumnType = "timestamptz"
+	TypeUUID        ColumnType = "uuid"
+	TypeText        ColumnType = "text"
+)
+
+// Candidate types from most to least specific. The first type that enough values
+// parse as is chosen for the column.
+var inferableTypes = []ColumnType{TypeBoolean, TypeInteger, TypeBigint, TypeNumeric, TypeDate, TypeTimestamp, TypeTimestampTZ, TypeUUID}
+
+// Column describes a column of a raw table and where its values come from in the uploaded file
+type Column struct {
+	Name       string     `json:"name"`
+	Header     string     `json:"header"`
+	Index      int        `json:"-"` // position of the column's values in each CSV record
+	Type       ColumnType `json:"type"`
+	SQLType    string     `json:"sql_type"`
+	Confidence float64    `json:"confidence"`
+}
+
+// TypeInferenceOptions controls how confident the inference has to be before
+// choosing anything other than text
+type TypeInferenceOptions struct {
+	Disabled   bool    // every column is text
+	Confidence float64 // fraction of non-empty values that must parse as a type for it to be chosen
+	MinValues  int     // columns with fewer non-empty values stay text
+}
+
+var DefaultTypeInferenceOptions = TypeInferenceOptions{Confidence: 1, MinValues: 1}
+
+// InferredType is the type chosen for a column and the fraction of its non-empty values that fit it
+type InferredType struct {
+	Type       ColumnType `json:"type"`
+	Confidence float64    `json:"confidence"`
+}
+
+// TypeInferrer accumulates the values of each column and picks a type for each
+type TypeInferrer struct {
+	opts    TypeInferenceOptions
+	profile ParsingProfile
+	columns []columnTypeCounts
+}
+
+type columnTypeCounts struct {
+	nonEmpty int
+	matches  map[ColumnType]int
+}
+
+func NewTypeInferrer(opts TypeInferenceOptions, profile ParsingProfile) *TypeInferrer {
+	return &TypeInferrer{opts: opts, profile: profile}
+}
+
+// Add counts the types each value of a record could be loaded as
+func (ti *TypeInferrer) Add(record []string) {
+	for len(ti.columns) < len(record) {
+		ti.columns = append(ti.columns, columnTypeCounts{matches: map[ColumnType]int{}})
+	}
+	if ti.opts.Disabled {
+		return
+	}
+	for i, value := range record {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		counts := &ti.columns[i]
+		counts.nonEmpty++
+		for _, t := range inferableTypes {
+			if _, err := ti.profile.Convert(t, value); err == nil {
+				counts.matches[t]++
+			}
+		}
+	}
+}
+
+// Types returns the inferred type of every column seen so far
+func (ti *TypeInferrer) Types() []InferredType {
+	types := make([]InferredType, len(ti.columns))
+	for i, counts := range ti.columns {
+		types[i] = InferredType{Type: TypeText, Confidence: 1}
+		if counts.nonEmpty == 0 || counts.nonEmpty < ti.opts.MinValues {
+			continue
+		}
+		for _, t := range inferableTypes {
+			confidence := float64(counts.matches[t]) / float64(counts.nonEmpty)
+			if confidence >= ti.opts.Confidence {
+				types[i] = InferredType{Type: t, Confidence: confidence}
+				break
+			}
+		}
+	}
+	return types
+}
+
+// SQL returns the column definition type. Text columns keep the VARCHAR sized to the longest value.
+func (t ColumnType) SQL(maxLength int) string {
+	if t == TypeText || t == "" {
+		if maxLength < 1 { // 0-length varchar not allowed in Postgres? (allowed in MySQL)
+			maxLength = 1
+		}
+		return fmt.Sprintf("VARCHAR(%d)", maxLength)
+	}
+	return strings.ToUpper(string(t))
+}
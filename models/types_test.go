@@ -0,0 +1,32 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestTypeInferrer(t *testing.T) {
+	records := [][]string{
+		{"1", "00123", "1.5", "yes", "2023-01-02", "2023-01-02 10:00:00", "2023-01-02T10:00:00Z", "6f1b7c2e-8a2d-4a51-9c3e-0d2b5e7f9a10", "3000000000", "a"},
+		{"2", "00456", "", "no", "2023-12-31", "2023-12-31", "2023-01-02T10:00:00+02:00", "6F1B7C2E-8A2D-4A51-9C3E-0D2B5E7F9A10", "1", "2023-01-02"},
+		{"-3", "789", "4", "Y", "", "2023-12-31T23:59", "", "", "2", "3"},
+	}
+	want := []ColumnType{TypeInteger, TypeText, TypeNumeric, TypeBoolean, TypeDate, TypeTimestamp, TypeTimestampTZ, TypeUUID, TypeBigint, TypeText}
+
+	inferrer := NewTypeInferrer(DefaultTypeInferenceOptions, DefaultParsingProfile)
+	for _, record := range records {
+		inferrer.Add(record)
+	}
+	for i, got := range inferrer.Types() {
+		if got.Type != want[i] {
+			t.Errorf("column %d: type = %v, want %v", i, got.Type, want[i])
+		}
+	}
+
+	relaxed := NewTypeInferrer(TypeInferenceOptions{Confidence: 0.6, MinValues: 1}, DefaultParsingProfile)
+	relaxed.Add([]string{"1"})
+	relaxed.Add([]string{"2"})
+	relaxed.Add([]string{"n/a"})
+	if got := relaxed.Types()[0]; got.Type != TypeInteger {
+		t.Errorf("relaxed confidence: type = %v, want %v", got.Type, TypeInteger)
+	}
+}
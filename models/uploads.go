@@ -12,6 +12,10 @@ type Upload struct {
 	FileSize         int64     `json:"file_size"`
 	ImportFormat     string    `json:"format_name"`
 	DatetimeUploaded time.Time `json:"datetime_uploaded"`
+	RowCount         *int64    `json:"row_count"` // NULL for workbooks, archives and uploads from before rows were counted
+	RowCountDedup    *int64    `json:"row_count_dedup"`
+	ValidationStatus *string   `json:"validation_status"` // NULL unless the upload's import format has rules
+	DeletedAt        *time.Time `json:"deleted_at,omitempty"`
 
 }
 
@@ -20,12 +24,14 @@ type UploadModel struct {
 }
 
 //func handleFileUpload(w http.ResponseWriter, r *http.Request, db *models.DB) {
-func (m UploadModel) All(ctx context.Context) ([]Upload, error) {	
-	query := `SELECT u.id, u.source_filename, u.file_size, u.datetime_uploaded, COALESCE(c.name, '') as format_name
+// All returns the uploads that aren't deleted, or those that are if deleted is set
+func (m UploadModel) All(ctx context.Context, deleted bool) ([]Upload, error) {	
+	query := `SELECT u.id, u.source_filename, u.file_size, u.datetime_uploaded, COALESCE(c.name, '') as format_name, u.row_count, u.row_count_dedup, u.validation_status, u.deleted_at
 	FROM core_raw_tables u
 	LEFT JOIN core_import_formats c ON u.format_id = c.id
+	WHERE u.parent_id IS NULL AND u.deleted = $1
 	ORDER BY u.datetime_uploaded DESC;`
-	rows, err :=m.DB.QueryWithContext(ctx, query)	
+	rows, err :=m.DB.QueryWithContext(ctx, query, deleted)	
 	if err != nil {		
 		return nil, fmt.Errorf("Failed to fetch file information from the database")
 	}
@@ -35,7 +41,7 @@ func (m UploadModel) All(ctx context.Context) ([]Upload, error) {
 
 	for rows.Next() {
 		var fileInfo Upload
-		err := rows.Scan(&fileInfo.Id, &fileInfo.FileName, &fileInfo.FileSize, &fileInfo.DatetimeUploaded, &fileInfo.ImportFormat)
+		err := rows.Scan(&fileInfo.Id, &fileInfo.FileName, &fileInfo.FileSize, &fileInfo.DatetimeUploaded, &fileInfo.ImportFormat, &fileInfo.RowCount, &fileInfo.RowCountDedup, &fileInfo.ValidationStatus, &fileInfo.DeletedAt)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to read file information from the database")
 		}
@@ -44,16 +50,3 @@ func (m UploadModel) All(ctx context.Context) ([]Upload, error) {
 	return fileInfos, nil
 }
 
-
-func (m UploadModel) Delete(ctx context.Context, id int) (error) {
-	tx, err := m.DB.BeginTx(ctx)
-	if err != nil {
-		return fmt.Errorf("Failed to start transaction")
-	}
-	defer m.DB.Close()
-	_, err = tx.ExecContext(ctx, "DELETE FROM core_raw_tables WHERE id = $1", id)
-	if err != nil {
-		return fmt.Errorf("Failed to delete file")
-	}
-	return nil	
-}
\ No newline at end of file
@@ -0,0 +1,449 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Kinds of validation rule
+const (
+	RuleRequired = "required" // the value isn't empty
+	RuleUnique   = "unique"   // no other row has the value
+	RuleRegex    = "regex"    // the value matches pattern
+	RuleAllowed  = "allowed"  // the value is one of values
+	RuleRange    = "range"    // the value is between min and max, as a number or date
+	RuleCompare  = "compare"  // the value compares with op to column other, or to value
+)
+
+// Severities of validation rule. An upload that breaks an error rule isn't valid.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Validation status of an upload whose import format has rules
+const (
+	ValidationValid    = "valid"
+	ValidationWarnings = "warnings" // only warning rules were broken
+	ValidationInvalid  = "invalid"
+)
+
+// Violations stored for each rule. The summary counts all of them.
+const maxStoredViolations = 1000
+
+var ErrNoRules = errors.New("the import format has no validation rules")
+
+// Patterns a value has to match before it's compared as a number or a date. Postgres shares the syntax.
+// A value that matches can still not be one, such as 2023-02-30, so it's converted with the
+// core_try_ functions, which return NULL rather than fail the rule.
+const (
+	numericPattern   = `^\s*[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?\s*$`
+	datePattern      = `^\d{4}-\d{2}-\d{2}$`
+	timestampPattern = `^\d{4}-\d{2}-\d{2}([ T]\d{2}:\d{2}(:\d{2}(\.\d+)?)?)?$`
+)
+
+var comparablePatterns = map[ColumnType]*regexp.Regexp{
+	TypeNumeric:   regexp.MustCompile(numericPattern),
+	TypeDate:      regexp.MustCompile(datePattern),
+	TypeTimestamp: regexp.MustCompile(timestampPattern),
+}
+
+var compareOps = map[string]bool{"=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// ValidationRule is a check an import format makes on the values of a column
+type ValidationRule struct {
+	Column   string     `json:"column"` // header or column name
+	Kind     string     `json:"kind"`
+	Severity string     `json:"severity,omitempty"` // error if empty
+	Pattern  string     `json:"pattern,omitempty"`  // regex. A Postgres regular expression.
+	Values   []string   `json:"values,omitempty"`   // allowed
+	Type     ColumnType `json:"type,omitempty"`     // range and compare: numeric, date or timestamp. Compare is text if empty.
+	Min      string     `json:"min,omitempty"`      // range
+	Max      string     `json:"max,omitempty"`      // range
+	Op       string     `json:"op,omitempty"`       // compare: =, <>, <, <=, > or >=
+	Other    string     `json:"other,omitempty"`    // compare: the other column
+	Value    string     `json:"value,omitempty"`    // compare: a constant instead of another column
+	Message  string     `json:"message,omitempty"`  // reported with each violation instead of the default
+}
+
+// Validate checks that a rule can be run
+func (r ValidationRule) Validate() error {
+	if r.Column == "" {
+		return fmt.Errorf("column is required")
+	}
+	if r.Severity != "" && r.Severity != SeverityError && r.Severity != SeverityWarning {
+		return fmt.Errorf("severity must be %q or %q", SeverityError, SeverityWarning)
+	}
+	comparable := func() error {
+		if _, ok := comparablePatterns[r.Type]; !ok {
+			return fmt.Errorf("type must be %s, %s or %s", TypeNumeric, TypeDate, TypeTimestamp)
+		}
+		return nil
+	}
+	switch r.Kind {
+	case RuleRequired, RuleUnique:
+	case RuleRegex:
+		if r.Pattern == "" {
+			return fmt.Errorf("pattern is required")
+		}
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+	case RuleAllowed:
+		if len(r.Values) == 0 {
+			return fmt.Errorf("values are required")
+		}
+	case RuleRange:
+		if err := comparable(); err != nil {
+			return err
+		}
+		if r.Min == "" && r.Max == "" {
+			return fmt.Errorf("min or max is required")
+		}
+		for _, bound := range []string{r.Min, r.Max} {
+			if bound == "" {
+				continue
+			}
+			if err := r.checkConstant(bound); err != nil {
+				return err
+			}
+		}
+		if r.Type == TypeNumeric && r.Min != "" && r.Max != "" {
+			lo, _ := strconv.ParseFloat(r.Min, 64)
+			hi, _ := strconv.ParseFloat(r.Max, 64)
+			if lo > hi {
+				return fmt.Errorf("min is greater than max")
+			}
+		}
+	case RuleCompare:
+		if r.Type != "" && r.Type != TypeText {
+			if err := comparable(); err != nil {
+				return err
+			}
+		}
+		if !compareOps[r.Op] {
+			return fmt.Errorf("op must be =, <>, <, <=, > or >=")
+		}
+		if (r.Other == "") == (r.Value == "") {
+			return fmt.Errorf("compare needs either other or value")
+		}
+		if r.Value != "" && r.Type != "" && r.Type != TypeText {
+			if err := r.checkConstant(r.Value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", r.Kind)
+	}
+	return nil
+}
+
+// checkConstant checks that a value in the rule itself is of its type, as Postgres would fail the
+// rule casting it
+func (r ValidationRule) checkConstant(value string) error {
+	if !comparablePatterns[r.Type].MatchString(value) {
+		return fmt.Errorf("%q isn't a %s", value, r.Type)
+	}
+	if r.Type == TypeNumeric {
+		return nil
+	}
+	// Dates and timestamps start with a date, which the pattern doesn't check is real
+	if _, err := time.Parse("2006-01-02", value[:10]); err != nil {
+		return fmt.Errorf("%q isn't a %s", value, r.Type)
+	}
+	return nil
+}
+
+func (r ValidationRule) severity() string {
+	if r.Severity == "" {
+		return SeverityError
+	}
+	return r.Severity
+}
+
+// message describes a violation of the rule
+func (r ValidationRule) message() string {
+	if r.Message != "" {
+		return r.Message
+	}
+	switch r.Kind {
+	case RuleRequired:
+		return "value is required"
+	case RuleUnique:
+		return "value is repeated in other rows"
+	case RuleRegex:
+		return fmt.Sprintf("value doesn't match %s", r.Pattern)
+	case RuleAllowed:
+		return "value isn't one of the allowed values"
+	case RuleRange:
+		switch {
+		case r.Min == "":
+			return fmt.Sprintf("value isn't a %s at most %s", r.Type, r.Max)
+		case r.Max == "":
+			return fmt.Sprintf("value isn't a %s at least %s", r.Type, r.Min)
+		}
+		return fmt.Sprintf("value isn't a %s between %s and %s", r.Type, r.Min, r.Max)
+	case RuleCompare:
+		if r.Other != "" {
+			return fmt.Sprintf("value isn't %s %s", r.Op, r.Other)
+		}
+		return fmt.Sprintf("value isn't %s %s", r.Op, r.Value)
+	}
+	return "value is invalid"
+}
+
+// RuleResult is how many rows broke a rule. Error is set instead if the rule couldn't be run.
+type RuleResult struct {
+	Index      int    `json:"index"` // position of the rule in the format's rules
+	Column     string `json:"column"`
+	Kind       string `json:"kind"`
+	Severity   string `json:"severity"`
+	Violations int64  `json:"violations"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ValidationSummary is the outcome of running an import format's rules on an upload
+type ValidationSummary struct {
+	Status   string       `json:"status"`
+	Errors   int64        `json:"errors"`   // violations of error rules
+	Warnings int64        `json:"warnings"` // violations of warning rules
+	Rules    []RuleResult `json:"rules"`
+}
+
+// Violation is a cell of a raw table that broke a rule. RowID is the row's _id, or nil if the
+// whole column is missing.
+type Violation struct {
+	RuleIndex int     `json:"rule_index"`
+	Column    string  `json:"column"`
+	RowID     *int64  `json:"row_id"`
+	Value     *string `json:"value"`
+	Severity  string  `json:"severity"`
+	Message   string  `json:"message"`
+}
+
+// typedValue is the value of a column as type t, or NULL if it can't be read as one
+func typedValue(column string, t ColumnType, arg func(interface{}) string) string {
+	text := column + "::text"
+	pattern, ok := comparablePatterns[t]
+	if !ok {
+		return text
+	}
+	return fmt.Sprintf("CASE WHEN %s ~ %s THEN core_try_%s(%s) END", text, arg(pattern.String()), t, text)
+}
+
+// violationsQuery selects the row_id and value of each row of table that breaks the rule.
+// column and other are the quoted columns the rule refers to.
+func violationsQuery(r ValidationRule, table, column, other string, arg func(interface{}) string) string {
+	text := column + "::text"
+	nonEmpty := fmt.Sprintf("%s IS NOT NULL AND %s <> ''", column, text)
+	selectFrom := fmt.Sprintf("SELECT _id AS row_id, %s AS value FROM %s WHERE ", text, table)
+	switch r.Kind {
+	case RuleRequired:
+		return selectFrom + fmt.Sprintf("%s IS NULL OR %s = ''", column, text)
+	case RuleUnique:
+		return fmt.Sprintf("SELECT row_id, value FROM (SELECT _id AS row_id, %s AS value, count(*) OVER (PARTITION BY %s) AS n FROM %s) t WHERE value <> '' AND n > 1", text, text, table)
+	case RuleRegex:
+		return selectFrom + fmt.Sprintf("%s AND %s !~ %s", nonEmpty, text, arg(r.Pattern))
+	case RuleAllowed:
+		return selectFrom + fmt.Sprintf("%s AND NOT (%s = ANY(%s))", nonEmpty, text, arg(pq.Array(r.Values)))
+	case RuleRange:
+		value := typedValue(column, r.Type, arg)
+		conditions := fmt.Sprintf("%s IS NULL", value) // not a number or date at all
+		if r.Min != "" {
+			conditions += fmt.Sprintf(" OR %s < %s::%s", value, arg(r.Min), r.Type)
+		}
+		if r.Max != "" {
+			conditions += fmt.Sprintf(" OR %s > %s::%s", value, arg(r.Max), r.Type)
+		}
+		return selectFrom + fmt.Sprintf("%s AND (%s)", nonEmpty, conditions)
+	case RuleCompare:
+		left := typedValue(column, r.Type, arg)
+		var right string
+		if r.Other != "" {
+			right = typedValue(other, r.Type, arg)
+		} else if t := r.Type; t != "" && t != TypeText {
+			right = fmt.Sprintf("%s::%s", arg(r.Value), t)
+		} else {
+			right = arg(r.Value) + "::text"
+		}
+		// Rows where either side is missing aren't compared
+		compared := fmt.Sprintf("%s IS NOT NULL AND %s IS NOT NULL AND NOT (%s %s %s)", left, right, left, r.Op, right)
+		if t := r.Type; t == "" || t == TypeText {
+			return selectFrom + compared
+		}
+		// but a side that isn't empty and can't be read as the type breaks the rule
+		unreadable := fmt.Sprintf("%s <> '' AND %s IS NULL", text, left)
+		if r.Other != "" {
+			unreadable += fmt.Sprintf(" OR %s::text <> '' AND %s IS NULL", other, right)
+		}
+		return selectFrom + fmt.Sprintf("%s OR %s", unreadable, compared)
+	}
+	return ""
+}
+
+// findColumn finds a column of a raw table by its name or header
+func findColumn(columns []Column, name string) (string, bool) {
+	for _, column := range columns {
+		if column.Name == name {
+			return column.Name, true
+		}
+	}
+	for _, column := range columns {
+		if column.Header == name {
+			return column.Name, true
+		}
+	}
+	return "", false
+}
+
+// ValidateUpload runs validation rules on the raw table of an upload, replacing the violations
+// recorded by any earlier run, and records the outcome
+func ValidateUpload(ctx context.Context, tx *Tx, uploadID int64, rules []ValidationRule) (ValidationSummary, error) {
+	summary := ValidationSummary{Status: ValidationValid, Rules: []RuleResult{}}
+	var table sql.NullString
+	var rawTableID int64
+	err := tx.QueryRowContext(ctx, "SELECT name, COALESCE(duplicate_of, id) FROM core_raw_tables WHERE id = $1", uploadID).Scan(&table, &rawTableID)
+	if err != nil {
+		return summary, fmt.Errorf("error reading upload %d: %w", uploadID, err)
+	}
+	if !table.Valid {
+		return summary, ErrNoTable
+	}
+	columns, err := GetColumns(ctx, tx, rawTableID)
+	if err != nil {
+		return summary, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM core_validation_violations WHERE raw_table_id = $1", uploadID); err != nil {
+		return summary, fmt.Errorf("error clearing violations of upload %d: %w", uploadID, err)
+	}
+
+	for i, rule := range rules {
+		result := RuleResult{Index: i, Column: rule.Column, Kind: rule.Kind, Severity: rule.severity()}
+		result.Violations, err = runRule(ctx, tx, uploadID, i, rule, table.String, columns)
+		if err != nil {
+			// A rule that can't be run doesn't stop the others, but can't be passed either
+			result.Error = err.Error()
+			result.Violations = 0
+		}
+		if result.Violations > 0 || result.Error != "" {
+			if result.Severity == SeverityError {
+				summary.Status = ValidationInvalid
+			} else if summary.Status == ValidationValid {
+				summary.Status = ValidationWarnings
+			}
+		}
+		if result.Severity == SeverityError {
+			summary.Errors += result.Violations
+		} else {
+			summary.Warnings += result.Violations
+		}
+		summary.Rules = append(summary.Rules, result)
+	}
+
+	query := "UPDATE core_raw_tables SET validation_status = $2, validation_errors = $3, validation_warnings = $4 WHERE id = $1"
+	if _, err := tx.ExecContext(ctx, query, uploadID, summary.Status, summary.Errors, summary.Warnings); err != nil {
+		return summary, fmt.Errorf("error saving validation status of upload %d: %w", uploadID, err)
+	}
+	return summary, nil
+}
+
+// runRule stores up to maxStoredViolations violations of a rule and returns how many there are.
+// The rule runs in a savepoint so that one Postgres can't run leaves the transaction usable.
+func runRule(ctx context.Context, tx *Tx, uploadID int64, index int, rule ValidationRule, table string, columns []Column) (int64, error) {
+	column, ok := findColumn(columns, rule.Column)
+	if !ok {
+		query := `INSERT INTO core_validation_violations (raw_table_id, rule_index, column_name, severity, message)
+		VALUES ($1, $2, $3, $4, $5)`
+		_, err := tx.ExecContext(ctx, query, uploadID, index, rule.Column, rule.severity(), "column is missing")
+		if err != nil {
+			return 0, fmt.Errorf("error saving violations: %w", err)
+		}
+		return 1, nil
+	}
+	other := ""
+	if rule.Kind == RuleCompare && rule.Other != "" {
+		if other, ok = findColumn(columns, rule.Other); !ok {
+			return 0, fmt.Errorf("%w: %q", ErrUnknownSourceColumn, rule.Other)
+		}
+		other = pq.QuoteIdentifier(other)
+	}
+
+	args := []interface{}{uploadID, index, rule.Column, rule.severity(), rule.message(), maxStoredViolations}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	violations := violationsQuery(rule, pq.QuoteIdentifier(table), pq.QuoteIdentifier(column), other, arg)
+	query := fmt.Sprintf(`WITH v AS (%s), stored AS (
+		INSERT INTO core_validation_violations (raw_table_id, rule_index, column_name, row_id, value, severity, message)
+		SELECT $1, $2, $3, row_id, value, $4, $5 FROM v ORDER BY row_id LIMIT $6
+	)
+	SELECT count(*) FROM v`, violations)
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT validation_rule"); err != nil {
+		return 0, fmt.Errorf("error starting rule: %w", err)
+	}
+	var count int64
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		if _, rollbackErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT validation_rule"); rollbackErr != nil {
+			return 0, fmt.Errorf("error undoing rule: %w", rollbackErr)
+		}
+		return 0, fmt.Errorf("rule %d couldn't be run: %w", index+1, err)
+	}
+	if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT validation_rule"); err != nil {
+		return 0, fmt.Errorf("error finishing rule: %w", err)
+	}
+	return count, nil
+}
+
+// ValidateUploadFormat runs the rules of an upload's import format on it again, as they may have
+// changed since it was uploaded
+func ValidateUploadFormat(ctx context.Context, tx *Tx, uploadID int64) (ValidationSummary, error) {
+	var formatID sql.NullInt64
+	err := tx.QueryRowContext(ctx, "SELECT format_id FROM core_raw_tables WHERE id = $1", uploadID).Scan(&formatID)
+	if err != nil {
+		return ValidationSummary{}, fmt.Errorf("error reading upload %d: %w", uploadID, err)
+	}
+	if !formatID.Valid {
+		return ValidationSummary{}, ErrNoFormat
+	}
+	format, err := GetImportFormat(ctx, tx, formatID.Int64)
+	if err != nil {
+		return ValidationSummary{}, fmt.Errorf("error reading import format of upload %d: %w", uploadID, err)
+	}
+	if len(format.Rules) == 0 {
+		return ValidationSummary{}, ErrNoRules
+	}
+	return ValidateUpload(ctx, tx, uploadID, format.Rules)
+}
+
+// ListViolations returns a page of the violations recorded for an upload, by rule and row
+func ListViolations(ctx context.Context, tx *Tx, uploadID int64, limit, offset int) ([]Violation, error) {
+	query := `SELECT rule_index, column_name, row_id, value, severity, message
+	FROM core_validation_violations
+	WHERE raw_table_id = $1
+	ORDER BY rule_index, row_id NULLS FIRST, id
+	LIMIT $2 OFFSET $3`
+	rows, err := tx.QueryContext(ctx, query, uploadID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("error reading violations of upload %d: %w", uploadID, err)
+	}
+	defer rows.Close()
+
+	violations := []Violation{}
+	for rows.Next() {
+		var v Violation
+		if err := rows.Scan(&v.RuleIndex, &v.Column, &v.RowID, &v.Value, &v.Severity, &v.Message); err != nil {
+			return nil, fmt.Errorf("error reading violations of upload %d: %w", uploadID, err)
+		}
+		violations = append(violations, v)
+	}
+	return violations, rows.Err()
+}
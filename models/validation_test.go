@@ -0,0 +1,109 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestValidationRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ValidationRule
+		wantErr bool
+	}{
+		{"required", ValidationRule{Column: "id", Kind: RuleRequired}, false},
+		{"no column", ValidationRule{Kind: RuleRequired}, true},
+		{"unknown kind", ValidationRule{Column: "id", Kind: "positive"}, true},
+		{"bad severity", ValidationRule{Column: "id", Kind: RuleUnique, Severity: "fatal"}, true},
+		{"regex", ValidationRule{Column: "sku", Kind: RuleRegex, Pattern: `^[A-Z]{3}-\d+$`}, false},
+		{"bad regex", ValidationRule{Column: "sku", Kind: RuleRegex, Pattern: `(`}, true},
+		{"allowed without values", ValidationRule{Column: "country", Kind: RuleAllowed}, true},
+		{"numeric range", ValidationRule{Column: "price", Kind: RuleRange, Type: TypeNumeric, Min: "0", Max: "1e6"}, false},
+		{"upside down range", ValidationRule{Column: "price", Kind: RuleRange, Type: TypeNumeric, Min: "10", Max: "1"}, true},
+		{"range without bounds", ValidationRule{Column: "price", Kind: RuleRange, Type: TypeNumeric}, true},
+		{"range of text", ValidationRule{Column: "price", Kind: RuleRange, Type: TypeText, Min: "a"}, true},
+		{"date range", ValidationRule{Column: "placed", Kind: RuleRange, Type: TypeDate, Min: "2020-01-01"}, false},
+		{"impossible date", ValidationRule{Column: "placed", Kind: RuleRange, Type: TypeDate, Max: "2020-02-31"}, true},
+		{"timestamp range", ValidationRule{Column: "placed", Kind: RuleRange, Type: TypeTimestamp, Max: "2030-01-01 00:00"}, false},
+		{"compare columns", ValidationRule{Column: "end", Kind: RuleCompare, Type: TypeDate, Op: ">=", Other: "start"}, false},
+		{"compare to a date", ValidationRule{Column: "end", Kind: RuleCompare, Type: TypeDate, Op: "<", Value: "2023-02-28"}, false},
+		{"compare to an impossible date", ValidationRule{Column: "end", Kind: RuleCompare, Type: TypeDate, Op: "<", Value: "2023-02-30"}, true},
+		{"compare to text", ValidationRule{Column: "end", Kind: RuleCompare, Op: "=", Value: "2023-02-30"}, false},
+		{"compare both", ValidationRule{Column: "end", Kind: RuleCompare, Op: "=", Other: "start", Value: "x"}, true},
+		{"compare bad op", ValidationRule{Column: "end", Kind: RuleCompare, Op: "LIKE", Value: "x"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestViolationsQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     ValidationRule
+		other    string
+		want     string
+		wantArgs []interface{}
+	}{
+		{
+			name: "required",
+			rule: ValidationRule{Column: "id", Kind: RuleRequired},
+			want: `SELECT _id AS row_id, "c"::text AS value FROM "t" WHERE "c" IS NULL OR "c"::text = ''`,
+		},
+		{
+			name: "unique",
+			rule: ValidationRule{Column: "id", Kind: RuleUnique},
+			want: `SELECT row_id, value FROM (SELECT _id AS row_id, "c"::text AS value, count(*) OVER (PARTITION BY "c"::text) AS n FROM "t") t WHERE value <> '' AND n > 1`,
+		},
+		{
+			name:     "numeric range",
+			rule:     ValidationRule{Column: "price", Kind: RuleRange, Type: TypeNumeric, Min: "0"},
+			want:     `SELECT _id AS row_id, "c"::text AS value FROM "t" WHERE "c" IS NOT NULL AND "c"::text <> '' AND (CASE WHEN "c"::text ~ $1 THEN core_try_numeric("c"::text) END IS NULL OR CASE WHEN "c"::text ~ $1 THEN core_try_numeric("c"::text) END < $2::numeric)`,
+			wantArgs: []interface{}{numericPattern, "0"},
+		},
+		{
+			// 2023-02-30 matches the pattern, and core_try_date makes it NULL, a violation, rather than an error
+			name:     "date range",
+			rule:     ValidationRule{Column: "placed", Kind: RuleRange, Type: TypeDate, Max: "2023-12-31"},
+			want:     `SELECT _id AS row_id, "c"::text AS value FROM "t" WHERE "c" IS NOT NULL AND "c"::text <> '' AND (CASE WHEN "c"::text ~ $1 THEN core_try_date("c"::text) END IS NULL OR CASE WHEN "c"::text ~ $1 THEN core_try_date("c"::text) END > $2::date)`,
+			wantArgs: []interface{}{datePattern, "2023-12-31"},
+		},
+		{
+			name:  "compare dates",
+			rule:  ValidationRule{Column: "end", Kind: RuleCompare, Type: TypeDate, Op: ">=", Other: "start"},
+			other: `"o"`,
+			want: `SELECT _id AS row_id, "c"::text AS value FROM "t" WHERE "c"::text <> '' AND CASE WHEN "c"::text ~ $1 THEN core_try_date("c"::text) END IS NULL` +
+				` OR "o"::text <> '' AND CASE WHEN "o"::text ~ $2 THEN core_try_date("o"::text) END IS NULL` +
+				` OR CASE WHEN "c"::text ~ $1 THEN core_try_date("c"::text) END IS NOT NULL AND CASE WHEN "o"::text ~ $2 THEN core_try_date("o"::text) END IS NOT NULL` +
+				` AND NOT (CASE WHEN "c"::text ~ $1 THEN core_try_date("c"::text) END >= CASE WHEN "o"::text ~ $2 THEN core_try_date("o"::text) END)`,
+			wantArgs: []interface{}{datePattern, datePattern},
+		},
+		{
+			name:     "compare columns",
+			rule:     ValidationRule{Column: "end", Kind: RuleCompare, Op: ">=", Other: "start"},
+			other:    `"o"`,
+			want:     `SELECT _id AS row_id, "c"::text AS value FROM "t" WHERE "c"::text IS NOT NULL AND "o"::text IS NOT NULL AND NOT ("c"::text >= "o"::text)`,
+			wantArgs: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []interface{}
+			arg := func(v interface{}) string {
+				args = append(args, v)
+				return fmt.Sprintf("$%d", len(args))
+			}
+			if got := violationsQuery(tt.rule, `"t"`, `"c"`, tt.other, arg); got != tt.want {
+				t.Errorf("violationsQuery() =\n%s\nwant\n%s", got, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("violationsQuery() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
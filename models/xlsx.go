@@ -0,0 +1,469 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sheet is a non-empty worksheet of an uploaded workbook. Every row has a cell for each
+// column of the sheet, and rows with no values are left out.
+type Sheet struct {
+	Name string
+	Rows [][]Cell
+}
+
+// Cell is a worksheet cell written in the form Postgres reads its type in:
+// numbers as they are stored, dates as 2006-01-02, booleans as true and false.
+// Type is empty for empty cells.
+type Cell struct {
+	Value string
+	Type  ColumnType
+}
+
+type xlsxWorkbook struct {
+	Properties struct {
+		Date1904 string `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"id,attr"` // r:id
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxRichText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (rt xlsxRichText) text() string {
+	if len(rt.Runs) == 0 {
+		return rt.T
+	}
+	var b strings.Builder
+	for _, run := range rt.Runs {
+		b.WriteString(run.T)
+	}
+	return b.String()
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxRichText `xml:"si"`
+}
+
+type xlsxStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		Cells []xlsxCell `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+type xlsxCell struct {
+	Ref    string       `xml:"r,attr"`
+	Type   string       `xml:"t,attr"`
+	Style  int          `xml:"s,attr"`
+	Value  string       `xml:"v"`
+	Inline xlsxRichText `xml:"is"`
+}
+
+type numFmtKind int
+
+const (
+	numFmtNumber numFmtKind = iota
+	numFmtDate
+	numFmtTime // time of day or duration, without a date
+)
+
+// Built in number formats that show dates or times. 27-36 and 50-58 are dates in East Asian locales.
+var builtInNumFmts = map[int]numFmtKind{
+	14: numFmtDate, 15: numFmtDate, 16: numFmtDate, 17: numFmtDate, 22: numFmtDate,
+	18: numFmtTime, 19: numFmtTime, 20: numFmtTime, 21: numFmtTime, 45: numFmtTime, 46: numFmtTime, 47: numFmtTime,
+	27: numFmtDate, 28: numFmtDate, 29: numFmtDate, 30: numFmtDate, 31: numFmtDate, 32: numFmtDate, 33: numFmtDate,
+	34: numFmtDate, 35: numFmtDate, 36: numFmtDate, 50: numFmtDate, 51: numFmtDate, 52: numFmtDate, 53: numFmtDate,
+	54: numFmtDate, 55: numFmtDate, 56: numFmtDate, 57: numFmtDate, 58: numFmtDate,
+}
+
+// Parts of a format code that are shown as they are: quoted text, escaped characters,
+// padding, and [colours] or [$-409] locales
+var numFmtLiteralRe = regexp.MustCompile(`"[^"]*"|\\.|_.|\*.|\[[^\]]*\]`)
+
+// classifyNumFmt says whether a custom number format code shows a date, a time or a number
+func classifyNumFmt(code string) numFmtKind {
+	code = strings.ToLower(strings.SplitN(code, ";", 2)[0])
+	elapsed := strings.Contains(code, "[h") || strings.Contains(code, "[m") || strings.Contains(code, "[s")
+	code = numFmtLiteralRe.ReplaceAllString(code, "")
+	switch {
+	case strings.ContainsAny(code, "yd"):
+		return numFmtDate
+	case elapsed || strings.ContainsAny(code, "hs"):
+		return numFmtTime
+	case strings.Contains(code, "m"):
+		return numFmtDate // months, as minutes are only shown next to hours or seconds
+	}
+	return numFmtNumber
+}
+
+// workbook holds what is shared by the sheets of a workbook while they are read
+type workbook struct {
+	zip      *zip.Reader
+	date1904 bool
+	shared   []string
+	formats  []numFmtKind // by cell style index
+}
+
+// IsWorkbook says whether r is an Excel workbook (.xlsx)
+func IsWorkbook(r io.ReaderAt, size int64) bool {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return false
+	}
+	for _, f := range zr.File {
+		if f.Name == "xl/workbook.xml" {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadWorkbook reads the non-empty worksheets of an Excel workbook in workbook order
+func ReadWorkbook(r io.ReaderAt, size int64) ([]Sheet, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("error opening workbook: %w", err)
+	}
+	wb := &workbook{zip: zr}
+
+	var book xlsxWorkbook
+	if err := wb.decode("xl/workbook.xml", &book); err != nil {
+		return nil, err
+	}
+	wb.date1904 = book.Properties.Date1904 == "1" || book.Properties.Date1904 == "true"
+
+	var rels xlsxRelationships
+	if err := wb.decode("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	targets := map[string]string{}
+	for _, rel := range rels.Relationships {
+		if strings.HasPrefix(rel.Target, "/") {
+			targets[rel.ID] = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			targets[rel.ID] = path.Join("xl", rel.Target)
+		}
+	}
+
+	var shared xlsxSharedStrings
+	if err := wb.decodeOptional("xl/sharedStrings.xml", &shared); err != nil {
+		return nil, err
+	}
+	for _, item := range shared.Items {
+		wb.shared = append(wb.shared, item.text())
+	}
+
+	var styles xlsxStyles
+	if err := wb.decodeOptional("xl/styles.xml", &styles); err != nil {
+		return nil, err
+	}
+	custom := map[int]numFmtKind{}
+	for _, format := range styles.NumFmts {
+		custom[format.ID] = classifyNumFmt(format.Code)
+	}
+	for _, xf := range styles.CellXfs {
+		kind, ok := custom[xf.NumFmtID]
+		if !ok {
+			kind = builtInNumFmts[xf.NumFmtID]
+		}
+		wb.formats = append(wb.formats, kind)
+	}
+
+	sheets := []Sheet{}
+	for _, s := range book.Sheets {
+		target, ok := targets[s.RID]
+		if !ok {
+			return nil, fmt.Errorf("error reading workbook: sheet %q has no part", s.Name)
+		}
+		sheet, err := wb.readSheet(s.Name, target)
+		if err != nil {
+			return nil, err
+		}
+		if len(sheet.Rows) > 0 {
+			sheets = append(sheets, sheet)
+		}
+	}
+	return sheets, nil
+}
+
+func (wb *workbook) readSheet(name, part string) (Sheet, error) {
+	var ws xlsxWorksheet
+	if err := wb.decode(part, &ws); err != nil {
+		return Sheet{}, err
+	}
+	sheet := Sheet{Name: name}
+	width := 0
+	for _, row := range ws.Rows {
+		cells := []Cell{}
+		filled := false
+		for _, c := range row.Cells {
+			col := len(cells)
+			if c.Ref != "" {
+				col = columnIndex(c.Ref)
+			}
+			for len(cells) <= col {
+				cells = append(cells, Cell{})
+			}
+			cells[col] = wb.cell(c)
+			filled = filled || cells[col].Type != ""
+		}
+		if !filled {
+			continue
+		}
+		if len(cells) > width {
+			width = len(cells)
+		}
+		sheet.Rows = append(sheet.Rows, cells)
+	}
+	for i, row := range sheet.Rows {
+		for len(row) < width {
+			row = append(row, Cell{})
+		}
+		sheet.Rows[i] = row
+	}
+	return sheet, nil
+}
+
+// cell converts a worksheet cell from how it is stored to the form it is loaded in
+func (wb *workbook) cell(c xlsxCell) Cell {
+	var text string
+	switch c.Type {
+	case "s":
+		i, err := strconv.Atoi(c.Value)
+		if err != nil || i < 0 || i >= len(wb.shared) {
+			return Cell{}
+		}
+		text = wb.shared[i]
+	case "inlineStr":
+		text = c.Inline.text()
+	case "str": // result of a formula
+		text = c.Value
+	case "b":
+		return Cell{Value: strconv.FormatBool(c.Value == "1"), Type: TypeBoolean}
+	case "e": // #DIV/0! and other formula errors
+		return Cell{}
+	case "d":
+		t, err := time.Parse("2006-01-02T15:04:05.999999999", strings.TrimSuffix(c.Value, "Z"))
+		if err != nil {
+			text = c.Value
+			break
+		}
+		return timeCell(t)
+	default:
+		if c.Value == "" {
+			return Cell{}
+		}
+		f, err := strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			text = c.Value
+			break
+		}
+		kind := numFmtNumber
+		if c.Style >= 0 && c.Style < len(wb.formats) {
+			kind = wb.formats[c.Style]
+		}
+		switch kind {
+		case numFmtDate:
+			return timeCell(excelTime(f, wb.date1904))
+		case numFmtTime:
+			return Cell{Value: excelTime(f, false).Format("15:04:05"), Type: TypeText}
+		}
+		if strings.ContainsAny(c.Value, "eE") {
+			return Cell{Value: strconv.FormatFloat(f, 'f', -1, 64), Type: TypeNumeric}
+		}
+		return Cell{Value: c.Value, Type: TypeNumeric}
+	}
+	if text == "" {
+		return Cell{}
+	}
+	return Cell{Value: text, Type: TypeText}
+}
+
+func timeCell(t time.Time) Cell {
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+		return Cell{Value: t.Format("2006-01-02"), Type: TypeDate}
+	}
+	return Cell{Value: t.Format("2006-01-02 15:04:05.999"), Type: TypeTimestamp}
+}
+
+// excelTime converts a date serial number, days since the workbook's epoch, to a time
+func excelTime(serial float64, date1904 bool) time.Time {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if date1904 {
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	} else if serial < 61 {
+		epoch = epoch.AddDate(0, 0, 1) // Excel counts 29 February 1900, which didn't happen
+	}
+	days := math.Floor(serial)
+	ms := math.Round((serial - days) * 24 * 60 * 60 * 1000)
+	return epoch.AddDate(0, 0, int(days)).Add(time.Duration(ms) * time.Millisecond)
+}
+
+// columnIndex returns the zero based column of a cell reference such as AB12
+func columnIndex(ref string) int {
+	col := 0
+	for _, c := range strings.ToUpper(ref) {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		col = col*26 + int(c-'A'+1)
+	}
+	return col - 1
+}
+
+func (wb *workbook) decode(name string, v interface{}) error {
+	for _, f := range wb.zip.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("error reading workbook part %s: %w", name, err)
+		}
+		defer rc.Close()
+		if err := xml.NewDecoder(rc).Decode(v); err != nil {
+			return fmt.Errorf("error reading workbook part %s: %w", name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("error reading workbook: %s is missing", name)
+}
+
+func (wb *workbook) decodeOptional(name string, v interface{}) error {
+	for _, f := range wb.zip.File {
+		if f.Name == name {
+			return wb.decode(name, v)
+		}
+	}
+	return nil
+}
+
+// Values returns the text of each cell of the rows
+func (s Sheet) Values() [][]string {
+	values := make([][]string, len(s.Rows))
+	for i, row := range s.Rows {
+		values[i] = make([]string, len(row))
+		for j, cell := range row {
+			values[i][j] = cell.Value
+		}
+	}
+	return values
+}
+
+// DetectLayout looks for a title and a header row at the top of the sheet.
+// The offset counts the non-empty rows before the table.
+func (s Sheet) DetectLayout() HeaderLayout {
+	lines := make([]int, len(s.Rows))
+	for i := range lines {
+		lines[i] = i + 1
+	}
+	return DetectLayout(s.Values(), lines, DefaultParsingProfile)
+}
+
+// InferCellTypes picks a type for each column from the types of its cells
+func InferCellTypes(rows [][]Cell, opts TypeInferenceOptions) []InferredType {
+	width := 0
+	for _, row := range rows {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+	types := make([]InferredType, width)
+	for col := range types {
+		types[col] = InferredType{Type: TypeText, Confidence: 1}
+		if opts.Disabled {
+			continue
+		}
+		counts := map[ColumnType]int{}
+		nonEmpty, integerType := 0, TypeInteger
+		for _, row := range rows {
+			if col >= len(row) || row[col].Type == "" {
+				continue
+			}
+			cell := row[col]
+			nonEmpty++
+			counts[cell.Type]++
+			if cell.Type != TypeNumeric || integerType == TypeNumeric {
+				continue
+			}
+			if _, err := strconv.ParseInt(cell.Value, 10, 32); err != nil {
+				integerType = TypeBigint
+				if _, err := strconv.ParseInt(cell.Value, 10, 64); err != nil {
+					integerType = TypeNumeric
+				}
+			}
+		}
+		if nonEmpty == 0 || nonEmpty < opts.MinValues {
+			continue
+		}
+		dateType, dates := TypeDate, counts[TypeDate]
+		if counts[TypeTimestamp] > 0 {
+			dateType, dates = TypeTimestamp, dates+counts[TypeTimestamp]
+		}
+		candidates := []InferredType{
+			{Type: TypeBoolean, Confidence: float64(counts[TypeBoolean]) / float64(nonEmpty)},
+			{Type: integerType, Confidence: float64(counts[TypeNumeric]) / float64(nonEmpty)},
+			{Type: dateType, Confidence: float64(dates) / float64(nonEmpty)},
+		}
+		for _, candidate := range candidates {
+			if candidate.Confidence >= opts.Confidence {
+				types[col] = candidate
+				break
+			}
+		}
+	}
+	return types
+}
+
+// FitCellTypes makes text of the columns with a value that can't be loaded as their inferred
+// type, which a confidence below 1 allows, so no value is lost
+func FitCellTypes(rows [][]Cell, types []InferredType) []InferredType {
+	fitted := append([]InferredType(nil), types...)
+	for col, t := range fitted {
+		if t.Type == TypeText {
+			continue
+		}
+		for _, row := range rows {
+			if col >= len(row) {
+				continue
+			}
+			if _, err := DefaultParsingProfile.Convert(t.Type, row[col].Value); err != nil {
+				fitted[col] = InferredType{Type: TypeText, Confidence: 1}
+				break
+			}
+		}
+	}
+	return fitted
+}
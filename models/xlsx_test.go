@@ -0,0 +1,145 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestWorkbook(t *testing.T, parts map[string]string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range parts {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestReadWorkbook(t *testing.T) {
+	r := newTestWorkbook(t, map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+			<sheets><sheet name="Orders" sheetId="1" r:id="rId1"/><sheet name="Empty" sheetId="2" r:id="rId2"/><sheet name="Notes" sheetId="3" r:id="rId3"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+			<Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Target="worksheets/sheet2.xml"/><Relationship Id="rId3" Target="/xl/worksheets/sheet3.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>id</t></si><si><t>ordered</t></si><si><r><t>pa</t></r><r><t>id</t></r></si><si><t>00123</t></si></sst>`,
+		"xl/styles.xml": `<styleSheet><numFmts><numFmt numFmtId="164" formatCode="dd/mm/yyyy\ hh:mm"/><numFmt numFmtId="165" formatCode="#,##0.00 &quot;EUR&quot;"/></numFmts>
+			<cellXfs><xf numFmtId="0"/><xf numFmtId="14"/><xf numFmtId="164"/><xf numFmtId="165"/><xf numFmtId="20"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>
+			<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="C1" t="s"><v>2</v></c><c r="D1" t="inlineStr"><is><t>total</t></is></c></row>
+			<row r="2"><c r="A2" t="s"><v>3</v></c><c r="B2" s="1"><v>45000</v></c><c r="C2" t="b"><v>1</v></c><c r="D2" s="3"><v>1.5E3</v></c></row>
+			<row r="3"><c r="A3"/></row>
+			<row r="4"><c r="B4" s="2"><v>45000.5</v></c><c r="D4" t="e"><v>#DIV/0!</v></c><c r="E4" s="4"><v>0.75</v></c></row>
+		</sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet><sheetData/></worksheet>`,
+		"xl/worksheets/sheet3.xml": `<worksheet><sheetData><row><c t="str"><v>note</v></c></row></sheetData></worksheet>`,
+	})
+	if !IsWorkbook(r, r.Size()) {
+		t.Fatal("IsWorkbook() = false")
+	}
+	sheets, err := ReadWorkbook(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Sheet{
+		{Name: "Orders", Rows: [][]Cell{
+			{{"id", TypeText}, {"ordered", TypeText}, {"paid", TypeText}, {"total", TypeText}, {}},
+			{{"00123", TypeText}, {"2023-03-15", TypeDate}, {"true", TypeBoolean}, {"1500", TypeNumeric}, {}},
+			{{}, {"2023-03-15 12:00:00", TypeTimestamp}, {}, {}, {"18:00:00", TypeText}},
+		}},
+		{Name: "Notes", Rows: [][]Cell{{{"note", TypeText}}}},
+	}
+	if !reflect.DeepEqual(sheets, want) {
+		t.Errorf("ReadWorkbook() = %v, want %v", sheets, want)
+	}
+}
+
+func TestIsWorkbook(t *testing.T) {
+	r := newTestWorkbook(t, map[string]string{"data.csv": "a,b\n"})
+	if IsWorkbook(r, r.Size()) {
+		t.Error("IsWorkbook() = true for a zip of CSV files")
+	}
+}
+
+func TestClassifyNumFmt(t *testing.T) {
+	tests := []struct {
+		code string
+		want numFmtKind
+	}{
+		{"General", numFmtNumber},
+		{"0.00E+00", numFmtNumber},
+		{`#,##0 "days"`, numFmtNumber},
+		{"[Red]#,##0.00", numFmtNumber},
+		{"yyyy-mm-dd", numFmtDate},
+		{"[$-409]mmm yy", numFmtDate},
+		{"mmmm", numFmtDate},
+		{"h:mm AM/PM", numFmtTime},
+		{"[h]:mm", numFmtTime},
+		{"mm:ss", numFmtTime},
+	}
+	for _, tt := range tests {
+		if got := classifyNumFmt(tt.code); got != tt.want {
+			t.Errorf("classifyNumFmt(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestExcelTime(t *testing.T) {
+	tests := []struct {
+		serial   float64
+		date1904 bool
+		want     time.Time
+	}{
+		{1, false, time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{61, false, time.Date(1900, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{45000.25, false, time.Date(2023, 3, 15, 6, 0, 0, 0, time.UTC)},
+		{0, true, time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := excelTime(tt.serial, tt.date1904); !got.Equal(tt.want) {
+			t.Errorf("excelTime(%v, %v) = %v, want %v", tt.serial, tt.date1904, got, tt.want)
+		}
+	}
+}
+
+func TestInferCellTypes(t *testing.T) {
+	rows := [][]Cell{
+		{{"1", TypeNumeric}, {"1.5", TypeNumeric}, {"3000000000", TypeNumeric}, {"2023-01-02", TypeDate}, {"2023-01-02", TypeDate}, {"true", TypeBoolean}, {"x", TypeText}},
+		{{"2", TypeNumeric}, {"2", TypeNumeric}, {"1", TypeNumeric}, {"2023-01-03", TypeDate}, {"2023-01-03 10:00:00", TypeTimestamp}, {}, {"3", TypeNumeric}},
+	}
+	got := InferCellTypes(rows, DefaultTypeInferenceOptions)
+	want := []InferredType{
+		{TypeInteger, 1}, {TypeNumeric, 1}, {TypeBigint, 1}, {TypeDate, 1}, {TypeTimestamp, 1}, {TypeBoolean, 1}, {TypeText, 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("InferCellTypes() = %v, want %v", got, want)
+	}
+	got = InferCellTypes(rows, TypeInferenceOptions{Confidence: 0.5, MinValues: 1})
+	if got[6] != (InferredType{TypeInteger, 0.5}) {
+		t.Errorf("InferCellTypes() with confidence 0.5 = %v for the mixed column", got[6])
+	}
+}
+
+func TestFitCellTypes(t *testing.T) {
+	rows := [][]Cell{
+		{{"1", TypeNumeric}, {"x", TypeText}, {"2023-01-02", TypeDate}},
+		{{}, {"3", TypeNumeric}, {"2023-01-03", TypeDate}},
+	}
+	types := InferCellTypes(rows, TypeInferenceOptions{Confidence: 0.5, MinValues: 1})
+	want := []InferredType{{TypeInteger, 1}, {TypeText, 1}, {TypeDate, 1}}
+	if got := FitCellTypes(rows, types); !reflect.DeepEqual(got, want) {
+		t.Errorf("FitCellTypes() = %v, want %v, with the column holding x as text", got, want)
+	}
+	if types[1] != (InferredType{TypeInteger, 0.5}) {
+		t.Errorf("FitCellTypes() changed the inferred types to %v", types)
+	}
+}
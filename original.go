@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+// fetchOriginalFile sends a file back byte for byte as it was uploaded, compressed or not
+func (env *Env) fetchOriginalFile(w http.ResponseWriter, r *http.Request) {
+	id, ok := fileIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	filename, saved, err := env.upload.StoredFile(r.Context(), id)
+	if errors.Is(err, models.ErrNotStored) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeLifecycleError(w, err)
+		return
+	}
+	blob, err := env.files.Open(r.Context(), saved)
+	if errors.Is(err, models.ErrBlobNotFound) {
+		log.Printf("Stored file %s of upload %d is missing", saved, id)
+		http.Error(w, "The stored file is missing", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error opening stored file:", err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	// The content never changes under its name, which ends with its hash, so that's a strong ETag
+	etag := `"` + path.Base(saved) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("ETag", etag)
+	if !blob.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", blob.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if blob.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(blob.Size, 10))
+	}
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("Error sending stored file %s: %v", saved, err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nickcoast/gocsv/models"
+)
+
+// Resumable uploads go through these steps, so a large file sent over a flaky connection
+// doesn't have to start over when it drops:
+//
+//	POST   /uploads               filename, and optionally size and sha256 of the whole file
+//	HEAD   /uploads/{id}          Upload-Offset says how much has been received
+//	PATCH  /uploads/{id}          the next chunk as the body, sent at the Upload-Offset header
+//	POST   /uploads/{id}/finalize the import options of POST /upload, and sha256 if it wasn't given up front
+//	DELETE /uploads/{id}
+//
+// An upload that goes without a chunk for resumableUploadTTL is deleted.
+const (
+	resumableUploadDir    = "uploads/partial"
+	resumableUploadTTL    = 24 * time.Hour
+	resumableExpiryPeriod = time.Hour
+)
+
+// expireResumableUploads deletes abandoned resumable uploads every period until the program exits
+func expireResumableUploads(store *models.ResumableStore, period time.Duration) {
+	for now := range time.Tick(period) {
+		expired, err := store.Expire(now)
+		if err != nil {
+			log.Println("Error expiring resumable uploads:", err)
+			continue
+		}
+		if expired > 0 {
+			log.Println("Expired resumable uploads:", expired)
+		}
+	}
+}
+
+func writeResumableUpload(w http.ResponseWriter, status int, upload models.ResumableUpload) {
+	setUploadOffset(w, upload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(upload)
+}
+
+func setUploadOffset(w http.ResponseWriter, upload models.ResumableUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if upload.Size > 0 {
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// writeResumableError reports an error with a resumable upload to the client
+func writeResumableError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidUpload):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, models.ErrUploadNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, models.ErrUploadBusy):
+		http.Error(w, err.Error(), http.StatusLocked)
+	case errors.Is(err, models.ErrOffsetMismatch):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, models.ErrUploadTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, models.ErrUploadIncomplete):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println("Error with resumable upload:", err)
+		http.Error(w, "Error with resumable upload", http.StatusInternalServerError)
+	}
+}
+
+// createResumableUpload starts a resumable upload from the form fields filename, size and sha256
+func (env *Env) createResumableUpload(w http.ResponseWriter, r *http.Request) {
+	filename := r.PostFormValue("filename")
+	if filename == "" {
+		http.Error(w, "No filename", http.StatusBadRequest)
+		return
+	}
+	var size int64
+	if value := r.PostFormValue("size"); value != "" {
+		var err error
+		size, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+	upload, err := env.resumable.Create(filename, size, r.PostFormValue("sha256"))
+	if err != nil {
+		writeResumableError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/uploads/"+upload.ID)
+	writeResumableUpload(w, http.StatusCreated, upload)
+}
+
+// fetchResumableUpload reports how much of an upload has been received, in the Upload-Offset
+// header, and describes it in the body unless it's a HEAD request
+func (env *Env) fetchResumableUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := env.resumable.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeResumableError(w, err)
+		return
+	}
+	writeResumableUpload(w, http.StatusOK, upload)
+}
+
+// appendResumableUpload writes the request body to an upload at the Upload-Offset header.
+// What was received is kept even if the connection drops, so the client can resume from it.
+func (env *Env) appendResumableUpload(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+	upload, err := env.resumable.Append(mux.Vars(r)["id"], offset, r.Body)
+	if err != nil {
+		if upload.ID != "" {
+			setUploadOffset(w, upload)
+		}
+		writeResumableError(w, err)
+		return
+	}
+	setUploadOffset(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeResumableUpload checks a complete upload against its checksum and imports it like
+// POST /upload. The upload is kept if the import fails, so it can be finalized again.
+func (env *Env) finalizeResumableUpload(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	upload, err := env.resumable.Get(id)
+	if err != nil {
+		writeResumableError(w, err)
+		return
+	}
+	if err := r.ParseMultipartForm(maxFormValueBytes); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Error reading form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	checksum := strings.ToLower(r.PostFormValue("sha256"))
+	if checksum == "" {
+		checksum = upload.SHA256
+	}
+	if checksum == "" {
+		http.Error(w, "No sha256 checksum to check the upload against", http.StatusBadRequest)
+		return
+	}
+
+	// No chunk can be added until Finish, so what's imported is what was checked
+	file, err := env.resumable.Open(id)
+	if err != nil {
+		writeResumableError(w, err)
+		return
+	}
+	imported := false
+	defer func() {
+		// Once imported, the data has been copied into the file store and the upload's own copy can go
+		if err := env.resumable.Finish(id, file, imported); err != nil {
+			log.Println("Error finishing resumable upload:", err)
+		}
+	}()
+	if file.Hash != checksum {
+		http.Error(w, "The upload doesn't match its sha256 checksum", http.StatusUnprocessableEntity)
+		return
+	}
+	imported = importUpload(w, r, env.upload.DB, env.files, file)
+}
+
+func (env *Env) deleteResumableUpload(w http.ResponseWriter, r *http.Request) {
+	if err := env.resumable.Delete(mux.Vars(r)["id"]); err != nil {
+		writeResumableError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
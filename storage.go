@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+// Uploaded files are stored in uploadDir unless STORAGE_BACKEND is s3, when they're stored in an
+// S3 compatible bucket that every instance can reach:
+//
+//	S3_ENDPOINT           scheme and host, e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+//	S3_REGION             us-east-1 if it's left out
+//	S3_BUCKET
+//	S3_PREFIX             optional key prefix
+//	S3_PATH_STYLE         true to put the bucket in the path, as MinIO needs
+//	S3_ACCESS_KEY_ID
+//	S3_SECRET_ACCESS_KEY  from the environment or Vault
+const uploadDir = "uploads"
+
+func blobStoreFromEnv() (models.BlobStore, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		return models.NewLocalBlobStore(uploadDir)
+	case "s3":
+		config := models.S3Config{
+			Endpoint:    os.Getenv("S3_ENDPOINT"),
+			Region:      os.Getenv("S3_REGION"),
+			Bucket:      os.Getenv("S3_BUCKET"),
+			Prefix:      os.Getenv("S3_PREFIX"),
+			AccessKeyID: os.Getenv("S3_ACCESS_KEY_ID"),
+		}
+		if value := os.Getenv("S3_PATH_STYLE"); value != "" {
+			pathStyle, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid S3_PATH_STYLE %q", value)
+			}
+			config.PathStyle = pathStyle
+		}
+		secret, err := getSecret("S3_SECRET_ACCESS_KEY")
+		if err != nil {
+			return nil, err
+		}
+		config.SecretAccessKey = secret
+		return models.NewS3BlobStore(config)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q, want local or s3", backend)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Romanisation of Cyrillic (Russian, Ukrainian, Belarusian, Serbian and Macedonian letters),
+// loosely following BGN/PCGN without diacritics
+var cyrillicToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g", 'ў': "u", 'ђ': "dj", 'ј': "j",
+	'љ': "lj", 'њ': "nj", 'ћ': "c", 'џ': "dz", 'ѓ': "gj", 'ќ': "kj", 'ѕ': "dz",
+}
+
+// Romanisation of modern Greek, after ELOT 743 without diacritics
+var greekToLatin = map[rune]string{
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps",
+	'ω': "o",
+}
+
+// Latin letters that don't decompose into a base letter and combining marks
+var latinSpecials = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'ł': "l", 'þ': "th",
+	'ı': "i", 'ħ': "h", 'ŋ': "ng",
+}
+
+// transliterate rewrites letters from other scripts in Latin letters so that they survive
+// toPostgreSQLName's ASCII clean up. Cyrillic and Greek are romanised; letters and digits of
+// scripts without a romanisation, such as CJK, Arabic and Hangul, are named by code point
+// (价格 becomes u4ef7_u683c), which is stable and unique if not pretty. Accented Latin letters
+// are left for the NFD step to strip.
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		lower := unicode.ToLower(r)
+		if latin, ok := romanise(lower); ok {
+			b.WriteString(latin)
+			continue
+		}
+		// Accented Greek and Cyrillic letters romanise as their base letter
+		if base := []rune(norm.NFD.String(string(lower))); len(base) > 1 {
+			if latin, ok := romanise(base[0]); ok {
+				b.WriteString(latin)
+				continue
+			}
+		}
+		if r <= unicode.MaxASCII || unicode.Is(unicode.Latin, r) || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			b.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&b, "_u%04x_", r)
+	}
+	return b.String()
+}
+
+func romanise(r rune) (string, bool) {
+	for _, table := range []map[rune]string{cyrillicToLatin, greekToLatin, latinSpecials} {
+		if latin, ok := table[r]; ok {
+			return latin, true
+		}
+	}
+	return "", false
+}
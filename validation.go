@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nickcoast/gocsv/models"
+)
+
+// Page size of the violations listed for an upload
+const (
+	defaultViolationsLimit = 100
+	maxViolationsLimit     = 1000
+)
+
+// validateFile runs the validation rules of an upload's import format on it again and returns
+// the summary. The violations found before are replaced.
+func (env *Env) validateFile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	tx, err := env.upload.DB.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	summary, err := models.ValidateUploadFormat(ctx, tx, id)
+	switch {
+	case errors.Is(err, models.ErrNoTable), errors.Is(err, models.ErrNoFormat), errors.Is(err, models.ErrNoRules):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		log.Println("Error validating upload:", err)
+		http.Error(w, "Error validating data", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Error committing transaction", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// fetchViolations lists the cells of an upload that broke validation rules, by rule and row.
+// The query parameters limit and offset page through them.
+func (env *Env) fetchViolations(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	limit, offset, err := pageFromQuery(r, defaultViolationsLimit, maxViolationsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	tx, err := env.upload.DB.BeginTx(ctx)
+	if err != nil {
+		http.Error(w, "Error starting transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	violations, err := models.ListViolations(ctx, tx, id, limit, offset)
+	if err != nil {
+		log.Println("Error reading violations:", err)
+		http.Error(w, "Error reading violations", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"limit":      limit,
+		"offset":     offset,
+		"violations": violations,
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nickcoast/gocsv/models"
+)
+
+var errEmptyWorkbook = errors.New("the workbook has no sheets with data")
+
+// importWorkbookFile records an Excel workbook in core_raw_tables and loads its worksheets
+func importWorkbookFile(ctx context.Context, tx *models.Tx, r *http.Request, file *models.File) (map[string]interface{}, error) {
+	load, err := tableLoadFromForm(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Workbooks are only compared as they are
+	hashes := models.FileHashes{Hash: file.Hash}
+	duplicate, link, err := checkDuplicate(ctx, tx, r, hashes)
+	if err != nil {
+		return nil, err
+	}
+	if link {
+		return linkDuplicate(ctx, tx, file, hashes, nil, duplicate)
+	}
+
+	// The workbook's row has no table of its own, each sheet's table is recorded under it
+	query := "INSERT INTO core_raw_tables (source_filename, file_size, datetime_uploaded, file_hash, compression) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+	var uploadID int64
+	err = tx.QueryRowContext(ctx, query, file.Header.Filename, file.Header.Size, time.Now(), file.Hash, nullableString(file.Compression)).Scan(&uploadID)
+	if err != nil {
+		return nil, failedUpload("Failed to save file information to the database", fmt.Errorf("error saving workbook: %w", err))
+	}
+	tables, err := importWorkbook(ctx, tx, *file, uploadID, load)
+	if errors.Is(err, errEmptyWorkbook) {
+		return nil, badUpload("Error importing workbook: " + err.Error())
+	}
+	if err != nil {
+		return nil, failedUpload("Error importing workbook", err)
+	}
+	imported := map[string]interface{}{"id": uploadID, "tables": tables}
+	if duplicate != nil {
+		imported["duplicate"] = duplicate
+	}
+	return imported, nil
+}
+
+// importWorkbook loads each non-empty worksheet of an Excel workbook into its own raw table,
+// recorded in core_raw_tables under the upload's row. Cells are loaded by their own types,
+// so the upload's parsing profile doesn't apply.
+func importWorkbook(ctx context.Context, tx *models.Tx, file models.File, uploadID int64, load tableLoad) ([]map[string]interface{}, error) {
+	sheets, err := models.ReadWorkbook(file.File, file.Header.Size)
+	if err != nil {
+		return nil, err
+	}
+	if len(sheets) == 0 {
+		return nil, errEmptyWorkbook
+	}
+
+	tables := []map[string]interface{}{}
+	for _, sheet := range sheets {
+		layout := sheet.DetectLayout()
+		rows := sheet.Rows[layout.Offset:]
+		var headers []string
+		if layout.HasHeader {
+			for _, cell := range rows[0] {
+				headers = append(headers, cell.Value)
+			}
+			rows = rows[1:]
+		}
+
+		id, tableName, err := insertSheetTable(ctx, tx, file, uploadID, sheet.Name, layout)
+		if err != nil {
+			return nil, err
+		}
+		columns, loaded, err := loadCellTable(ctx, tx, id, tableName, headers, rows, layout.HasHeader, load)
+		if err != nil {
+			return nil, fmt.Errorf("error loading sheet %q: %w", sheet.Name, err)
+		}
+
+		table := map[string]interface{}{
+			"id":      id,
+			"table":   tableName,
+			"sheet":   sheet.Name,
+			"layout":  layout,
+			"columns": columns,
+		}
+		loaded.addTo(table)
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// tableLoad is how the cells of a workbook or JSON upload are loaded into raw tables
+type tableLoad struct {
+	typeOpts models.TypeInferenceOptions
+	dedup    bool // make a deduplicated companion of each table
+}
+
+func tableLoadFromForm(r *http.Request) (tableLoad, error) {
+	typeOpts, err := typeInferenceOptionsFromForm(r)
+	if err != nil {
+		return tableLoad{}, badUpload("Invalid type inference options: " + err.Error())
+	}
+	dedup, err := dedupTableFromForm(r)
+	if err != nil {
+		return tableLoad{}, badUpload(err.Error())
+	}
+	return tableLoad{typeOpts: typeOpts, dedup: dedup}, nil
+}
+
+// loadCellTable creates the raw table of rows of typed cells, records its columns under id,
+// loads the rows and records how many there were. The columns are named by position if
+// headers is nil. hasHeader says whether the headers came from a row of the upload.
+func loadCellTable(ctx context.Context, tx *models.Tx, id int64, tableName string, headers []string, rows [][]models.Cell, hasHeader bool, load tableLoad) ([]models.Column, loadedRows, error) {
+	headerLengths := make([]int, len(headers))
+	for i, header := range headers {
+		headerLengths[i] = len(header)
+	}
+	maxLengths := make([]int, len(headers))
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(maxLengths) {
+				maxLengths = append(maxLengths, 0)
+			}
+			if len(cell.Value) > maxLengths[i] {
+				maxLengths[i] = len(cell.Value)
+			}
+		}
+	}
+	types := models.FitCellTypes(rows, models.InferCellTypes(rows, load.typeOpts))
+	columns := tableColumns(headers, maxLengths, headerLengths, types)
+
+	err := createRawTable(ctx, tx, tableName, columns, false)
+	if err != nil {
+		return nil, loadedRows{}, err
+	}
+	err = models.InsertColumns(ctx, tx, id, columns)
+	if err != nil {
+		return nil, loadedRows{}, err
+	}
+
+	columnNames := make([]string, len(columns))
+	for i, column := range columns {
+		columnNames[i] = column.Name
+	}
+	next := 0
+	rowsLoaded, err := copyRows(ctx, tx, tableName, columnNames, func() ([]interface{}, error) {
+		if next == len(rows) {
+			return nil, io.EOF
+		}
+		row := rows[next]
+		next++
+		// Every value fits its column's type, as columns with any that don't are text
+		values := make([]interface{}, len(columns))
+		for i, column := range columns {
+			if column.Index >= len(row) {
+				continue
+			}
+			value, err := models.DefaultParsingProfile.Convert(column.Type, row[column.Index].Value)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", column.Name, err)
+			}
+			values[i] = value
+		}
+		return values, nil
+	})
+	if err != nil {
+		return nil, loadedRows{}, err
+	}
+	loaded, err := recordRows(ctx, tx, id, tableName, columnNames, rowsLoaded, hasHeader, load.dedup)
+	if err != nil {
+		return nil, loadedRows{}, err
+	}
+	return columns, loaded, nil
+}
+
+// insertSheetTable records the raw table of a worksheet under the workbook's upload
+func insertSheetTable(ctx context.Context, tx *models.Tx, file models.File, uploadID int64, sheetName string, layout models.HeaderLayout) (int64, string, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT nextval('core_raw_tables_id_seq')").Scan(&id)
+	if err != nil {
+		return 0, "", fmt.Errorf("error getting next raw table id: %w", err)
+	}
+	tableName := fmt.Sprintf("raw_table_%d", id)
+
+	query := "INSERT INTO core_raw_tables (id, parent_id, sheet_name, name, source_filename, file_size, datetime_uploaded, header_offset, has_header) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	_, err = tx.ExecContext(ctx, query, id, uploadID, sheetName, tableName, file.Header.Filename, file.Header.Size, time.Now(), layout.Offset, layout.HasHeader)
+	if err != nil {
+		return 0, "", fmt.Errorf("error saving sheet %q: %w", sheetName, err)
+	}
+	return id, tableName, nil
+}